@@ -10,3 +10,46 @@ const (
 	DeviceListStrategyCDICRI         = "cdi-cri"
 	DefaultCDIAnnotationPrefix       = cdiapi.AnnotationPrefix
 )
+
+// Annotations read by the Kata runtime to decide how a device is plugged into
+// the VM. They are set on every CDI device and, aggregated over the devices of
+// a container, on the Allocate response.
+const (
+	KataAnnotationPrefix = "xpu.katacontainers.io/"
+	// AttachModeAnnotation is "cold-plug" or "hot-plug"
+	AttachModeAnnotation = KataAnnotationPrefix + "attach-mode"
+	// PCIePortAnnotation is the port type the device is plugged into:
+	// "root-port", "switch-port" or "bridge-port"
+	PCIePortAnnotation = KataAnnotationPrefix + "pcie-port"
+	// PCIePortCountAnnotation is the number of ports to pre-create, per device
+	// in the CDI spec and the total of the container in the Allocate response
+	PCIePortCountAnnotation = KataAnnotationPrefix + "pcie-port-count"
+	// GroupMembersAnnotation lists every function of the IOMMU group of the
+	// device as "<bdf>=<vendor>:<device>:<class>", separated by commas
+	GroupMembersAnnotation = KataAnnotationPrefix + "iommu-group-members"
+	// FabricPartitionAnnotation names the NVLink fabric partition of a GPU or NVSwitch
+	FabricPartitionAnnotation = KataAnnotationPrefix + "fabric-partition"
+	// VFIODriverAnnotation is the VFIO driver of the device, vfio-pci or a
+	// variant such as nvgrace-gpu-vfio-pci
+	VFIODriverAnnotation = KataAnnotationPrefix + "vfio-driver"
+	// CCCapableAnnotation is "true" when the device can be passed through to a confidential VM
+	CCCapableAnnotation = KataAnnotationPrefix + "cc-capable"
+	// CCPlatformAnnotation is the confidential VM technology of the host: "tdx" or "sev-snp"
+	CCPlatformAnnotation = KataAnnotationPrefix + "cc-platform"
+	// IommuModeAnnotation is the type of the IOMMU group, e.g. "DMA-FQ"
+	IommuModeAnnotation = KataAnnotationPrefix + "iommu-mode"
+	// PCIeCapabilitiesAnnotation lists the ATS, PRI and PASID support, e.g. "ats,pasid"
+	PCIeCapabilitiesAnnotation = KataAnnotationPrefix + "pcie-capabilities"
+	// MdevUUIDAnnotation is the UUID of a mediated device, the VFIO device of
+	// the VM is /sys/bus/mdev/devices/<uuid>
+	MdevUUIDAnnotation = KataAnnotationPrefix + "mdev-uuid"
+	// MdevTypeAnnotation is the mdev type of a mediated device, e.g. "nvidia-35"
+	MdevTypeAnnotation = KataAnnotationPrefix + "mdev-type"
+	// ParentBDFAnnotation is the PCI function a mediated device is created on
+	ParentBDFAnnotation = KataAnnotationPrefix + "parent-bdf"
+	// PhysFnAnnotation is the physical function of an SR-IOV virtual function
+	PhysFnAnnotation = KataAnnotationPrefix + "physfn"
+	// SimulatedAnnotation is "true" on the fake devices of the simulated
+	// backend, which must not be passed through
+	SimulatedAnnotation = KataAnnotationPrefix + "simulated"
+)
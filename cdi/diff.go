@@ -0,0 +1,103 @@
+package cdi
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// DeviceChange describes how a device present in both specs differs
+type DeviceChange struct {
+	Name    string
+	Changes []string
+}
+
+// SpecDiff lists the devices added, removed or changed between two specs
+type SpecDiff struct {
+	Added   []string
+	Removed []string
+	Changed []DeviceChange
+	// Spec reports differences of the spec level fields
+	Spec []string
+}
+
+// Empty reports whether the two specs are equivalent
+func (d SpecDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Spec) == 0
+}
+
+// Diff compares two specs device by device. Devices are matched by name,
+// the order of the devices in the files is ignored.
+func Diff(old, new *CdiSpec) SpecDiff {
+	diff := SpecDiff{}
+
+	if old.Version != new.Version {
+		diff.Spec = append(diff.Spec, fmt.Sprintf("cdiVersion: %q -> %q", old.Version, new.Version))
+	}
+	if old.Kind != new.Kind {
+		diff.Spec = append(diff.Spec, fmt.Sprintf("kind: %q -> %q", old.Kind, new.Kind))
+	}
+	diff.Spec = append(diff.Spec, diffAnnotations(old.Annotations, new.Annotations)...)
+	diff.Spec = append(diff.Spec, diffDeviceNodes(old.ContainerEdits.DeviceNodes, new.ContainerEdits.DeviceNodes)...)
+
+	for _, dev := range new.Devices {
+		oldDev := old.Device(dev.Name)
+		if oldDev == nil {
+			diff.Added = append(diff.Added, dev.Name)
+			continue
+		}
+		changes := diffAnnotations(oldDev.Annotations, dev.Annotations)
+		changes = append(changes, diffDeviceNodes(oldDev.ContainerEdits.DeviceNodes, dev.ContainerEdits.DeviceNodes)...)
+		if len(changes) > 0 {
+			diff.Changed = append(diff.Changed, DeviceChange{Name: dev.Name, Changes: changes})
+		}
+	}
+	for _, dev := range old.Devices {
+		if new.Device(dev.Name) == nil {
+			diff.Removed = append(diff.Removed, dev.Name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Name < diff.Changed[j].Name })
+	return diff
+}
+
+func diffAnnotations(old, new map[string]string) []string {
+	changes := []string{}
+	for key, value := range new {
+		oldValue, ok := old[key]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("+annotation %s=%s", key, value))
+		case oldValue != value:
+			changes = append(changes, fmt.Sprintf("~annotation %s: %s -> %s", key, oldValue, value))
+		}
+	}
+	for key, value := range old {
+		if _, ok := new[key]; !ok {
+			changes = append(changes, fmt.Sprintf("-annotation %s=%s", key, value))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func diffDeviceNodes(old, new []*DeviceNode) []string {
+	paths := func(nodes []*DeviceNode) []string {
+		p := []string{}
+		for _, node := range nodes {
+			if node != nil {
+				p = append(p, node.Path)
+			}
+		}
+		sort.Strings(p)
+		return p
+	}
+	oldPaths, newPaths := paths(old), paths(new)
+	if reflect.DeepEqual(oldPaths, newPaths) {
+		return nil
+	}
+	return []string{fmt.Sprintf("deviceNodes: %v -> %v", oldPaths, newPaths)}
+}
@@ -3,7 +3,10 @@ package cdi
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -82,7 +85,8 @@ func (cs *CdiSpec) NewDevice(devName string, annotations map[string]string, devi
 	cs.Devices = append(cs.Devices, device)
 }
 
-func (spec *CdiSpec) Save(cdiPath, fName, format string) {
+// Save writes the spec to cdiPath/fName with the suffix of the format
+func (spec *CdiSpec) Save(cdiPath, fName, format string) error {
 	suffix := ".json"
 	if format == "YAML" {
 		suffix = ".yaml"
@@ -92,38 +96,84 @@ func (spec *CdiSpec) Save(cdiPath, fName, format string) {
 	file_path := cdiPath + fName + suffix
 	file, err := os.Create(file_path)
 	if err != nil {
-		fmt.Println("Error creating file:", err)
-		return
+		return fmt.Errorf("error creating file: %w", err)
 	}
 	defer file.Close()
 
-	var data []byte
+	if err := spec.Encode(file, format); err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+	return nil
+}
 
+// Encode writes the spec to w, as YAML if format is "YAML" and as JSON otherwise
+func (spec *CdiSpec) Encode(w io.Writer, format string) error {
 	switch format {
-	// Encode the CdiSpec instance to YAML file
+	// Encode the CdiSpec instance to YAML
 	case "YAML":
 		// Create a new YAML encoder with pretty format
-		encoder := yaml.NewEncoder(file)
+		encoder := yaml.NewEncoder(w)
 		defer encoder.Close()
 		encoder.SetIndent(2)
 		if err := encoder.Encode(&spec); err != nil {
-			fmt.Println("Error encoding YAML:", err)
-			return
+			return fmt.Errorf("error encoding YAML: %w", err)
 		}
-	// Serialize the CdiSpec instance to JSON file
+	// Serialize the CdiSpec instance to JSON
 	default:
-		data, err = json.MarshalIndent(spec, "", "  ")
+		data, err := json.MarshalIndent(spec, "", "  ")
 		if err != nil {
-			fmt.Println("Error marshalling JSON:", err)
-			return
+			return fmt.Errorf("error marshalling JSON: %w", err)
+		}
+		if _, err = w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads a spec file, JSON files are recognized by their extension and
+// anything else is parsed as YAML
+func Load(path string) (*CdiSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	format := "YAML"
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		format = "JSON"
+	}
+	spec, err := Parse(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CDI spec %s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// Parse decodes spec data in the given format, "JSON" or "YAML"
+func Parse(data []byte, format string) (*CdiSpec, error) {
+	var spec CdiSpec
+	switch format {
+	case "JSON":
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return nil, err
 		}
-		if _, err = file.Write(data); err != nil {
-			fmt.Println("Error writing to file:", err)
-			return
+	default:
+		if err := yaml.Unmarshal(data, &spec); err != nil {
+			return nil, err
 		}
 	}
+	return &spec, nil
+}
 
-	fmt.Println("Data successfully written to file")
+// Device returns the device with the given name, nil if the spec has none
+func (spec *CdiSpec) Device(name string) *Device {
+	for i := range spec.Devices {
+		if spec.Devices[i].Name == name {
+			return &spec.Devices[i]
+		}
+	}
+	return nil
 }
 
 // func exampleCdiSpec() CdiSpec {
@@ -204,26 +254,6 @@ func (spec *CdiSpec) Save(cdiPath, fName, format string) {
 // 	}
 // }
 
-// func Load(json_data string) {
-// 	var CdiSpec CdiSpec
-// 	err := json.Unmarshal([]byte(json_data), &CdiSpec)
-// 	if err != nil {
-// 		log.Fatalf("error: %v", err)
-// 	}
-
-// 	fmt.Printf("Parsed JSON: %+v\n", CdiSpec)
-// }
-
-// func Load2() {
-//   var SpecData CdiSpec
-// 	err := yaml.Unmarshal([]byte(data), &CdiSpec)
-// 	if err != nil {
-// 		log.Fatalf("error: %v", err)
-// 	}
-
-// 	fmt.Printf("Parsed YAML: %+v\n", CdiSpec)
-// }
-
 // func main() {
 // 	cs := exampleCdiSpec()
 // 	Save(cs, "/var/run/cdi", "cdi-config", "JSON")
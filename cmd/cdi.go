@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/pkg/config"
+	"kata-xpu-device-plugin/pkg/device_plugin"
+)
+
+// cdiCommands are the subcommands of the cdi subcommand
+var cdiCommands = map[string]func(args []string) error{
+	"generate": runCDIGenerate,
+	"validate": runCDIValidate,
+	"diff":     runCDIDiff,
+}
+
+func runCDI(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: cdi generate|validate|diff [flags]")
+	}
+	run, ok := cdiCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown cdi command %q, expected generate, validate or diff", args[0])
+	}
+	return run(args[1:])
+}
+
+// runCDIGenerate renders the CDI spec from discovery, to stdout unless an
+// output directory is given
+func runCDIGenerate(args []string) error {
+	flags := flag.NewFlagSet("cdi generate", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultConfigPath, "path to the plugin configuration file")
+	sysfsRoot := flags.String("sysfs-root", "", "sysfs mount point to discover devices from (default from config, /sys)")
+	pciIds := flags.String("pci-ids", "", "pci.ids database used to name the devices (default from config)")
+	outputDir := flags.String("output-dir", "", "directory to write the spec to instead of stdout, e.g. /var/run/cdi")
+	format := flags.String("format", "yaml", "spec format: yaml or json")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if *sysfsRoot != "" {
+		cfg.Discovery.SysfsRoot = *sysfsRoot
+	}
+	if *pciIds != "" {
+		cfg.Discovery.PciIdsPath = *pciIds
+	}
+
+	specFormat := strings.ToUpper(*format)
+	if specFormat != "YAML" && specFormat != "JSON" {
+		return fmt.Errorf("unknown spec format %q", *format)
+	}
+
+	spec := device_plugin.NewManager(cfg, device_plugin.Options{}).GenerateCDISpec()
+	if *outputDir == "" {
+		return spec.Encode(os.Stdout, specFormat)
+	}
+
+	if err := os.MkdirAll(*outputDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(*outputDir, device_plugin.CDISpecName+"."+strings.ToLower(specFormat))
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := spec.Encode(file, specFormat); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d devices to %s\n", len(spec.Devices), path)
+	return nil
+}
+
+// runCDIValidate checks a spec file with the upstream CDI parser and the
+// plugin specific checks
+func runCDIValidate(args []string) error {
+	flags := flag.NewFlagSet("cdi validate", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultConfigPath, "path to the plugin configuration file")
+	sysfsRoot := flags.String("sysfs-root", "", "sysfs mount point the IOMMU groups are checked against (default from config, /sys)")
+	devRoot := flags.String("dev-root", "", "root the device nodes of the spec are looked up under (default from config, /)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: cdi validate [flags] <file>")
+	}
+	path := flags.Arg(0)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if *sysfsRoot != "" {
+		cfg.Discovery.SysfsRoot = *sysfsRoot
+	}
+	if *devRoot == "" {
+		*devRoot = cfg.Discovery.DevRoot
+	}
+
+	if _, err := cdiapi.ReadSpec(path, 0); err != nil {
+		return err
+	}
+	spec, err := cdihandler.Load(path)
+	if err != nil {
+		return err
+	}
+
+	errs := device_plugin.NewManager(cfg, device_plugin.Options{}).ValidateCDISpec(spec, *devRoot)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: %d problems found", path, len(errs))
+	}
+	fmt.Printf("%s: valid, %d devices\n", path, len(spec.Devices))
+	return nil
+}
+
+// runCDIDiff prints the devices added, removed or changed between two spec
+// files and exits with status 1 if there are any, like diff(1)
+func runCDIDiff(args []string) error {
+	flags := flag.NewFlagSet("cdi diff", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: cdi diff <old> <new>")
+	}
+
+	old, err := cdihandler.Load(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	new, err := cdihandler.Load(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	diff := cdihandler.Diff(old, new)
+	printSpecDiff(os.Stdout, diff)
+	if !diff.Empty() {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+func printSpecDiff(w io.Writer, diff cdihandler.SpecDiff) {
+	for _, change := range diff.Spec {
+		fmt.Fprintf(w, "~ spec: %s\n", change)
+	}
+	for _, name := range diff.Added {
+		fmt.Fprintf(w, "+ device %s\n", name)
+	}
+	for _, name := range diff.Removed {
+		fmt.Fprintf(w, "- device %s\n", name)
+	}
+	for _, dev := range diff.Changed {
+		fmt.Fprintf(w, "~ device %s\n", dev.Name)
+		for _, change := range dev.Changes {
+			fmt.Fprintf(w, "    %s\n", change)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"kata-xpu-device-plugin/pkg/config"
+	"kata-xpu-device-plugin/pkg/device_plugin"
+)
+
+// runCordon takes a device out of service through the admin API
+func runCordon(args []string) error {
+	return cordonCommand("cordon", args)
+}
+
+// runUncordon puts a cordoned device back in service
+func runUncordon(args []string) error {
+	return cordonCommand("uncordon", args)
+}
+
+func cordonCommand(name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultConfigPath, "path to the plugin configuration file")
+	socket := flags.String("socket", "", "admin socket of the daemon (default from config)")
+	timeout := flags.Duration("timeout", 5*time.Second, "timeout of the request")
+	var entry device_plugin.CordonEntry
+	flags.StringVar(&entry.IommuGroup, "group", "", "IOMMU group of the device")
+	flags.StringVar(&entry.BDF, "bdf", "", "PCI address of a function of the device")
+	flags.StringVar(&entry.Serial, "serial", "", "PCIe serial number of a function of the device")
+	if name == "cordon" {
+		flags.StringVar(&entry.Reason, "reason", "", "why the device is taken out of service")
+	}
+	flags.Parse(args)
+
+	if *socket == "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		*socket = cfg.Admin.Socket
+	}
+	if *socket == "" {
+		return fmt.Errorf("the admin API is disabled in the configuration, pass -socket")
+	}
+
+	if name == "cordon" {
+		return device_plugin.CordonDevice(*socket, entry, *timeout)
+	}
+	return device_plugin.UncordonDevice(*socket, entry, *timeout)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"kata-xpu-device-plugin/pkg/config"
+	"kata-xpu-device-plugin/pkg/device_plugin"
+)
+
+// runDiscover walks sysfs like the daemon does and prints the inventory,
+// without writing a CDI spec or registering with kubelet
+func runDiscover(args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultConfigPath, "path to the plugin configuration file")
+	sysfsRoot := flags.String("sysfs-root", "", "sysfs mount point to discover devices from (default from config, /sys)")
+	pciIds := flags.String("pci-ids", "", "pci.ids database used to name the devices (default from config)")
+	snapshot := flags.String("snapshot", "", "archive written by the snapshot command to discover devices from instead of sysfs")
+	output := flags.String("o", "table", "output format: table, json or yaml")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if *sysfsRoot != "" {
+		cfg.Discovery.SysfsRoot = *sysfsRoot
+	}
+	if *pciIds != "" {
+		cfg.Discovery.PciIdsPath = *pciIds
+	}
+
+	opts := device_plugin.Options{}
+	if *snapshot != "" {
+		snap, err := device_plugin.OpenSnapshot(*snapshot)
+		if err != nil {
+			return err
+		}
+		opts.Sysfs = snap.Sysfs
+		// The names of the host, unless another database is asked for
+		if *pciIds == "" && snap.PciIds != nil {
+			opts.PciIds = snap.PciIds
+		}
+		fmt.Fprintf(os.Stderr, "Discovering from the snapshot of %s captured at %s\n", snap.Info.Hostname, snap.Info.CapturedAt.Format(time.RFC3339))
+	}
+
+	result := device_plugin.NewManager(cfg, opts).Discover()
+	return printInventory(os.Stdout, result, *output)
+}
+
+func printInventory(w io.Writer, result device_plugin.DiscoveryResult, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		defer encoder.Close()
+		encoder.SetIndent(2)
+		return encoder.Encode(result)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "BDF\tVENDOR:DEVICE\tMODEL\tIOMMU GROUP\tGROUP MEMBERS\tDRIVER\tNUMA\tRESOURCE\tCDI")
+		for _, dev := range result.Devices {
+			fmt.Fprintf(tw, "%s\t%s:%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+				dev.BDF, dev.VendorID, dev.DeviceID, dev.ModelName, dev.IommuGroup,
+				strings.Join(dev.GroupMembers, ","), dev.Driver, dev.NumaNode,
+				dev.ResourceName, strings.Join(dev.CDINames, ","))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		if result.Host != nil {
+			platform := result.Host.Platform()
+			if platform == "" {
+				platform = "none"
+			}
+			fmt.Fprintf(w, "\nConfidential computing (host platform: %s):\n", platform)
+			fmt.Fprintln(tw, "BDF\tIOMMU MODE\tPCIE CAPABILITIES\tCAPABLE\tREASON")
+			for _, dev := range result.Devices {
+				if cc := dev.ConfidentialComputing; cc != nil {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%s\n", dev.BDF, cc.IommuMode, cc.Capabilities(), cc.Capable, cc.Reason)
+				}
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+
+		if len(result.Filtered) == 0 {
+			return nil
+		}
+
+		fmt.Fprintln(w, "\nFiltered:")
+		fmt.Fprintln(tw, "BDF\tVENDOR:DEVICE\tCLASS\tDRIVER\tREASON")
+		for _, dev := range result.Filtered {
+			fmt.Fprintf(tw, "%s\t%s:%s\t%s\t%s\t%s\n", dev.BDF, dev.VendorID, dev.DeviceID, dev.Class, dev.Driver, dev.Reason)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
@@ -1,7 +1,71 @@
 package main
 
-import "kata-xpu-device-plugin/pkg/device_plugin"
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"kata-xpu-device-plugin/pkg/config"
+	"kata-xpu-device-plugin/pkg/device_plugin"
+)
+
+// subcommands maps the name of a CLI subcommand to its entry point. Without
+// a subcommand the device plugin daemon is started.
+var subcommands = map[string]func(args []string) error{
+	"discover":  runDiscover,
+	"cdi":       runCDI,
+	"status":    runStatus,
+	"preflight": runPreflight,
+	"cordon":    runCordon,
+	"uncordon":  runUncordon,
+	"snapshot":  runSnapshot,
+}
+
+// exitStatus is returned by subcommands that exit non-zero without an error
+// message, like cdi diff when the specs differ
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
 
 func main() {
-	device_plugin.InitiateDevicePlugin()
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				var status exitStatus
+				if errors.As(err, &status) {
+					os.Exit(int(status))
+				}
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	configPath := flag.String("config", config.DefaultConfigPath, "path to the plugin configuration file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+
+	m := device_plugin.NewManager(cfg, device_plugin.Options{})
+
+	// Stop the device plugins on termination
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received signal %v, shutting down", sig)
+		m.Shutdown()
+	}()
+
+	m.Run()
 }
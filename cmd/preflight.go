@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"kata-xpu-device-plugin/pkg/config"
+	"kata-xpu-device-plugin/pkg/preflight"
+)
+
+// runPreflight checks the host IOMMU and VFIO setup like the daemon does at
+// startup and exits non-zero when a check fails
+func runPreflight(args []string) error {
+	flags := flag.NewFlagSet("preflight", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultConfigPath, "path to the plugin configuration file")
+	sysfsRoot := flags.String("sysfs-root", "", "sysfs mount point (default from config, /sys)")
+	procRoot := flags.String("proc-root", "", "procfs mount point (default from config, /proc)")
+	output := flags.String("o", "text", "output format: text or json")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if *sysfsRoot != "" {
+		cfg.Discovery.SysfsRoot = *sysfsRoot
+	}
+	if *procRoot != "" {
+		cfg.Preflight.ProcRoot = *procRoot
+	}
+
+	report := preflight.Run(preflight.Options{
+		SysfsRoot: cfg.Discovery.SysfsRoot,
+		ProcRoot:  cfg.Preflight.ProcRoot,
+		Ignore:    cfg.Preflight.Ignore,
+	})
+	switch *output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	case "text":
+		if err := printPreflight(os.Stdout, report); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+	if report.Failed() {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+func printPreflight(w io.Writer, report preflight.Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tMESSAGE")
+	for _, result := range report.Results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Name, result.Status, result.Message)
+	}
+	return tw.Flush()
+}
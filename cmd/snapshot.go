@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"kata-xpu-device-plugin/pkg/config"
+	"kata-xpu-device-plugin/pkg/device_plugin"
+)
+
+// runSnapshot captures the sysfs and procfs files discovery reads into an
+// archive that discover -snapshot replays, e.g. to attach to a bug report
+func runSnapshot(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultConfigPath, "path to the plugin configuration file")
+	sysfsRoot := flags.String("sysfs-root", "", "sysfs mount point (default from config, /sys)")
+	procRoot := flags.String("proc-root", "", "procfs mount point (default from config, /proc)")
+	pciIds := flags.String("pci-ids", "", "pci.ids database used to name the devices (default from config)")
+	output := flags.String("o", "kata-xpu-snapshot.tar.gz", "archive to write, - for stdout")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if *sysfsRoot != "" {
+		cfg.Discovery.SysfsRoot = *sysfsRoot
+	}
+	if *procRoot != "" {
+		cfg.Preflight.ProcRoot = *procRoot
+	}
+	if *pciIds != "" {
+		cfg.Discovery.PciIdsPath = *pciIds
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	info, err := device_plugin.CaptureSnapshot(w, cfg.Discovery.SysfsRoot, cfg.Preflight.ProcRoot, cfg.Discovery.PciIdsPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range info.Skipped {
+		fmt.Fprintf(os.Stderr, "Could not read %s, captured empty\n", name)
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "Wrote snapshot of %s to %s\n", info.Hostname, *output)
+	}
+	return nil
+}
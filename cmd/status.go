@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"kata-xpu-device-plugin/pkg/config"
+	"kata-xpu-device-plugin/pkg/device_plugin"
+)
+
+// runStatus queries the admin API of the running daemon
+func runStatus(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultConfigPath, "path to the plugin configuration file")
+	socket := flags.String("socket", "", "admin socket of the daemon (default from config)")
+	timeout := flags.Duration("timeout", 5*time.Second, "timeout of the request")
+	output := flags.String("o", "text", "output format: text or json")
+	flags.Parse(args)
+
+	if *socket == "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		*socket = cfg.Admin.Socket
+	}
+	if *socket == "" {
+		return fmt.Errorf("the admin API is disabled in the configuration, pass -socket")
+	}
+
+	status, err := device_plugin.QueryStatus(*socket, *timeout)
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	case "text":
+		return printStatus(os.Stdout, status)
+	default:
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+}
+
+func printStatus(w io.Writer, status *device_plugin.Status) error {
+	fmt.Fprintf(w, "Version:  %s\n", status.Version)
+	fmt.Fprintf(w, "Frontend: %s\n", status.Frontend)
+	if status.CDI.Path != "" {
+		fmt.Fprintf(w, "CDI spec: %s, %d devices, written %s", status.CDI.Path, status.CDI.Devices, status.CDI.Time.Format(time.RFC3339))
+		if status.CDI.Error != "" {
+			fmt.Fprintf(w, ", error: %s", status.CDI.Error)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if status.Preflight != nil {
+		fmt.Fprintln(w, "\nPreflight")
+		if err := printPreflight(w, *status.Preflight); err != nil {
+			return err
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, plugin := range status.Plugins {
+		registration := "registered"
+		if !plugin.Registered {
+			registration = "not registered"
+			if plugin.RegistrationError != "" {
+				registration += ": " + plugin.RegistrationError
+			}
+		}
+		fmt.Fprintf(w, "\n%s\n", plugin.ResourceName)
+		fmt.Fprintf(w, "  socket:        %s\n", plugin.SocketPath)
+		fmt.Fprintf(w, "  registration:  %s\n", registration)
+		fmt.Fprintf(w, "  watch streams: %d\n", plugin.WatchStreams)
+		fmt.Fprintln(tw, "  DEVICE\tHEALTH\tREASONS")
+		for _, dev := range plugin.Devices {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", dev.ID, dev.Health, formatReasons(dev.Reasons))
+		}
+		tw.Flush()
+	}
+
+	if len(status.Cordons) > 0 {
+		fmt.Fprintf(w, "\nCordoned\n")
+		fmt.Fprintln(tw, "  DEVICE\tREASON\tSINCE")
+		for _, entry := range status.Cordons {
+			reason := entry.Reason
+			if reason == "" {
+				reason = "-"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", entry, reason, entry.Since.Format(time.RFC3339))
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintf(w, "\nAllocations\n")
+	if len(status.Ledger) == 0 {
+		fmt.Fprintln(w, "  none")
+		return nil
+	}
+	fmt.Fprintln(tw, "  DEVICE\tRESOURCE\tPOD\tCONTAINER\tALLOCATED\tLEAKED")
+	for _, entry := range status.Ledger {
+		pod := "-"
+		if entry.Pod != "" {
+			pod = entry.Namespace + "/" + entry.Pod
+		}
+		container := entry.Container
+		if container == "" {
+			container = "-"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%t\n", entry.DeviceID, entry.ResourceName, pod, container,
+			entry.AllocatedAt.Format(time.RFC3339), entry.Leaked)
+	}
+	return tw.Flush()
+}
+
+func formatReasons(reasons map[string]string) string {
+	if len(reasons) == 0 {
+		return "-"
+	}
+	parts := []string{}
+	for source, reason := range reasons {
+		parts = append(parts, source+": "+reason)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "; ")
+}
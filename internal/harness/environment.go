@@ -0,0 +1,190 @@
+package harness
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// Device IDs of common NVIDIA functions with their pci.ids names
+const (
+	H100SXM5Device = "2330"
+	H100NVSwitch   = "22a3"
+	NvidiaAudio    = "22ba"
+)
+
+// NvidiaDeviceNames are the entries written to the fake pci.ids database
+var NvidiaDeviceNames = map[string]string{
+	H100SXM5Device: "GH100 [H100 SXM5 80GB]",
+	H100NVSwitch:   "GH100 [H100 NVSwitch]",
+	NvidiaAudio:    "AD102 High Definition Audio Controller",
+}
+
+// Environment is a temporary directory holding a fake sysfs tree, a fake
+// kubelet and a plugin configuration pointing at both
+type Environment struct {
+	Dir     string
+	Sysfs   *SysfsTree
+	Kubelet *FakeKubelet
+	// PluginWatcher registers the plugins of the plugins_registry directory
+	PluginWatcher *FakePluginWatcher
+	Config        *config.Config
+	// KubeClient is a fake API server holding the Node of the environment
+	KubeClient *fake.Clientset
+}
+
+// NewEnvironment lays out an environment below dir. The fake kubelet is not
+// started and the sysfs tree has no devices yet.
+func NewEnvironment(dir string) (*Environment, error) {
+	sysfs, err := NewSysfsTree(filepath.Join(dir, "sys"))
+	if err != nil {
+		return nil, err
+	}
+	pciIds := filepath.Join(dir, "pci.ids")
+	if err := WritePciIds(pciIds, NvidiaDeviceNames); err != nil {
+		return nil, err
+	}
+
+	// A host set up for passthrough, so that the preflight checks pass
+	for module, params := range map[string]map[string]string{
+		"vfio":             {"enable_unsafe_noiommu_mode": "N"},
+		"vfio_pci":         nil,
+		"vfio_iommu_type1": {"allow_unsafe_interrupts": "N"},
+	} {
+		if err := sysfs.LoadModule(module, params); err != nil {
+			return nil, err
+		}
+	}
+	procRoot := filepath.Join(dir, "proc")
+	if err := os.MkdirAll(procRoot, 0755); err != nil {
+		return nil, err
+	}
+	cmdline := "BOOT_IMAGE=/vmlinuz root=/dev/sda1 intel_iommu=on iommu=pt\n"
+	if err := os.WriteFile(filepath.Join(procRoot, "cmdline"), []byte(cmdline), 0644); err != nil {
+		return nil, err
+	}
+
+	cfg := config.Default()
+	cfg.NodeName = "harness"
+	cfg.Discovery.SysfsRoot = sysfs.Root
+	cfg.Discovery.PciIdsPath = pciIds
+	cfg.Preflight.ProcRoot = procRoot
+	cfg.Discovery.DevRoot = dir
+	cfg.Kubelet.DevicePluginDir = filepath.Join(dir, "device-plugins")
+	cfg.CDI.SpecDir = filepath.Join(dir, "cdi")
+	cfg.Ledger.CheckpointPath = filepath.Join(dir, "state", "allocations.json")
+	cfg.Ledger.ReconcileInterval = time.Hour
+	cfg.Cordon.File = filepath.Join(dir, "state", "cordon.yaml")
+	cfg.PodResources.Socket = filepath.Join(dir, "pod-resources", "kubelet.sock")
+	cfg.Admin.Socket = filepath.Join(dir, "admin.sock")
+	cfg.NodeFeatures.FeaturesDir = filepath.Join(dir, "features.d")
+	cfg.DRA.PluginDir = filepath.Join(dir, "plugins")
+	cfg.DRA.RegistryDir = filepath.Join(dir, "plugins_registry")
+	cfg.Kubelet.PluginDir = filepath.Join(cfg.DRA.PluginDir, "kata-xpu-device-plugin")
+	cfg.Kubelet.RegistryDir = cfg.DRA.RegistryDir
+
+	for _, d := range []string{cfg.CDI.SpecDir, cfg.DRA.PluginDir, cfg.DRA.RegistryDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: cfg.NodeName, UID: types.UID(cfg.NodeName)}}
+
+	return &Environment{
+		Dir:           dir,
+		Sysfs:         sysfs,
+		Kubelet:       NewFakeKubelet(cfg.Kubelet.DevicePluginDir),
+		PluginWatcher: NewFakePluginWatcher(cfg.Kubelet.RegistryDir),
+		Config:        cfg,
+		KubeClient:    fake.NewSimpleClientset(node),
+	}, nil
+}
+
+// AddVFIOGroup creates the /dev/vfio node of an IOMMU group, as a plain file
+func (e *Environment) AddVFIOGroup(group int) error {
+	dir := filepath.Join(e.Config.Discovery.DevRoot, "dev", "vfio")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, strconv.Itoa(group)), nil, 0600)
+}
+
+// AddHGXBoard adds an HGX H100 baseboard: gpus GPUs, each in its own IOMMU
+// group starting at firstGroup with an audio companion function, and
+// switches NVSwitches in the following groups, all bound to vfio-pci and
+// with their /dev/vfio node
+func (e *Environment) AddHGXBoard(bus int, firstGroup int, numaNode int, gpus int, switches int) error {
+	for group := firstGroup; group < firstGroup+gpus+switches; group++ {
+		if err := e.AddVFIOGroup(group); err != nil {
+			return err
+		}
+	}
+	group := firstGroup
+	for i := 0; i < gpus; i++ {
+		bdf := fmt.Sprintf("0000:%02x:00", bus+i)
+		for _, dev := range []PCIDevice{
+			{BDF: bdf + ".0", Vendor: "10de", Device: H100SXM5Device, Class: "030200"},
+			{BDF: bdf + ".1", Vendor: "10de", Device: NvidiaAudio, Class: "040300"},
+		} {
+			dev.Driver = "vfio-pci"
+			dev.IommuGroup = group
+			dev.NumaNode = numaNode
+			if err := e.Sysfs.AddDevice(dev); err != nil {
+				return err
+			}
+		}
+		group++
+	}
+	for i := 0; i < switches; i++ {
+		err := e.Sysfs.AddDevice(PCIDevice{
+			BDF:        fmt.Sprintf("0000:%02x:00.0", bus+gpus+i),
+			Vendor:     "10de",
+			Device:     H100NVSwitch,
+			Class:      "068000",
+			Driver:     "vfio-pci",
+			IommuGroup: group,
+			NumaNode:   numaNode,
+		})
+		if err != nil {
+			return err
+		}
+		group++
+	}
+	return nil
+}
+
+// Close stops the fake kubelet and removes the directory
+func (e *Environment) Close() error {
+	e.Kubelet.Stop()
+	return os.RemoveAll(e.Dir)
+}
+
+// WritePciIds writes a pci.ids database with the given NVIDIA devices
+func WritePciIds(path string, devices map[string]string) error {
+	ids := make([]string, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var b strings.Builder
+	b.WriteString("# Fake pci.ids written by the test harness\n")
+	b.WriteString("10de  NVIDIA Corporation\n")
+	for _, id := range ids {
+		fmt.Fprintf(&b, "\t%s  %s\n", id, devices[id])
+	}
+	b.WriteString("10df  Emulex Corporation\n")
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
@@ -0,0 +1,218 @@
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// FakeKubelet serves the kubelet device plugin registration API in a
+// directory and records the registrations
+type FakeKubelet struct {
+	Dir string
+	// Reject fails the registration of the resources by name with the reason
+	Reject map[string]string
+	server *grpc.Server
+
+	mu            sync.Mutex
+	registrations map[string]*pluginapi.RegisterRequest
+	notify        chan struct{}
+}
+
+// NewFakeKubelet returns a kubelet serving dir/kubelet.sock once started
+func NewFakeKubelet(dir string) *FakeKubelet {
+	return &FakeKubelet{
+		Dir:           dir,
+		Reject:        make(map[string]string),
+		registrations: make(map[string]*pluginapi.RegisterRequest),
+		notify:        make(chan struct{}),
+	}
+}
+
+// SocketPath is the registration socket, device plugins live next to it
+func (k *FakeKubelet) SocketPath() string {
+	return filepath.Join(k.Dir, "kubelet.sock")
+}
+
+// Start serves the registration API
+func (k *FakeKubelet) Start() error {
+	if err := os.MkdirAll(k.Dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(k.SocketPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sock, err := net.Listen("unix", k.SocketPath())
+	if err != nil {
+		return err
+	}
+	k.server = grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(k.server, k)
+	go k.server.Serve(sock)
+	return nil
+}
+
+// Stop stops serving and removes the socket, which device plugins take as a
+// kubelet restart
+func (k *FakeKubelet) Stop() {
+	if k.server != nil {
+		k.server.Stop()
+		k.server = nil
+	}
+	os.Remove(k.SocketPath())
+}
+
+// Register implements the kubelet registration service
+func (k *FakeKubelet) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	if req.Version != pluginapi.Version {
+		return nil, fmt.Errorf("unsupported device plugin API version %s", req.Version)
+	}
+	k.mu.Lock()
+	if reason, ok := k.Reject[req.ResourceName]; ok {
+		k.mu.Unlock()
+		return nil, errors.New(reason)
+	}
+	k.registrations[req.ResourceName] = req
+	close(k.notify)
+	k.notify = make(chan struct{})
+	k.mu.Unlock()
+	return &pluginapi.Empty{}, nil
+}
+
+// Registrations returns the last registration of every resource
+func (k *FakeKubelet) Registrations() map[string]*pluginapi.RegisterRequest {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	registrations := make(map[string]*pluginapi.RegisterRequest, len(k.registrations))
+	for name, req := range k.registrations {
+		registrations[name] = req
+	}
+	return registrations
+}
+
+// WaitForRegistration waits until resourceName is registered
+func (k *FakeKubelet) WaitForRegistration(resourceName string, timeout time.Duration) (*pluginapi.RegisterRequest, error) {
+	deadline := time.After(timeout)
+	for {
+		k.mu.Lock()
+		req, ok := k.registrations[resourceName]
+		notify := k.notify
+		k.mu.Unlock()
+		if ok {
+			return req, nil
+		}
+		select {
+		case <-notify:
+		case <-deadline:
+			return nil, fmt.Errorf("resource %s not registered after %v", resourceName, timeout)
+		}
+	}
+}
+
+// Dial connects to the device plugin registered with the endpoint
+func (k *FakeKubelet) Dial(req *pluginapi.RegisterRequest) (*PluginClient, error) {
+	return DialPlugin(filepath.Join(k.Dir, req.Endpoint))
+}
+
+// PluginClient drives a device plugin the way kubelet does
+type PluginClient struct {
+	conn   *grpc.ClientConn
+	client pluginapi.DevicePluginClient
+}
+
+// DialPlugin connects to the device plugin socket
+func DialPlugin(socketPath string) (*PluginClient, error) {
+	conn, err := grpc.Dial(socketPath,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &PluginClient{conn: conn, client: pluginapi.NewDevicePluginClient(conn)}, nil
+}
+
+// Close closes the connection
+func (c *PluginClient) Close() error {
+	return c.conn.Close()
+}
+
+// Options returns the device plugin options
+func (c *PluginClient) Options(ctx context.Context) (*pluginapi.DevicePluginOptions, error) {
+	return c.client.GetDevicePluginOptions(ctx, &pluginapi.Empty{})
+}
+
+// Watch opens a ListAndWatch stream and forwards every device list until
+// ctx is done or the stream fails, then closes the channel
+func (c *PluginClient) Watch(ctx context.Context) (<-chan []*pluginapi.Device, error) {
+	stream, err := c.client.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		return nil, err
+	}
+	updates := make(chan []*pluginapi.Device, 16)
+	go func() {
+		defer close(updates)
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case updates <- resp.Devices:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// Allocate allocates the devices to a single container
+func (c *PluginClient) Allocate(ctx context.Context, deviceIDs ...string) (*pluginapi.ContainerAllocateResponse, error) {
+	resp, err := c.client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: deviceIDs}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.ContainerResponses) != 1 {
+		return nil, fmt.Errorf("expected 1 container response, got %d", len(resp.ContainerResponses))
+	}
+	return resp.ContainerResponses[0], nil
+}
+
+// GetPreferredAllocation asks for size devices of a single container
+func (c *PluginClient) GetPreferredAllocation(ctx context.Context, available, mustInclude []string, size int) ([]string, error) {
+	resp, err := c.client.GetPreferredAllocation(ctx, &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs:   available,
+			MustIncludeDeviceIDs: mustInclude,
+			AllocationSize:       int32(size),
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.ContainerResponses) != 1 {
+		return nil, fmt.Errorf("expected 1 container response, got %d", len(resp.ContainerResponses))
+	}
+	return resp.ContainerResponses[0].DeviceIDs, nil
+}
+
+// PreStartContainer calls the pre-start hook
+func (c *PluginClient) PreStartContainer(ctx context.Context, deviceIDs ...string) error {
+	_, err := c.client.PreStartContainer(ctx, &pluginapi.PreStartContainerRequest{DevicesIDs: deviceIDs})
+	return err
+}
@@ -0,0 +1,126 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// FakePluginWatcher plays the kubelet plugin watcher on a plugins_registry
+// directory: it asks every registration socket for its PluginInfo and
+// reports the registration status back
+type FakePluginWatcher struct {
+	Dir string
+	// Reject fails the registration of the plugins by name with the reason
+	Reject map[string]string
+
+	mu      sync.Mutex
+	seen    map[string]bool                    // registration sockets already notified
+	plugins map[string]*registerapi.PluginInfo // notified plugins by name
+}
+
+// NewFakePluginWatcher returns a plugin watcher of dir
+func NewFakePluginWatcher(dir string) *FakePluginWatcher {
+	return &FakePluginWatcher{
+		Dir:     dir,
+		Reject:  make(map[string]string),
+		seen:    make(map[string]bool),
+		plugins: make(map[string]*registerapi.PluginInfo),
+	}
+}
+
+// Sync registers the sockets of the directory not seen yet, like kubelet
+// does when a socket shows up. Sockets nobody serves are skipped.
+func (w *FakePluginWatcher) Sync(ctx context.Context) error {
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		socketPath := filepath.Join(w.Dir, entry.Name())
+		w.mu.Lock()
+		seen := w.seen[socketPath]
+		w.mu.Unlock()
+		if seen || entry.Type()&fs.ModeSocket == 0 {
+			continue
+		}
+		info, err := w.register(ctx, socketPath)
+		if err != nil {
+			continue
+		}
+		w.mu.Lock()
+		w.seen[socketPath] = true
+		w.plugins[info.Name] = info
+		w.mu.Unlock()
+	}
+	return nil
+}
+
+func (w *FakePluginWatcher) register(ctx context.Context, socketPath string) (*registerapi.PluginInfo, error) {
+	conn, err := grpc.Dial(socketPath,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := registerapi.NewRegistrationClient(conn)
+	info, err := client.GetInfo(ctx, &registerapi.InfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+	status := &registerapi.RegistrationStatus{PluginRegistered: true}
+	if reason, ok := w.Reject[info.Name]; ok {
+		status = &registerapi.RegistrationStatus{PluginRegistered: false, Error: reason}
+	}
+	if _, err := client.NotifyRegistrationStatus(ctx, status); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Restart forgets every plugin like a restarted kubelet, the next Sync
+// registers them again
+func (w *FakePluginWatcher) Restart() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seen = make(map[string]bool)
+	w.plugins = make(map[string]*registerapi.PluginInfo)
+}
+
+// WaitForPlugin syncs until the registration status of the named plugin was
+// reported, whether it was registered or rejected
+func (w *FakePluginWatcher) WaitForPlugin(name string, timeout time.Duration) (*registerapi.PluginInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		if err := w.Sync(ctx); err != nil {
+			return nil, err
+		}
+		w.mu.Lock()
+		info, ok := w.plugins[name]
+		w.mu.Unlock()
+		if ok {
+			return info, nil
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("plugin %s not registered after %v", name, timeout)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Package harness builds fake environments for the tests of the device
+// plugin on a machine without GPUs: a synthetic sysfs tree, a fake kubelet
+// registration server, a fake plugin watcher and a client driving the device
+// plugin API.
+package harness
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PCIDevice describes a PCI function of a fake sysfs tree
+type PCIDevice struct {
+	// BDF is the full PCI address, e.g. 0000:41:00.0
+	BDF string
+	// Vendor, Device and Class are hex IDs without 0x prefix, e.g. 10de, 2330, 030200
+	Vendor string
+	Device string
+	Class  string
+	// Driver is the bound driver, none when empty
+	Driver     string
+	IommuGroup int
+	// NumaNode is -1 when the platform does not report one
+	NumaNode int
+	// MdevTypes are the mediated device types the function supports
+	MdevTypes []string
+	// SriovTotalVFs is written to sriov_totalvfs when not zero
+	SriovTotalVFs int
+	// PhysFn is the BDF of the physical function of an SR-IOV virtual
+	// function, added before it. Empty for any other function.
+	PhysFn string
+}
+
+// SysfsTree is a synthetic sysfs tree laid out like the kernel's: the
+// functions live below devices/ and are linked from bus/pci/devices and
+// kernel/iommu_groups/<group>/devices, mediated devices live below their
+// parent and are linked from bus/mdev/devices
+type SysfsTree struct {
+	Root string
+}
+
+// NewSysfsTree creates an empty tree below root
+func NewSysfsTree(root string) (*SysfsTree, error) {
+	for _, dir := range []string{"bus/pci/devices", "bus/pci/drivers", "kernel/iommu_groups", "devices"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &SysfsTree{Root: root}, nil
+}
+
+// devicePath returns the real directory of a function, below its root complex
+func (t *SysfsTree) devicePath(bdf string) string {
+	domain := "0000"
+	if parts := strings.SplitN(bdf, ":", 2); len(parts) == 2 {
+		domain = parts[0]
+	}
+	return filepath.Join(t.Root, "devices", "pci"+domain+":00", bdf)
+}
+
+// AddDevice adds a function with its attribute files and links
+func (t *SysfsTree) AddDevice(dev PCIDevice) error {
+	dir := t.devicePath(dev.BDF)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"vendor":    "0x" + dev.Vendor,
+		"device":    "0x" + dev.Device,
+		"class":     "0x" + dev.Class,
+		"numa_node": strconv.Itoa(dev.NumaNode),
+		"enable":    "0",
+	}
+	if dev.SriovTotalVFs > 0 {
+		files["sriov_totalvfs"] = strconv.Itoa(dev.SriovTotalVFs)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	for _, mdevType := range dev.MdevTypes {
+		if err := os.MkdirAll(filepath.Join(dir, "mdev_supported_types", mdevType), 0755); err != nil {
+			return err
+		}
+	}
+
+	group := filepath.Join(t.Root, "kernel", "iommu_groups", strconv.Itoa(dev.IommuGroup))
+	if err := os.MkdirAll(filepath.Join(group, "devices"), 0755); err != nil {
+		return err
+	}
+	links := map[string]string{
+		filepath.Join(dir, "iommu_group"):                       group,
+		filepath.Join(group, "devices", dev.BDF):                dir,
+		filepath.Join(t.Root, "bus", "pci", "devices", dev.BDF): dir,
+	}
+	if dev.PhysFn != "" {
+		pf := t.devicePath(dev.PhysFn)
+		vfs, err := filepath.Glob(filepath.Join(pf, "virtfn*"))
+		if err != nil {
+			return err
+		}
+		links[filepath.Join(dir, "physfn")] = pf
+		links[filepath.Join(pf, "virtfn"+strconv.Itoa(len(vfs)))] = dir
+	}
+	for link, target := range links {
+		if err := relativeSymlink(target, link); err != nil {
+			return err
+		}
+	}
+
+	return t.SetDriver(dev.BDF, dev.Driver)
+}
+
+// AddMdev creates a mediated device of the type on the parent function, in
+// an IOMMU group of its own. The type is added to the mdev_supported_types
+// of the parent with its name.
+func (t *SysfsTree) AddMdev(parent string, uuid string, mdevType string, typeName string, iommuGroup int) error {
+	parentDir := t.devicePath(parent)
+	typeDir := filepath.Join(parentDir, "mdev_supported_types", mdevType)
+	if err := os.MkdirAll(typeDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(typeDir, "name"), []byte(typeName+"\n"), 0644); err != nil {
+		return err
+	}
+	dir := filepath.Join(parentDir, uuid)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	group := filepath.Join(t.Root, "kernel", "iommu_groups", strconv.Itoa(iommuGroup))
+	if err := os.MkdirAll(filepath.Join(group, "devices"), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(t.Root, "bus", "mdev", "devices"), 0755); err != nil {
+		return err
+	}
+	links := map[string]string{
+		filepath.Join(dir, "mdev_type"):                       typeDir,
+		filepath.Join(dir, "iommu_group"):                     group,
+		filepath.Join(group, "devices", uuid):                 dir,
+		filepath.Join(t.Root, "bus", "mdev", "devices", uuid): dir,
+	}
+	for link, target := range links {
+		if err := relativeSymlink(target, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetDriver binds the function to driver, or unbinds it when driver is empty
+func (t *SysfsTree) SetDriver(bdf string, driver string) error {
+	link := filepath.Join(t.devicePath(bdf), "driver")
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if driver == "" {
+		return nil
+	}
+	target := filepath.Join(t.Root, "bus", "pci", "drivers", driver)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	return relativeSymlink(target, link)
+}
+
+// SetEnabled sets the enable count of the function, non zero while a driver
+// or a VM uses it
+func (t *SysfsTree) SetEnabled(bdf string, enabled int) error {
+	return os.WriteFile(filepath.Join(t.devicePath(bdf), "enable"), []byte(strconv.Itoa(enabled)+"\n"), 0644)
+}
+
+// RemoveDevice removes a function as if it was hot-unplugged
+func (t *SysfsTree) RemoveDevice(bdf string) error {
+	dir := t.devicePath(bdf)
+	group, err := os.Readlink(filepath.Join(dir, "iommu_group"))
+	if err != nil {
+		return fmt.Errorf("unknown device %s: %w", bdf, err)
+	}
+	group = filepath.Join(dir, group)
+	for _, path := range []string{
+		filepath.Join(group, "devices", bdf),
+		filepath.Join(t.Root, "bus", "pci", "devices", bdf),
+	} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// LoadModule adds a kernel module with its parameters, e.g.
+// {"allow_unsafe_interrupts": "N"}
+func (t *SysfsTree) LoadModule(name string, params map[string]string) error {
+	dir := filepath.Join(t.Root, "module", name, "parameters")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for param, value := range params {
+		if err := os.WriteFile(filepath.Join(dir, param), []byte(value+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relativeSymlink links link to target with a relative path, like sysfs does
+func relativeSymlink(target, link string) error {
+	rel, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(rel, link)
+}
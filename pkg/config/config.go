@@ -0,0 +1,695 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigPath is where the plugin looks for its configuration file
+const DefaultConfigPath = "/etc/kata-xpu-device-plugin/config.yaml"
+
+// DefaultAdminSocket is where the daemon serves its local admin API
+const DefaultAdminSocket = "/var/run/kata-xpu-device-plugin/admin.sock"
+
+// How Kata attaches a device to the VM
+const (
+	AttachModeColdPlug = "cold-plug"
+	AttachModeHotPlug  = "hot-plug"
+)
+
+// PCIe port types Kata plugs a device into
+const (
+	PCIeRootPort   = "root-port"
+	PCIeSwitchPort = "switch-port"
+	PCIeBridgePort = "bridge-port"
+)
+
+// How NVSwitch functions are handed out
+const (
+	// FabricModeOff leaves NVSwitches to the discovery filters
+	FabricModeOff = "off"
+	// FabricModeInclude passes the switches of a partition through with its GPUs
+	FabricModeInclude = "include"
+	// FabricModeResource advertises the switches as a resource of their own
+	FabricModeResource = "resource"
+)
+
+// How GPUs and NVSwitches are grouped into fabric partitions
+const (
+	PartitionByNode = "node"
+	PartitionByNuma = "numa"
+)
+
+// Frontends serving the discovered devices to kubelet
+const (
+	FrontendDevicePlugin = "device-plugin"
+	FrontendDRA          = "dra"
+)
+
+// How a device plugin announces itself to kubelet
+const (
+	// RegistrationKubeletSocket dials kubelet.sock in the device plugin
+	// directory and registers again when kubelet removes the plugin socket
+	RegistrationKubeletSocket = "kubelet-socket"
+	// RegistrationPluginWatcher places a socket in the plugins_registry
+	// directory, kubelet discovers it and registers the plugin again itself
+	// after a restart
+	RegistrationPluginWatcher = "plugin-watcher"
+)
+
+// Device backends discovering and handing out the devices of a resource
+const (
+	// BackendVFIO passes whole PCI functions bound to a VFIO driver through,
+	// one device per IOMMU group
+	BackendVFIO = "vfio"
+	// BackendMdev passes the mediated devices created on NVIDIA GPUs, e.g.
+	// vGPUs, through, one resource per mdev type
+	BackendMdev = "mdev"
+	// BackendSRIOVVF passes the SR-IOV virtual functions bound to a VFIO
+	// driver through, they are left out of the vfio backend
+	BackendSRIOVVF = "sriov-vf"
+	// BackendSimulated advertises a configured fleet of fake devices backed
+	// by a harmless device node, for clusters without GPUs
+	BackendSimulated = "simulated"
+)
+
+// Config is the runtime configuration of the kata-xpu-device-plugin
+type Config struct {
+	// Frontend is either the classic device plugin API or a DRA kubelet plugin
+	Frontend string `json:"frontend" yaml:"frontend"`
+	// NodeName is the name of the node the plugin runs on, NODE_NAME by default
+	NodeName string `json:"nodeName" yaml:"nodeName"`
+	// Kubeconfig is used to reach the API server when not running in a pod
+	Kubeconfig string `json:"kubeconfig" yaml:"kubeconfig"`
+
+	Discovery    DiscoveryConfig    `json:"discovery" yaml:"discovery"`
+	Backends     BackendsConfig     `json:"backends" yaml:"backends"`
+	Preflight    PreflightConfig    `json:"preflight" yaml:"preflight"`
+	Kubelet      KubeletConfig      `json:"kubelet" yaml:"kubelet"`
+	DRA          DRAConfig          `json:"dra" yaml:"dra"`
+	PreStart     PreStartConfig     `json:"preStart" yaml:"preStart"`
+	Ledger       LedgerConfig       `json:"ledger" yaml:"ledger"`
+	PodResources PodResourcesConfig `json:"podResources" yaml:"podResources"`
+	Metrics      MetricsConfig      `json:"metrics" yaml:"metrics"`
+	NodeFeatures NodeFeaturesConfig `json:"nodeFeatures" yaml:"nodeFeatures"`
+	Admin        AdminConfig        `json:"admin" yaml:"admin"`
+	Cordon       CordonConfig       `json:"cordon" yaml:"cordon"`
+	Events       EventsConfig       `json:"events" yaml:"events"`
+	Kata         KataConfig         `json:"kata" yaml:"kata"`
+	CDI          CDIConfig          `json:"cdi" yaml:"cdi"`
+	Fabric       FabricConfig       `json:"fabric" yaml:"fabric"`
+
+	ConfidentialComputing ConfidentialComputingConfig `json:"confidentialComputing" yaml:"confidentialComputing"`
+}
+
+// DiscoveryConfig controls where devices are discovered
+type DiscoveryConfig struct {
+	// SysfsRoot is the mount point of sysfs, devices are read from <root>/bus/pci/devices
+	SysfsRoot string `json:"sysfsRoot" yaml:"sysfsRoot"`
+	// PciIdsPath is the pci.ids database used to name the devices
+	PciIdsPath string `json:"pciIdsPath" yaml:"pciIdsPath"`
+	// DevRoot is the root the VFIO group nodes are found under, in
+	// <root>/dev/vfio, and the iommufd node, in <root>/dev/iommu
+	DevRoot string `json:"devRoot" yaml:"devRoot"`
+	// VFIODrivers are the drivers accepted as VFIO: vfio-pci and its NVIDIA
+	// variants, e.g. nvgrace-gpu-vfio-pci. Only NVIDIA functions are
+	// discovered, the variants of other vendors are of no use here.
+	VFIODrivers []string `json:"vfioDrivers" yaml:"vfioDrivers"`
+	// Filters select which functions bound to a VFIO driver are advertised
+	Filters DeviceFilters `json:"filters" yaml:"filters"`
+	// Reserve keeps devices for host use, by vendor:device ID. The first
+	// devices of a model in PCI address order are never advertised.
+	Reserve map[string]int `json:"reserve" yaml:"reserve"`
+}
+
+// BackendsConfig selects the device backend of every resource
+type BackendsConfig struct {
+	// Default serves every resource without an entry in Resources, vfio
+	// when empty
+	Default string `json:"default" yaml:"default"`
+	// Resources overrides the default per resource name, e.g. nvidia.com/GH100
+	Resources map[string]string `json:"resources" yaml:"resources"`
+	// Simulated describes the devices of the simulated backend
+	Simulated SimulatedConfig `json:"simulated" yaml:"simulated"`
+}
+
+// SimulatedConfig describes the fake fleet of the simulated backend
+type SimulatedConfig struct {
+	// DeviceNode is the node every simulated CDI device points at
+	DeviceNode string `json:"deviceNode" yaml:"deviceNode"`
+	// Models are the fake devices, one resource per model
+	Models []SimulatedModel `json:"models" yaml:"models"`
+}
+
+// SimulatedModel is a set of identical fake devices
+type SimulatedModel struct {
+	// Name is the resource name without the nvidia.com/ prefix, e.g. GH100
+	Name  string `json:"name" yaml:"name"`
+	Count int    `json:"count" yaml:"count"`
+	// FirstIommuGroup is the IOMMU group, and so the device ID, of the first
+	// device, the next devices take the following groups. Zero continues
+	// after the previous model.
+	FirstIommuGroup int `json:"firstIommuGroup" yaml:"firstIommuGroup"`
+	// NumaNodes are spread over the devices in order, e.g. [0, 1] puts the
+	// first half on node 0. The NUMA node is unknown when empty.
+	NumaNodes []int `json:"numaNodes" yaml:"numaNodes"`
+	// Flap injects health flaps, one device of the model after the other
+	Flap SimulatedFlap `json:"flap" yaml:"flap"`
+}
+
+// SimulatedFlap makes a device unhealthy for Duration every Interval
+type SimulatedFlap struct {
+	// Interval between two flaps, disabled when zero
+	Interval time.Duration `json:"interval" yaml:"interval"`
+	Duration time.Duration `json:"duration" yaml:"duration"`
+}
+
+// IommuGroups returns the IOMMU groups of the devices of every model
+func (s SimulatedConfig) IommuGroups() [][]int {
+	groups := make([][]int, 0, len(s.Models))
+	next := 0
+	for _, model := range s.Models {
+		first := model.FirstIommuGroup
+		if first == 0 {
+			first = next
+		}
+		ids := make([]int, 0, model.Count)
+		for i := 0; i < model.Count; i++ {
+			ids = append(ids, first+i)
+		}
+		groups = append(groups, ids)
+		next = first + model.Count
+	}
+	return groups
+}
+
+func (s SimulatedConfig) validate() error {
+	names := map[string]bool{}
+	groups := map[int]string{}
+	iommuGroups := s.IommuGroups()
+	for i, model := range s.Models {
+		if model.Name == "" || strings.Contains(model.Name, "/") {
+			return fmt.Errorf("invalid model name %q", model.Name)
+		}
+		if names[model.Name] {
+			return fmt.Errorf("model %s listed twice", model.Name)
+		}
+		names[model.Name] = true
+		if model.Count < 1 {
+			return fmt.Errorf("invalid count %d of model %s", model.Count, model.Name)
+		}
+		if model.FirstIommuGroup < 0 {
+			return fmt.Errorf("invalid firstIommuGroup %d of model %s", model.FirstIommuGroup, model.Name)
+		}
+		if model.Flap.Interval < 0 || model.Flap.Duration < 0 ||
+			(model.Flap.Interval > 0 && (model.Flap.Duration == 0 || model.Flap.Duration >= model.Flap.Interval)) {
+			return fmt.Errorf("invalid flap of model %s, the duration must be shorter than the interval", model.Name)
+		}
+		for _, group := range iommuGroups[i] {
+			if other, ok := groups[group]; ok {
+				return fmt.Errorf("IOMMU group %d of model %s is also used by model %s", group, model.Name, other)
+			}
+			groups[group] = model.Name
+		}
+	}
+	return nil
+}
+
+// ForResource returns the backend serving resourceName
+func (b BackendsConfig) ForResource(resourceName string) string {
+	if backend, ok := b.Resources[resourceName]; ok {
+		return backend
+	}
+	return b.defaultBackend()
+}
+
+func (b BackendsConfig) defaultBackend() string {
+	if b.Default == "" {
+		return BackendVFIO
+	}
+	return b.Default
+}
+
+// Names returns the distinct backends in use, the default first
+func (b BackendsConfig) Names() []string {
+	names := []string{b.defaultBackend()}
+	seen := map[string]bool{b.defaultBackend(): true}
+	keys := make([]string, 0, len(b.Resources))
+	for name := range b.Resources {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	for _, name := range keys {
+		if backend := b.Resources[name]; !seen[backend] {
+			seen[backend] = true
+			names = append(names, backend)
+		}
+	}
+	return names
+}
+
+func validBackend(name string) error {
+	switch name {
+	case BackendVFIO, BackendMdev, BackendSRIOVVF, BackendSimulated:
+	default:
+		return fmt.Errorf("invalid backend %q", name)
+	}
+	return nil
+}
+
+// PreflightConfig controls the host checks run before devices are advertised
+type PreflightConfig struct {
+	// Enabled runs the checks at startup, fatal findings keep the devices
+	// from being advertised
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// ProcRoot is the mount point of procfs, the kernel command line is read from it
+	ProcRoot string `json:"procRoot" yaml:"procRoot"`
+	// Ignore are names of checks that are skipped, e.g. acs-override
+	Ignore []string `json:"ignore" yaml:"ignore"`
+}
+
+// DeviceFilters select devices by PCI class, vendor:device and BDF. A device
+// is advertised when it matches every non-empty include list and no exclude list.
+type DeviceFilters struct {
+	Include DeviceSelector `json:"include" yaml:"include"`
+	Exclude DeviceSelector `json:"exclude" yaml:"exclude"`
+}
+
+// DeviceSelector matches devices, empty lists match nothing
+type DeviceSelector struct {
+	// Classes are class (2 hex digits), class and subclass (4) or full class codes (6)
+	Classes []string `json:"classes" yaml:"classes"`
+	// Devices are vendor:device IDs, either may be "*"
+	Devices []string `json:"devices" yaml:"devices"`
+	// BDFs are PCI addresses, e.g. 0000:41:00.0
+	BDFs []string `json:"bdfs" yaml:"bdfs"`
+}
+
+func (sel DeviceSelector) validate() error {
+	for _, device := range sel.Devices {
+		if vendor, id, ok := strings.Cut(device, ":"); !ok || vendor == "" || id == "" {
+			return fmt.Errorf("invalid device %q, expected vendor:device", device)
+		}
+	}
+	return nil
+}
+
+// KubeletConfig locates the kubelet device plugin API
+type KubeletConfig struct {
+	// DevicePluginDir holds the kubelet registration socket kubelet.sock and
+	// the sockets of the device plugins
+	DevicePluginDir string `json:"devicePluginDir" yaml:"devicePluginDir"`
+	// Registration is kubelet-socket or plugin-watcher
+	Registration string `json:"registration" yaml:"registration"`
+	// PluginDir holds the sockets of the device plugins registered through
+	// the plugin watcher, kubelet empties DevicePluginDir when it restarts
+	PluginDir string `json:"pluginDir" yaml:"pluginDir"`
+	// RegistryDir is the kubelet plugin watcher directory
+	RegistryDir string `json:"registryDir" yaml:"registryDir"`
+}
+
+// PluginWatcher reports whether the device plugins register through the
+// plugin watcher, kubelet.sock is dialed when Registration is empty
+func (k KubeletConfig) PluginWatcher() bool {
+	return k.Registration == RegistrationPluginWatcher
+}
+
+// DRAConfig controls the Dynamic Resource Allocation kubelet plugin frontend
+type DRAConfig struct {
+	// DriverName is the DRA driver name referenced by resource classes
+	DriverName string `json:"driverName" yaml:"driverName"`
+	// PluginDir holds the socket serving the DRA node service
+	PluginDir string `json:"pluginDir" yaml:"pluginDir"`
+	// RegistryDir is the kubelet plugin watcher directory
+	RegistryDir string `json:"registryDir" yaml:"registryDir"`
+	// PublishResourceSlices makes the plugin write the ResourceSlices itself
+	// instead of reporting them to kubelet through NodeListAndWatchResources
+	PublishResourceSlices bool `json:"publishResourceSlices" yaml:"publishResourceSlices"`
+}
+
+// PreStartConfig controls the optional PreStartContainer hook which resets
+// the allocated devices before they are handed to a Kata VM
+type PreStartConfig struct {
+	// ResetDevices enables the PreStartContainer hook
+	ResetDevices bool `json:"resetDevices" yaml:"resetDevices"`
+	// ResetMethods are the sysfs reset methods to use, in order of preference
+	ResetMethods []string `json:"resetMethods" yaml:"resetMethods"`
+	// Timeout bounds the wait for a device to reappear after the reset
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+// LedgerConfig controls the allocation ledger which tracks which pod owns
+// which device and is reconciled against the kubelet pod-resources API
+type LedgerConfig struct {
+	// CheckpointPath is where the ledger is persisted across restarts
+	CheckpointPath string `json:"checkpointPath" yaml:"checkpointPath"`
+	// ReconcileInterval is the period of the pod-resources reconciliation,
+	// it must be positive
+	ReconcileInterval time.Duration `json:"reconcileInterval" yaml:"reconcileInterval"`
+	// GracePeriod is how long a fresh allocation may stay unknown to kubelet
+	GracePeriod time.Duration `json:"gracePeriod" yaml:"gracePeriod"`
+}
+
+// PodResourcesConfig controls the client of the kubelet pod-resources API
+type PodResourcesConfig struct {
+	// Socket is the path of the pod-resources unix socket
+	Socket string `json:"socket" yaml:"socket"`
+	// ConnectionTimeout bounds the dial of the socket
+	ConnectionTimeout time.Duration `json:"connectionTimeout" yaml:"connectionTimeout"`
+	// RequestTimeout bounds every single request
+	RequestTimeout time.Duration `json:"requestTimeout" yaml:"requestTimeout"`
+}
+
+// MetricsConfig controls the Prometheus metrics endpoint
+type MetricsConfig struct {
+	// ListenAddress of the metrics HTTP server, disabled when empty
+	ListenAddress string `json:"listenAddress" yaml:"listenAddress"`
+}
+
+// NodeFeaturesConfig controls the Node Feature Discovery local feature file
+type NodeFeaturesConfig struct {
+	// Enabled turns on writing the feature file
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// FeaturesDir is the features.d directory watched by the NFD worker
+	FeaturesDir string `json:"featuresDir" yaml:"featuresDir"`
+}
+
+// AdminConfig controls the local admin API queried by the status subcommand
+type AdminConfig struct {
+	// Socket is the unix socket serving the admin API, disabled when empty
+	Socket string `json:"socket" yaml:"socket"`
+}
+
+// CordonConfig controls the maintenance mode of devices
+type CordonConfig struct {
+	// File lists the cordoned devices. It is watched for changes and
+	// rewritten by the admin API, cordoning is disabled when empty.
+	File string `json:"file" yaml:"file"`
+}
+
+// EventsConfig controls the Kubernetes Events recorded on the Node object
+type EventsConfig struct {
+	// Enabled records events when an API server is reachable through the
+	// kubeconfig or the in-cluster configuration
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Burst and QPS rate-limit the events of the node, identical events are
+	// aggregated into one with a count
+	Burst int     `json:"burst" yaml:"burst"`
+	QPS   float32 `json:"qps" yaml:"qps"`
+}
+
+// ConfidentialComputingConfig controls the confidential computing readiness checks
+type ConfidentialComputingConfig struct {
+	// Enabled collects the CC facts of the host and devices, annotates the
+	// CDI spec and advertises the CC-capable devices as a resource of their own
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// ResourceSuffix is appended to the resource name of CC-capable devices
+	ResourceSuffix string `json:"resourceSuffix" yaml:"resourceSuffix"`
+	// RequiredCapabilities are PCIe capabilities a CC-capable device must
+	// have, among ats, pri and pasid
+	RequiredCapabilities []string `json:"requiredCapabilities" yaml:"requiredCapabilities"`
+}
+
+// FabricConfig controls the NVSwitch fabric handling of HGX systems
+type FabricConfig struct {
+	// Mode is off, include or resource
+	Mode string `json:"mode" yaml:"mode"`
+	// PartitionBy groups the GPUs and switches of the node into one partition
+	// (node) or one partition per NUMA node (numa)
+	PartitionBy string `json:"partitionBy" yaml:"partitionBy"`
+	// Partitions replace the automatic partitioning when set
+	Partitions []FabricPartition `json:"partitions" yaml:"partitions"`
+}
+
+// FabricPartition is a set of GPUs and NVSwitches connected over NVLink
+type FabricPartition struct {
+	Name string `json:"name" yaml:"name"`
+	// BDFs of the GPUs and switches of the partition
+	BDFs []string `json:"bdfs" yaml:"bdfs"`
+}
+
+// CDIConfig controls the content of the generated CDI spec
+type CDIConfig struct {
+	// SpecDir is the directory the CDI spec is written to
+	SpecDir string `json:"specDir" yaml:"specDir"`
+	// ExcludeClasses are PCI classes of IOMMU group members left out of the
+	// CDI devices, as class (2 hex digits), class and subclass (4) or full code (6)
+	ExcludeClasses []string `json:"excludeClasses" yaml:"excludeClasses"`
+}
+
+// KataConfig holds the plug hints given to the Kata runtime, per resource
+type KataConfig struct {
+	// Default applies to every resource
+	Default KataResourceConfig `json:"default" yaml:"default"`
+	// Resources overrides the default per resource name, e.g. nvidia.com/GH100
+	Resources map[string]KataResourceConfig `json:"resources" yaml:"resources"`
+}
+
+// KataResourceConfig tells Kata how to plug the devices of a resource
+type KataResourceConfig struct {
+	// AttachMode is cold-plug or hot-plug
+	AttachMode string `json:"attachMode" yaml:"attachMode"`
+	// PCIePort is root-port, switch-port or bridge-port
+	PCIePort string `json:"pciePort" yaml:"pciePort"`
+	// PCIePortsPerDevice is the number of ports Kata pre-creates per device
+	PCIePortsPerDevice int `json:"pciePortsPerDevice" yaml:"pciePortsPerDevice"`
+}
+
+// ForResource returns the default overridden by the fields set for resourceName
+func (k KataConfig) ForResource(resourceName string) KataResourceConfig {
+	rc := k.Default
+	override, ok := k.Resources[resourceName]
+	if !ok {
+		return rc
+	}
+	if override.AttachMode != "" {
+		rc.AttachMode = override.AttachMode
+	}
+	if override.PCIePort != "" {
+		rc.PCIePort = override.PCIePort
+	}
+	if override.PCIePortsPerDevice != 0 {
+		rc.PCIePortsPerDevice = override.PCIePortsPerDevice
+	}
+	return rc
+}
+
+func (rc KataResourceConfig) validate() error {
+	switch rc.AttachMode {
+	case "", AttachModeColdPlug, AttachModeHotPlug:
+	default:
+		return fmt.Errorf("invalid attachMode %q", rc.AttachMode)
+	}
+	switch rc.PCIePort {
+	case "", PCIeRootPort, PCIeSwitchPort, PCIeBridgePort:
+	default:
+		return fmt.Errorf("invalid pciePort %q", rc.PCIePort)
+	}
+	if rc.PCIePortsPerDevice < 0 {
+		return fmt.Errorf("invalid pciePortsPerDevice %d", rc.PCIePortsPerDevice)
+	}
+	return nil
+}
+
+// Default returns the configuration used when no config file is present
+func Default() *Config {
+	return &Config{
+		Frontend: FrontendDevicePlugin,
+		NodeName: os.Getenv("NODE_NAME"),
+		Discovery: DiscoveryConfig{
+			SysfsRoot:   "/sys",
+			PciIdsPath:  "/usr/pci.ids",
+			DevRoot:     "/",
+			VFIODrivers: []string{"vfio-pci", "nvgrace-gpu-vfio-pci"},
+			Filters: DeviceFilters{
+				// VGA and 3D controllers and processing accelerators, not
+				// NVSwitch bridges (0680) or audio functions (0403)
+				Include: DeviceSelector{Classes: []string{"0300", "0302", "1200"}},
+			},
+		},
+		Backends: BackendsConfig{
+			Default: BackendVFIO,
+			Simulated: SimulatedConfig{
+				DeviceNode: "/dev/null",
+			},
+		},
+		Preflight: PreflightConfig{
+			Enabled:  true,
+			ProcRoot: "/proc",
+		},
+		Kubelet: KubeletConfig{
+			DevicePluginDir: "/var/lib/kubelet/device-plugins",
+			Registration:    RegistrationKubeletSocket,
+			PluginDir:       "/var/lib/kubelet/plugins/kata-xpu-device-plugin",
+			RegistryDir:     "/var/lib/kubelet/plugins_registry",
+		},
+		DRA: DRAConfig{
+			DriverName:  "gpu.kata-xpu.io",
+			PluginDir:   "/var/lib/kubelet/plugins",
+			RegistryDir: "/var/lib/kubelet/plugins_registry",
+		},
+		PreStart: PreStartConfig{
+			ResetDevices: false,
+			ResetMethods: []string{"flr", "bus"},
+			Timeout:      5 * time.Second,
+		},
+		Ledger: LedgerConfig{
+			CheckpointPath:    "/var/lib/kata-xpu-device-plugin/allocations.json",
+			ReconcileInterval: 30 * time.Second,
+			GracePeriod:       2 * time.Minute,
+		},
+		PodResources: PodResourcesConfig{
+			Socket:            "/var/lib/kubelet/pod-resources/kubelet.sock",
+			ConnectionTimeout: 10 * time.Second,
+			RequestTimeout:    10 * time.Second,
+		},
+		NodeFeatures: NodeFeaturesConfig{
+			Enabled:     false,
+			FeaturesDir: "/etc/kubernetes/node-feature-discovery/features.d",
+		},
+		Admin: AdminConfig{
+			Socket: DefaultAdminSocket,
+		},
+		Events: EventsConfig{
+			Enabled: true,
+			Burst:   25,
+			QPS:     0.2,
+		},
+		Cordon: CordonConfig{
+			File: "/var/lib/kata-xpu-device-plugin/cordon.yaml",
+		},
+		CDI: CDIConfig{
+			SpecDir: "/var/run/cdi",
+		},
+		Fabric: FabricConfig{
+			Mode:        FabricModeOff,
+			PartitionBy: PartitionByNode,
+		},
+		ConfidentialComputing: ConfidentialComputingConfig{
+			Enabled:        false,
+			ResourceSuffix: "_CC",
+		},
+		Kata: KataConfig{
+			Default: KataResourceConfig{
+				AttachMode:         AttachModeColdPlug,
+				PCIePort:           PCIeRootPort,
+				PCIePortsPerDevice: 1,
+			},
+		},
+	}
+}
+
+// Load reads the YAML configuration at path on top of the defaults.
+// A missing file is not an error, the defaults are returned instead.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	switch cfg.Frontend {
+	case FrontendDevicePlugin, FrontendDRA:
+	default:
+		return nil, fmt.Errorf("invalid frontend %q in config file %s", cfg.Frontend, path)
+	}
+	switch cfg.Kubelet.Registration {
+	case RegistrationKubeletSocket, RegistrationPluginWatcher:
+	default:
+		return nil, fmt.Errorf("invalid kubelet registration %q in config file %s", cfg.Kubelet.Registration, path)
+	}
+
+	switch cfg.Fabric.Mode {
+	case FabricModeOff, FabricModeInclude, FabricModeResource:
+	default:
+		return nil, fmt.Errorf("invalid fabric mode %q in config file %s", cfg.Fabric.Mode, path)
+	}
+	switch cfg.Fabric.PartitionBy {
+	case PartitionByNode, PartitionByNuma:
+	default:
+		return nil, fmt.Errorf("invalid fabric partitionBy %q in config file %s", cfg.Fabric.PartitionBy, path)
+	}
+
+	for _, c := range cfg.ConfidentialComputing.RequiredCapabilities {
+		switch strings.ToLower(c) {
+		case "ats", "pri", "pasid":
+		default:
+			return nil, fmt.Errorf("invalid required PCIe capability %q in config file %s", c, path)
+		}
+	}
+
+	if len(cfg.Discovery.VFIODrivers) == 0 {
+		return nil, fmt.Errorf("no VFIO driver configured in config file %s", path)
+	}
+	for _, driver := range cfg.Discovery.VFIODrivers {
+		if driver == "" || strings.Contains(driver, "/") {
+			return nil, fmt.Errorf("invalid VFIO driver %q in config file %s", driver, path)
+		}
+	}
+
+	if cfg.Ledger.ReconcileInterval <= 0 {
+		return nil, fmt.Errorf("invalid ledger reconcileInterval %v in config file %s, it must be positive", cfg.Ledger.ReconcileInterval, path)
+	}
+
+	if cfg.Events.Burst < 1 || cfg.Events.QPS <= 0 {
+		return nil, fmt.Errorf("invalid events rate limit burst %d qps %v in config file %s", cfg.Events.Burst, cfg.Events.QPS, path)
+	}
+
+	for device, count := range cfg.Discovery.Reserve {
+		if vendor, id, ok := strings.Cut(device, ":"); !ok || vendor == "" || id == "" || strings.Contains(device, "*") {
+			return nil, fmt.Errorf("invalid reserved device %q in config file %s, expected vendor:device", device, path)
+		}
+		if count < 0 {
+			return nil, fmt.Errorf("invalid reserved count %d for %s in config file %s", count, device, path)
+		}
+	}
+
+	if err := cfg.Discovery.Filters.Include.validate(); err != nil {
+		return nil, fmt.Errorf("discovery.filters.include in config file %s: %v", path, err)
+	}
+	if err := cfg.Discovery.Filters.Exclude.validate(); err != nil {
+		return nil, fmt.Errorf("discovery.filters.exclude in config file %s: %v", path, err)
+	}
+	if err := validBackend(cfg.Backends.defaultBackend()); err != nil {
+		return nil, fmt.Errorf("backends.default in config file %s: %v", path, err)
+	}
+	for name, backend := range cfg.Backends.Resources {
+		if err := validBackend(backend); err != nil {
+			return nil, fmt.Errorf("backends.resources[%s] in config file %s: %v", name, path, err)
+		}
+	}
+	if cfg.Frontend == FrontendDRA {
+		// The DRA frontend publishes the IOMMU groups of the vfio backend only
+		for _, backend := range cfg.Backends.Names() {
+			if backend != BackendVFIO {
+				return nil, fmt.Errorf("backend %q is not supported by the %s frontend in config file %s", backend, FrontendDRA, path)
+			}
+		}
+	}
+	if err := cfg.Backends.Simulated.validate(); err != nil {
+		return nil, fmt.Errorf("backends.simulated in config file %s: %v", path, err)
+	}
+	if err := cfg.Kata.Default.validate(); err != nil {
+		return nil, fmt.Errorf("kata.default in config file %s: %v", path, err)
+	}
+	for name, rc := range cfg.Kata.Resources {
+		if err := rc.validate(); err != nil {
+			return nil, fmt.Errorf("kata.resources[%s] in config file %s: %v", name, path, err)
+		}
+	}
+
+	return cfg, nil
+}
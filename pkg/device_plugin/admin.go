@@ -0,0 +1,306 @@
+package device_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"kata-xpu-device-plugin/pkg/preflight"
+	"kata-xpu-device-plugin/pkg/version"
+)
+
+const (
+	adminStatusPath = "/status"
+	adminCordonPath = "/cordon"
+)
+
+// Status is the snapshot of the daemon state served by the admin API
+type Status struct {
+	Version  string         `json:"version"`
+	Frontend string         `json:"frontend"`
+	Plugins  []PluginStatus `json:"plugins"`
+	Ledger   []LedgerEntry  `json:"ledger"`
+	CDI      CDIWriteStatus `json:"cdi"`
+	// Preflight is the report of the startup host checks, when enabled
+	Preflight *preflight.Report `json:"preflight,omitempty"`
+	// Cordons are the devices taken out of service
+	Cordons []CordonEntry `json:"cordons,omitempty"`
+}
+
+// PluginStatus describes one GenericDevicePlugin
+type PluginStatus struct {
+	ResourceName      string         `json:"resourceName"`
+	SocketPath        string         `json:"socketPath"`
+	Registered        bool           `json:"registered"`
+	RegistrationError string         `json:"registrationError,omitempty"`
+	RegisteredAt      time.Time      `json:"registeredAt,omitempty"`
+	WatchStreams      int            `json:"watchStreams"`
+	Devices           []DeviceStatus `json:"devices"`
+}
+
+// DeviceStatus is the health of a device with the reasons it is unhealthy,
+// keyed by the source that reported them
+type DeviceStatus struct {
+	ID      string            `json:"id"`
+	Health  string            `json:"health"`
+	Reasons map[string]string `json:"reasons,omitempty"`
+}
+
+// CDIWriteStatus records the last write of the CDI spec
+type CDIWriteStatus struct {
+	Path    string    `json:"path,omitempty"`
+	Time    time.Time `json:"time,omitempty"`
+	Devices int       `json:"devices"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (m *Manager) recordCDIWrite(path string, devices int, err error) {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	m.cdiWrite = CDIWriteStatus{Path: path, Time: m.clock.Now(), Devices: devices}
+	if err != nil {
+		m.cdiWrite.Error = err.Error()
+	}
+}
+
+// adminServer serves the admin API of a manager as JSON over HTTP on a unix
+// socket, only reachable by root on the node
+type adminServer struct {
+	socketPath string
+	server     *http.Server
+	m          *Manager
+}
+
+func newAdminServer(socketPath string, m *Manager) *adminServer {
+	return &adminServer{socketPath: socketPath, m: m}
+}
+
+// Start listens on the admin socket and serves the API in the background
+func (a *adminServer) Start() error {
+	if err := os.MkdirAll(filepath.Dir(a.socketPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(a.socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sock, err := net.Listen("unix", a.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin socket %s: %v", a.socketPath, err)
+	}
+	if err := os.Chmod(a.socketPath, 0600); err != nil {
+		sock.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminStatusPath, a.handleStatus)
+	mux.HandleFunc(adminCordonPath, a.handleCordon)
+	a.server = &http.Server{Handler: mux}
+	go func() {
+		if err := a.server.Serve(sock); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving admin API: %v", err)
+		}
+	}()
+
+	log.Printf("Serving admin API on %s", a.socketPath)
+	return nil
+}
+
+// Stop shuts the server down and removes the socket
+func (a *adminServer) Stop() {
+	if a.server != nil {
+		a.server.Close()
+	}
+	if err := os.Remove(a.socketPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing admin socket: %v", err)
+	}
+}
+
+func (a *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.m.Status()); err != nil {
+		log.Printf("Error encoding admin status: %v", err)
+	}
+}
+
+// handleCordon lists the cordoned devices on GET, cordons the device of the
+// posted entry on POST and uncordons it on DELETE
+func (a *adminServer) handleCordon(w http.ResponseWriter, r *http.Request) {
+	cordons := a.m.cordons
+	if cordons == nil {
+		http.Error(w, "cordoning is disabled in the configuration", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cordons.Entries()); err != nil {
+			log.Printf("Error encoding cordoned devices: %v", err)
+		}
+		return
+	}
+
+	var entry CordonEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, fmt.Sprintf("invalid cordon entry: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := entry.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if err := cordons.Cordon(entry); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		found, err := cordons.Uncordon(entry)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("%s is not cordoned", entry), http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Status reports the state of the manager, as served by the admin API
+func (m *Manager) Status() Status {
+	m.statusMu.Lock()
+	plugins := m.plugins
+	cdiWrite := m.cdiWrite
+	m.statusMu.Unlock()
+
+	status := Status{
+		Version:   version.Version,
+		Frontend:  m.cfg.Frontend,
+		Plugins:   []PluginStatus{},
+		Ledger:    []LedgerEntry{},
+		CDI:       cdiWrite,
+		Preflight: m.lastPreflight(),
+	}
+	for _, dp := range plugins {
+		status.Plugins = append(status.Plugins, dp.status())
+	}
+	sort.Slice(status.Plugins, func(i, j int) bool {
+		return status.Plugins[i].ResourceName < status.Plugins[j].ResourceName
+	})
+	if m.ledger != nil {
+		status.Ledger = m.ledger.Entries()
+	}
+	if m.cordons != nil {
+		status.Cordons = m.cordons.Entries()
+	}
+	return status
+}
+
+// status reports the registration and device health of the plugin
+func (dpi *GenericDevicePlugin) status() PluginStatus {
+	dpi.mu.Lock()
+	ps := PluginStatus{
+		ResourceName:      dpi.resourceName(),
+		SocketPath:        dpi.socketPath,
+		Registered:        dpi.registered,
+		RegistrationError: dpi.registerError,
+		RegisteredAt:      dpi.registeredAt,
+	}
+	dpi.mu.Unlock()
+
+	ps.WatchStreams = dpi.state.Subscribers()
+	for _, dev := range dpi.state.List() {
+		ps.Devices = append(ps.Devices, DeviceStatus{
+			ID:      dev.ID,
+			Health:  dev.Health,
+			Reasons: dpi.state.Reasons(dev.ID),
+		})
+	}
+	sort.Slice(ps.Devices, func(i, j int) bool { return lessIommuGroup(ps.Devices[i].ID, ps.Devices[j].ID) })
+	return ps
+}
+
+// adminClient sends every request to the admin API on socketPath
+func adminClient(socketPath string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+// QueryStatus fetches the status of the daemon serving the admin API on socketPath
+func QueryStatus(socketPath string, timeout time.Duration) (*Status, error) {
+	// The host is ignored, every request goes to the socket
+	resp, err := adminClient(socketPath, timeout).Get("http://localhost" + adminStatusPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query admin API on %s: %w", socketPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin API on %s returned %s", socketPath, resp.Status)
+	}
+
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode admin status: %w", err)
+	}
+	return &status, nil
+}
+
+// CordonDevice asks the daemon serving the admin API on socketPath to cordon
+// the device of the entry
+func CordonDevice(socketPath string, entry CordonEntry, timeout time.Duration) error {
+	return sendCordon(socketPath, http.MethodPost, entry, timeout)
+}
+
+// UncordonDevice asks the daemon serving the admin API on socketPath to put
+// the device of the entry back in service
+func UncordonDevice(socketPath string, entry CordonEntry, timeout time.Duration) error {
+	return sendCordon(socketPath, http.MethodDelete, entry, timeout)
+}
+
+func sendCordon(socketPath string, method string, entry CordonEntry, timeout time.Duration) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, "http://localhost"+adminCordonPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := adminClient(socketPath, timeout).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API on %s: %w", socketPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("admin API on %s returned %s: %s", socketPath, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
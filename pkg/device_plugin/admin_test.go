@@ -0,0 +1,24 @@
+package device_plugin
+
+import (
+	"testing"
+)
+
+func TestAdminStatus(t *testing.T) {
+	env := newHGXEnvironment(t)
+	_, client := startDevicePlugins(t, env, gpuResource)
+
+	if _, err := client.Allocate(testContext(t), "10", "11"); err != nil {
+		t.Fatal(err)
+	}
+	status, err := QueryStatus(env.Config.Admin.Socket, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Plugins) != 1 || !status.Plugins[0].Registered || len(status.Ledger) != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if status.Preflight == nil || status.Preflight.Failed() {
+		t.Fatalf("unexpected preflight report %+v", status.Preflight)
+	}
+}
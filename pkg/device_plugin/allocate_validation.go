@@ -0,0 +1,128 @@
+package device_plugin
+
+import (
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Domain of the ErrorInfo details of rejected allocations
+const allocationErrorDomain = "kata-xpu-device-plugin"
+
+// Machine readable reasons of rejected allocations
+const (
+	AllocationReasonEmptyRequest     = "EMPTY_REQUEST"
+	AllocationReasonDuplicateDevice  = "DUPLICATE_DEVICE"
+	AllocationReasonUnknownDevice    = "UNKNOWN_DEVICE"
+	AllocationReasonOtherResource    = "DEVICE_OF_OTHER_RESOURCE"
+	AllocationReasonUnhealthy        = "DEVICE_UNHEALTHY"
+	AllocationReasonGroupChanged     = "IOMMU_GROUP_CHANGED"
+	AllocationReasonDeviceChanged    = "DEVICE_CHANGED"
+	AllocationReasonNotVFIO          = "DRIVER_NOT_VFIO"
+	AllocationReasonVFIONodeMissing  = "VFIO_NODE_MISSING"
+	AllocationReasonResponseInternal = "RESPONSE_FAILED"
+)
+
+// AllocationError rejects an Allocate request. It is returned to kubelet as
+// a gRPC status with the code and an ErrorInfo detail carrying the reason,
+// the device ID and the BDF.
+type AllocationError struct {
+	Code     codes.Code
+	Reason   string
+	DeviceID string
+	BDF      string
+	Message  string
+}
+
+func (e *AllocationError) Error() string {
+	return e.Message
+}
+
+// GRPCStatus converts the error, the gRPC server calls it on returned errors
+func (e *AllocationError) GRPCStatus() *status.Status {
+	st := status.New(e.Code, e.Message)
+	metadata := map[string]string{}
+	if e.DeviceID != "" {
+		metadata["deviceID"] = e.DeviceID
+	}
+	if e.BDF != "" {
+		metadata["bdf"] = e.BDF
+	}
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   e.Reason,
+		Domain:   allocationErrorDomain,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return st
+	}
+	return detailed
+}
+
+func allocationError(code codes.Code, reason string, deviceID string, bdf string, format string, args ...interface{}) *AllocationError {
+	return &AllocationError{
+		Code:     code,
+		Reason:   reason,
+		DeviceID: deviceID,
+		BDF:      bdf,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// validateAllocation checks the requested devices against the health state
+// of the plugin, then lets the backend check them against the host
+func (dpi *GenericDevicePlugin) validateAllocation(deviceIDs []string) error {
+	if len(deviceIDs) == 0 {
+		return allocationError(codes.InvalidArgument, AllocationReasonEmptyRequest, "", "",
+			"invalid allocation request: no device requested")
+	}
+
+	health := map[string]string{}
+	for _, dev := range dpi.state.List() {
+		health[dev.ID] = dev.Health
+	}
+	seen := map[string]bool{}
+	for _, id := range deviceIDs {
+		if seen[id] {
+			return allocationError(codes.InvalidArgument, AllocationReasonDuplicateDevice, id, "",
+				"invalid allocation request: device %s requested twice", id)
+		}
+		seen[id] = true
+
+		// Devices of other resources are rejected by the backend
+		if h, ok := health[id]; ok && h != pluginapi.Healthy {
+			return allocationError(codes.FailedPrecondition, AllocationReasonUnhealthy, id, "",
+				"device %s is unhealthy: %s", id, formatHealthReasons(dpi.state.Reasons(id)))
+		}
+	}
+	return dpi.backend.ValidateAllocation(dpi.devpluginName, deviceIDs)
+}
+
+// validateAllocatedFunction checks that a function is still where discovery
+// found it, the same device and bound to a VFIO driver
+func (m *Manager) validateAllocatedFunction(id string, dev NvidiaGpuDevice) error {
+	iommuGroup, err := m.readLink(dev.addr, "iommu_group")
+	if err != nil || iommuGroup != id {
+		return allocationError(codes.FailedPrecondition, AllocationReasonGroupChanged, id, dev.addr,
+			"IOMMU group of %s has changed on the system", dev.addr)
+	}
+	vendorID, err := m.readID(dev.addr, "vendor")
+	if err != nil || vendorID != dev.vendorID {
+		return allocationError(codes.FailedPrecondition, AllocationReasonDeviceChanged, id, dev.addr,
+			"vendor of %s has changed on the system", dev.addr)
+	}
+	deviceID, err := m.readID(dev.addr, "device")
+	if err != nil || deviceID != dev.deviceID {
+		return allocationError(codes.FailedPrecondition, AllocationReasonDeviceChanged, id, dev.addr,
+			"device ID of %s has changed on the system", dev.addr)
+	}
+	driver, _ := m.readLink(dev.addr, "driver")
+	if !m.isVFIODriver(driver) {
+		return allocationError(codes.FailedPrecondition, AllocationReasonNotVFIO, id, dev.addr,
+			"%s is bound to %q, not a VFIO driver", dev.addr, driver)
+	}
+	return nil
+}
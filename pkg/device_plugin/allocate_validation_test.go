@@ -0,0 +1,16 @@
+package device_plugin
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestRejectedAllocations(t *testing.T) {
+	env := newHGXEnvironment(t)
+	_, client := startDevicePlugins(t, env, gpuResource)
+	ctx := testContext(t)
+
+	expectRejected(t, ctx, client, codes.NotFound, AllocationReasonUnknownDevice, "99")
+	expectRejected(t, ctx, client, codes.InvalidArgument, AllocationReasonDuplicateDevice, "10", "10")
+}
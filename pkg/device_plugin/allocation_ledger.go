@@ -0,0 +1,357 @@
+package device_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+
+	"kata-xpu-device-plugin/utils"
+)
+
+const ledgerCheckpointVersion = 1
+
+// LedgerEntry records which container a device was handed to
+type LedgerEntry struct {
+	DeviceID     string    `json:"deviceID"`
+	ResourceName string    `json:"resourceName"`
+	Namespace    string    `json:"namespace,omitempty"`
+	Pod          string    `json:"pod,omitempty"`
+	Container    string    `json:"container,omitempty"`
+	AllocatedAt  time.Time `json:"allocatedAt"`
+	ReconciledAt time.Time `json:"reconciledAt,omitempty"`
+	// Leaked is set when kubelet no longer reports an owner but the VFIO group is still in use
+	Leaked bool `json:"leaked,omitempty"`
+}
+
+type ledgerCheckpoint struct {
+	Version int            `json:"version"`
+	Entries []*LedgerEntry `json:"entries"`
+}
+
+// ledgerReport is the outcome of a reconciliation, keyed by device
+type ledgerReport struct {
+	Leaked         map[ledgerKey]string
+	DoubleAssigned map[ledgerKey]string
+}
+
+// allocationLedger keeps track of the device allocations made through
+// Allocate and reconciles them against the kubelet pod-resources API.
+type allocationLedger struct {
+	mu             sync.Mutex
+	checkpointPath string
+	gracePeriod    time.Duration
+	clock          clock.PassiveClock
+	// inUse reports whether a device is opened, see DeviceBackend.InUse
+	inUse func(resourceName, id string) (bool, error)
+	// entries are keyed by resource too, backends may reuse the device IDs
+	// of one another
+	entries map[ledgerKey]*LedgerEntry
+}
+
+// ledgerKey identifies a device of a resource in the ledger
+type ledgerKey struct {
+	resourceName string
+	id           string
+}
+
+type containerOwner struct {
+	namespace string
+	pod       string
+	container string
+}
+
+func (o containerOwner) String() string {
+	return fmt.Sprintf("%s/%s/%s", o.namespace, o.pod, o.container)
+}
+
+// newAllocationLedger creates a ledger and restores the entries of its
+// checkpoint file, if any
+func newAllocationLedger(checkpointPath string, gracePeriod time.Duration, clk clock.PassiveClock, inUse func(string, string) (bool, error)) *allocationLedger {
+	l := &allocationLedger{
+		checkpointPath: checkpointPath,
+		gracePeriod:    gracePeriod,
+		clock:          clk,
+		inUse:          inUse,
+		entries:        make(map[ledgerKey]*LedgerEntry),
+	}
+	if err := l.load(); err != nil {
+		log.Printf("Error restoring allocation ledger from %s: %v", checkpointPath, err)
+	}
+	return l
+}
+
+// RecordAllocation adds the devices handed out by Allocate. Their owner is
+// not known until the next reconciliation.
+func (l *allocationLedger) RecordAllocation(resourceName string, deviceIDs []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	for _, id := range deviceIDs {
+		l.entries[ledgerKey{resourceName, id}] = &LedgerEntry{
+			DeviceID:     id,
+			ResourceName: resourceName,
+			AllocatedAt:  now,
+		}
+	}
+	l.saveLocked()
+}
+
+// Entries returns a copy of the ledger sorted by resource and device ID
+func (l *allocationLedger) Entries() []LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]LedgerEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entryLess(&entries[i], &entries[j]) })
+	return entries
+}
+
+// entryLess orders entries by resource and device ID
+func entryLess(a, b *LedgerEntry) bool {
+	if a.ResourceName != b.ResourceName {
+		return a.ResourceName < b.ResourceName
+	}
+	return a.DeviceID < b.DeviceID
+}
+
+// Reconcile updates the ledger from the device assignments kubelet reports.
+// Devices owned by kubelet get their owner recorded, devices reported for
+// more than one pod are double-assigned, and devices kubelet no longer
+// reports are released unless their VFIO group is still in use, in which
+// case they are leaked.
+func (l *allocationLedger) Reconcile(assignments []utils.DeviceAssignment, now time.Time) ledgerReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	report := ledgerReport{
+		Leaked:         make(map[ledgerKey]string),
+		DoubleAssigned: make(map[ledgerKey]string),
+	}
+
+	owners := make(map[ledgerKey][]containerOwner)
+	for _, assignment := range assignments {
+		for _, id := range assignment.DeviceIDs {
+			key := ledgerKey{assignment.ResourceName, id}
+			owners[key] = append(owners[key], containerOwner{
+				namespace: assignment.Namespace,
+				pod:       assignment.Pod,
+				container: assignment.Container,
+			})
+		}
+	}
+
+	for key, owned := range owners {
+		// Init and app containers of the same pod legitimately share devices
+		pods := map[string]bool{}
+		for _, owner := range owned {
+			pods[owner.namespace+"/"+owner.pod] = true
+		}
+		if len(pods) > 1 {
+			names := []string{}
+			for _, owner := range owned {
+				names = append(names, owner.String())
+			}
+			report.DoubleAssigned[key] = fmt.Sprintf("IOMMU group %s is assigned to %s", key.id, strings.Join(names, ", "))
+		}
+
+		entry, ok := l.entries[key]
+		if !ok {
+			// Allocated before the ledger existed or without a checkpoint
+			entry = &LedgerEntry{DeviceID: key.id, ResourceName: key.resourceName, AllocatedAt: now}
+			l.entries[key] = entry
+		}
+		entry.Namespace = owned[0].namespace
+		entry.Pod = owned[0].pod
+		entry.Container = owned[0].container
+		entry.ReconciledAt = now
+		entry.Leaked = false
+	}
+
+	for key, entry := range l.entries {
+		if _, ok := owners[key]; ok {
+			continue
+		}
+		if now.Sub(entry.AllocatedAt) < l.gracePeriod {
+			continue
+		}
+		busy, err := l.inUse(key.resourceName, key.id)
+		if err != nil {
+			log.Printf("Error checking IOMMU group %s of ledger entry: %v", key.id, err)
+		}
+		if busy {
+			lastOwner := "unknown"
+			if entry.Pod != "" {
+				lastOwner = entry.Namespace + "/" + entry.Pod
+			}
+			entry.Leaked = true
+			report.Leaked[key] = fmt.Sprintf("IOMMU group %s is in use but not assigned to any pod (last owner %s)",
+				key.id, lastOwner)
+			continue
+		}
+		delete(l.entries, key)
+	}
+
+	l.saveLocked()
+	return report
+}
+
+// reconcileLedger queries kubelet and feeds the outcome of the
+// reconciliation into the health of the devices and the metrics
+func (m *Manager) reconcileLedger(plugins []*GenericDevicePlugin) {
+	l := m.ledger
+	client, err := utils.NewPodResourcesClient(m.podResourcesOptions())
+	if err != nil {
+		log.Printf("Error connecting to pod resources API for ledger reconciliation: %v", err)
+		ledgerReconcileErrors.Inc()
+		return
+	}
+	defer client.Close()
+
+	assignments, err := client.AllocatedDevices(context.Background(), DevicePluginNamespace+"/")
+	if err != nil {
+		log.Printf("Error listing pod resources for ledger reconciliation: %v", err)
+		ledgerReconcileErrors.Inc()
+		return
+	}
+
+	report := l.Reconcile(servedAssignments(assignments, plugins), m.clock.Now())
+	for _, reason := range report.DoubleAssigned {
+		log.Printf("Allocation ledger: %s", reason)
+	}
+	for _, reason := range report.Leaked {
+		log.Printf("Allocation ledger: %s", reason)
+	}
+
+	for _, dp := range plugins {
+		for _, dev := range dp.state.List() {
+			key := ledgerKey{dp.resourceName(), dev.ID}
+			if reason, ok := report.DoubleAssigned[key]; ok {
+				dp.state.SetUnhealthy(dev.ID, healthSourceLedger, reason)
+			} else if reason, ok := report.Leaked[key]; ok {
+				dp.state.SetUnhealthy(dev.ID, healthSourceLedger, reason)
+			} else {
+				dp.state.ClearUnhealthy(dev.ID, healthSourceLedger)
+			}
+		}
+	}
+
+	ledgerAllocations.Set(float64(len(l.Entries())))
+	ledgerLeakedGroups.Set(float64(len(report.Leaked)))
+	ledgerDoubleAssignedGroups.Set(float64(len(report.DoubleAssigned)))
+}
+
+// servedAssignments keeps the assignments of the resources the plugins
+// serve. Other device plugins, like the NVIDIA one for nvidia.com/gpu and
+// the MIG resources, share the resource namespace.
+func servedAssignments(assignments []utils.DeviceAssignment, plugins []*GenericDevicePlugin) []utils.DeviceAssignment {
+	served := make(map[string]bool, len(plugins))
+	for _, dp := range plugins {
+		served[dp.resourceName()] = true
+	}
+	filtered := []utils.DeviceAssignment{}
+	for _, assignment := range assignments {
+		if served[assignment.ResourceName] {
+			filtered = append(filtered, assignment)
+		}
+	}
+	return filtered
+}
+
+func (m *Manager) podResourcesOptions() utils.PodResourcesOptions {
+	return utils.PodResourcesOptions{
+		Socket:            m.cfg.PodResources.Socket,
+		ConnectionTimeout: m.cfg.PodResources.ConnectionTimeout,
+		RequestTimeout:    m.cfg.PodResources.RequestTimeout,
+	}
+}
+
+// runLedgerReconciler periodically reconciles the ledger until the manager stops
+func (m *Manager) runLedgerReconciler(plugins []*GenericDevicePlugin) {
+	if m.cfg.Ledger.ReconcileInterval <= 0 {
+		// Load rejects it, a configuration built in code may still have it
+		log.Printf("Invalid ledger reconcile interval %v, not reconciling the allocation ledger", m.cfg.Ledger.ReconcileInterval)
+		return
+	}
+	ticker := m.clock.NewTicker(m.cfg.Ledger.ReconcileInterval)
+	defer ticker.Stop()
+
+	m.reconcileLedger(plugins)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C():
+			m.reconcileLedger(plugins)
+		}
+	}
+}
+
+func (l *allocationLedger) load() error {
+	data, err := os.ReadFile(l.checkpointPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var checkpoint ledgerCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return err
+	}
+	if checkpoint.Version != ledgerCheckpointVersion {
+		return fmt.Errorf("unsupported checkpoint version %d", checkpoint.Version)
+	}
+	for _, entry := range checkpoint.Entries {
+		l.entries[ledgerKey{entry.ResourceName, entry.DeviceID}] = entry
+	}
+	log.Printf("Restored %d allocation ledger entries from %s", len(checkpoint.Entries), l.checkpointPath)
+	return nil
+}
+
+// saveLocked atomically writes the checkpoint file
+func (l *allocationLedger) saveLocked() {
+	if l.checkpointPath == "" {
+		return
+	}
+
+	checkpoint := ledgerCheckpoint{Version: ledgerCheckpointVersion, Entries: []*LedgerEntry{}}
+	for _, entry := range l.entries {
+		checkpoint.Entries = append(checkpoint.Entries, entry)
+	}
+	sort.Slice(checkpoint.Entries, func(i, j int) bool {
+		return entryLess(checkpoint.Entries[i], checkpoint.Entries[j])
+	})
+
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding allocation ledger: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.checkpointPath), 0755); err != nil {
+		log.Printf("Error creating allocation ledger directory: %v", err)
+		return
+	}
+	tmp := l.checkpointPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Error writing allocation ledger checkpoint: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, l.checkpointPath); err != nil {
+		log.Printf("Error writing allocation ledger checkpoint: %v", err)
+	}
+}
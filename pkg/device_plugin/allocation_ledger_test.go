@@ -0,0 +1,148 @@
+package device_plugin
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+	testingclock "k8s.io/utils/clock/testing"
+
+	"kata-xpu-device-plugin/utils"
+)
+
+// podResources is a pod of a fake pod-resources List result, with the
+// devices of gpuResource of each container
+func podResources(namespace, name string, containers map[string][]string) *podresourcesapi.PodResources {
+	return resourcePod(namespace, name, gpuResource, containers)
+}
+
+// resourcePod is a pod of a fake pod-resources List result, with the
+// devices of resource of each container
+func resourcePod(namespace, name, resource string, containers map[string][]string) *podresourcesapi.PodResources {
+	pod := &podresourcesapi.PodResources{Namespace: namespace, Name: name}
+	for container, ids := range containers {
+		pod.Containers = append(pod.Containers, &podresourcesapi.ContainerResources{
+			Name:    container,
+			Devices: []*podresourcesapi.ContainerDevices{{ResourceName: resource, DeviceIds: ids}},
+		})
+	}
+	return pod
+}
+
+// listAssignments extracts the assignments of a List result like
+// PodResourcesClient.AllocatedDevices does
+func listAssignments(resp *podresourcesapi.ListPodResourcesResponse) []utils.DeviceAssignment {
+	assignments := []utils.DeviceAssignment{}
+	for _, pod := range resp.GetPodResources() {
+		assignments = append(assignments, utils.DeviceAssignments(pod, DevicePluginNamespace+"/")...)
+	}
+	return assignments
+}
+
+func TestLedgerReconcile(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := testingclock.NewFakePassiveClock(start)
+	inUse := map[string]bool{"12": true}
+	checkpoint := filepath.Join(t.TempDir(), "allocations.json")
+	l := newAllocationLedger(checkpoint, 10*time.Second, clk, func(resource, id string) (bool, error) {
+		return resource == gpuResource && inUse[id], nil
+	})
+	l.RecordAllocation(gpuResource, []string{"10", "11", "12", "13"})
+
+	// 10 is in two pods, 11 is shared by the init and app containers of a
+	// pod, 12 and 13 are no longer reported and 14 predates the ledger
+	list := &podresourcesapi.ListPodResourcesResponse{PodResources: []*podresourcesapi.PodResources{
+		podResources("default", "vm-a", map[string][]string{"qemu": {"10"}}),
+		podResources("default", "vm-b", map[string][]string{"qemu": {"10"}}),
+		podResources("team", "vm-c", map[string][]string{"init": {"11"}, "qemu": {"11"}}),
+		podResources("team", "vm-d", map[string][]string{"qemu": {"14"}}),
+	}}
+	assignments := listAssignments(list)
+
+	// Within the grace period the unreported allocations are kept as is
+	report := l.Reconcile(assignments, start.Add(time.Second))
+	if len(report.Leaked) != 0 || len(l.Entries()) != 5 {
+		t.Fatalf("expected no leak within the grace period, got %v with %d entries", report.Leaked, len(l.Entries()))
+	}
+	if len(report.DoubleAssigned) != 1 || !strings.Contains(report.DoubleAssigned[ledgerKey{gpuResource, "10"}], "default/vm-a/qemu") ||
+		!strings.Contains(report.DoubleAssigned[ledgerKey{gpuResource, "10"}], "default/vm-b/qemu") {
+		t.Fatalf("expected device 10 double-assigned to both pods, got %v", report.DoubleAssigned)
+	}
+
+	report = l.Reconcile(assignments, start.Add(time.Minute))
+	if len(report.Leaked) != 1 || !strings.Contains(report.Leaked[ledgerKey{gpuResource, "12"}], "in use but not assigned") {
+		t.Fatalf("expected device 12 leaked, got %v", report.Leaked)
+	}
+	if _, ok := report.DoubleAssigned[ledgerKey{gpuResource, "11"}]; ok {
+		t.Fatalf("containers of the same pod are not double-assigned: %v", report.DoubleAssigned)
+	}
+
+	entries := map[string]LedgerEntry{}
+	for _, entry := range l.Entries() {
+		entries[entry.DeviceID] = entry
+	}
+	if _, ok := entries["13"]; ok {
+		t.Fatalf("released device 13 still in the ledger")
+	}
+	if entry := entries["14"]; entry.Pod != "vm-d" || entry.ResourceName != gpuResource {
+		t.Fatalf("expected device 14 owned by team/vm-d, got %+v", entry)
+	}
+	if entry := entries["12"]; !entry.Leaked {
+		t.Fatalf("expected device 12 marked leaked, got %+v", entry)
+	}
+
+	// The outcome survives a restart, and a leak clears once kubelet reports the owner again
+	restored := newAllocationLedger(checkpoint, 10*time.Second, clk, func(string, string) (bool, error) { return false, nil })
+	if n := len(restored.Entries()); n != 4 {
+		t.Fatalf("expected 4 entries restored from the checkpoint, got %d", n)
+	}
+	list.PodResources = append(list.PodResources, podResources("team", "vm-e", map[string][]string{"qemu": {"12"}}))
+	report = restored.Reconcile(listAssignments(list), start.Add(2*time.Minute))
+	if len(report.Leaked) != 0 {
+		t.Fatalf("expected the leak cleared, got %v", report.Leaked)
+	}
+}
+
+// TestLedgerServedResources checks that the ledger only tracks the resources
+// the plugins serve, and tells the same ID of two resources apart
+func TestLedgerServedResources(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := testingclock.NewFakePassiveClock(start)
+	l := newAllocationLedger("", time.Second, clk, func(string, string) (bool, error) { return true, nil })
+
+	plugins := []*GenericDevicePlugin{
+		{devpluginName: strings.TrimPrefix(gpuResource, DevicePluginNamespace+"/")},
+		{devpluginName: strings.TrimPrefix(vfResource, DevicePluginNamespace+"/")},
+	}
+	// The upstream NVIDIA plugin shares the namespace, its IDs are no
+	// concern of the ledger even when they look like IOMMU groups
+	list := &podresourcesapi.ListPodResourcesResponse{PodResources: []*podresourcesapi.PodResources{
+		podResources("default", "vm-a", map[string][]string{"qemu": {"10"}}),
+		resourcePod("default", "vm-b", vfResource, map[string][]string{"qemu": {"10"}}),
+		resourcePod("default", "cuda-a", "nvidia.com/gpu", map[string][]string{"app": {"10"}}),
+		resourcePod("default", "cuda-b", "nvidia.com/mig-1g.10gb", map[string][]string{"app": {"10"}}),
+	}}
+	assignments := servedAssignments(listAssignments(list), plugins)
+	if len(assignments) != 2 {
+		t.Fatalf("expected the assignments of the served resources only, got %+v", assignments)
+	}
+
+	report := l.Reconcile(assignments, start)
+	if len(report.DoubleAssigned) != 0 {
+		t.Fatalf("the same ID of two resources is not double-assigned: %v", report.DoubleAssigned)
+	}
+	entries := l.Entries()
+	if len(entries) != 2 || entries[0].ResourceName != gpuResource || entries[0].Pod != "vm-a" ||
+		entries[1].ResourceName != vfResource || entries[1].Pod != "vm-b" {
+		t.Fatalf("expected one entry per resource, got %+v", entries)
+	}
+
+	// Releasing the VF leaves the entry of the GPU alone
+	list.PodResources = list.PodResources[:1]
+	report = l.Reconcile(servedAssignments(listAssignments(list), plugins), start.Add(time.Minute))
+	if _, ok := report.Leaked[ledgerKey{vfResource, "10"}]; !ok || len(report.Leaked) != 1 {
+		t.Fatalf("expected the VF leaked, got %v", report.Leaked)
+	}
+}
@@ -0,0 +1,220 @@
+package device_plugin
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Symlinks followed when resolving one name, like the Linux MAXSYMLINKS
+const maxSymlinks = 40
+
+// archiveEntry is a file, directory or symlink of a captured sysfs tree
+type archiveEntry struct {
+	path     string // slash separated name, "." for the root
+	mode     fs.FileMode
+	modTime  time.Time
+	data     []byte
+	target   string   // of a symlink, as recorded
+	children []string // base names of the entries of a directory, sorted
+}
+
+func (e *archiveEntry) Name() string       { return path.Base(e.path) }
+func (e *archiveEntry) Size() int64        { return int64(len(e.data)) }
+func (e *archiveEntry) Mode() fs.FileMode  { return e.mode }
+func (e *archiveEntry) ModTime() time.Time { return e.modTime }
+func (e *archiveEntry) IsDir() bool        { return e.mode.IsDir() }
+func (e *archiveEntry) Sys() any           { return nil }
+
+// archiveSysFS is a read-only sysfs tree held in memory, see OpenSnapshot.
+// Relative symlinks are resolved within the tree, links leaving it or
+// absolute ones resolve to nothing.
+type archiveSysFS struct {
+	entries map[string]*archiveEntry // by slash separated name
+}
+
+func newArchiveSysFS() *archiveSysFS {
+	return &archiveSysFS{entries: map[string]*archiveEntry{
+		".": {path: ".", mode: fs.ModeDir | 0555},
+	}}
+}
+
+// add records an entry and the directories above it
+func (a *archiveSysFS) add(name string, e *archiveEntry) {
+	e.path = name
+	a.entries[name] = e
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if _, ok := a.entries[dir]; ok {
+			break
+		}
+		a.entries[dir] = &archiveEntry{path: dir, mode: fs.ModeDir | 0555, modTime: e.modTime}
+	}
+}
+
+// index fills the children of every directory once all entries are added
+func (a *archiveSysFS) index() {
+	for name := range a.entries {
+		if name == "." {
+			continue
+		}
+		parent := a.entries[path.Dir(name)]
+		parent.children = append(parent.children, path.Base(name))
+	}
+	for _, e := range a.entries {
+		sort.Strings(e.children)
+	}
+}
+
+// resolve follows the symlinks of name, except the last element unless
+// followLast, and returns the entry it names
+func (a *archiveSysFS) resolve(op, name string, followLast bool) (*archiveEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	var parts []string
+	if name != "." {
+		parts = strings.Split(name, "/")
+	}
+	resolved := "."
+	links := 0
+	for i := 0; i < len(parts); i++ {
+		current := path.Join(resolved, parts[i])
+		e, ok := a.entries[current]
+		if !ok || (i > 0 && !a.entries[resolved].IsDir()) {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if e.mode&fs.ModeSymlink == 0 || (i == len(parts)-1 && !followLast) {
+			resolved = current
+			continue
+		}
+
+		links++
+		target := path.Join(resolved, e.target)
+		if links > maxSymlinks || path.IsAbs(e.target) || target == ".." || strings.HasPrefix(target, "../") {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		// Start over from the target with the rest of the name
+		rest := parts[i+1:]
+		parts = nil
+		if target != "." {
+			parts = strings.Split(target, "/")
+		}
+		parts = append(parts, rest...)
+		resolved = "."
+		i = -1
+	}
+	return a.entries[resolved], nil
+}
+
+func (a *archiveSysFS) Open(name string) (fs.File, error) {
+	e, err := a.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if e.IsDir() {
+		return &archiveDir{fs: a, name: name, entry: e}, nil
+	}
+	return &archiveFile{entry: e, Reader: bytes.NewReader(e.data)}, nil
+}
+
+func (a *archiveSysFS) ReadFile(name string) ([]byte, error) {
+	e, err := a.resolve("readfile", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if e.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+	return append([]byte{}, e.data...), nil
+}
+
+// ReadDir lists the entries of a directory without following their links,
+// like os.ReadDir
+func (a *archiveSysFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := a.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return a.dirEntries(e), nil
+}
+
+func (a *archiveSysFS) dirEntries(dir *archiveEntry) []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(dir.children))
+	for _, child := range dir.children {
+		entries = append(entries, fs.FileInfoToDirEntry(a.entries[path.Join(dir.path, child)]))
+	}
+	return entries
+}
+
+func (a *archiveSysFS) Stat(name string) (fs.FileInfo, error) {
+	return a.resolve("stat", name, true)
+}
+
+func (a *archiveSysFS) ReadLink(name string) (string, error) {
+	e, err := a.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if e.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.target, nil
+}
+
+// WriteFile fails, a snapshot is never modified
+func (a *archiveSysFS) WriteFile(name string, data []byte) error {
+	return &fs.PathError{Op: "writefile", Path: name, Err: fs.ErrPermission}
+}
+
+// archiveFile is an open regular file of an archiveSysFS
+type archiveFile struct {
+	entry *archiveEntry
+	*bytes.Reader
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.entry, nil }
+func (f *archiveFile) Close() error               { return nil }
+
+// archiveDir is an open directory of an archiveSysFS
+type archiveDir struct {
+	fs      *archiveSysFS
+	name    string
+	entry   *archiveEntry
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.entry, nil }
+func (d *archiveDir) Close() error               { return nil }
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		d.entries = d.fs.dirEntries(d.entry)
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
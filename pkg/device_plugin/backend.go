@@ -0,0 +1,169 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// DeviceBackend discovers devices of one kind and tells how to hand them to
+// a Kata VM. A GenericDevicePlugin serves one resource of a backend and
+// knows nothing of the devices but their IDs.
+//
+// Resources are named without the nvidia.com/ prefix, e.g. GH100.
+type DeviceBackend interface {
+	// Name is the name of the backend in the configuration
+	Name() string
+	// Discover refreshes the devices of the backend and returns them per
+	// resource. The other methods work on the outcome of the last discovery.
+	Discover() ([]BackendResource, error)
+	// CDIDevices returns the CDI devices of every discovered device
+	CDIDevices() []CDIDevice
+	// WatchHealth reports health changes of the devices of a resource to
+	// devices until stop is closed
+	WatchHealth(resource string, devices HealthReporter, stop <-chan struct{})
+	// ValidateAllocation checks that the devices can still be allocated,
+	// it returns an *AllocationError otherwise. Health and duplicates are
+	// checked by the device plugin.
+	ValidateAllocation(resource string, ids []string) error
+	// Allocate returns the fully qualified CDI names of the devices
+	Allocate(resource string, ids []string) ([]string, error)
+	// PreferredAllocation picks size devices among available
+	PreferredAllocation(resource string, available, mustInclude []string, size int) []string
+	// PreStart prepares the allocated devices before the container starts
+	PreStart(resource string, ids []string) error
+	// InUse reports whether a device is opened by a VM
+	InUse(id string) (bool, error)
+	// Location names a device in events and logs
+	Location(id string) string
+}
+
+// BackendResource is a resource discovered by a backend
+type BackendResource struct {
+	Name    string
+	Devices []*pluginapi.Device
+}
+
+// CDIDevice is a device of the CDI spec, Name is unqualified
+type CDIDevice struct {
+	// Resource the device belongs to, empty for devices only passed through
+	// alongside others, e.g. NVSwitches
+	Resource    string
+	Name        string
+	Annotations map[string]string
+	DeviceNodes []string
+}
+
+// HealthReporter receives the health changes found by a backend
+type HealthReporter interface {
+	SetUnhealthy(id string, source string, reason string) bool
+	ClearUnhealthy(id string, source string) bool
+}
+
+// newBackend returns the backend configured under name
+func (m *Manager) newBackend(name string) (DeviceBackend, error) {
+	switch name {
+	case config.BackendVFIO:
+		return &vfioBackend{m: m}, nil
+	case config.BackendMdev:
+		return &mdevBackend{m: m}, nil
+	case config.BackendSRIOVVF:
+		return &sriovBackend{m: m}, nil
+	case config.BackendSimulated:
+		return &simulatedBackend{m: m}, nil
+	}
+	return nil, fmt.Errorf("unknown device backend %q", name)
+}
+
+// selected reports whether backend serves resource in the configuration
+func (m *Manager) selected(backend DeviceBackend, resource string) bool {
+	return m.cfg.Backends.ForResource(fmt.Sprintf("%s/%s", DevicePluginNamespace, resource)) == backend.Name()
+}
+
+// backendResources runs the discovery of every backend and keeps the
+// resources each one is selected for
+func (m *Manager) backendResources() map[DeviceBackend][]BackendResource {
+	resources := map[DeviceBackend][]BackendResource{}
+	for _, backend := range m.backends {
+		discovered, err := backend.Discover()
+		if err != nil {
+			log.Printf("Error discovering %s devices: %v", backend.Name(), err)
+			continue
+		}
+		for _, res := range discovered {
+			if !m.selected(backend, res.Name) {
+				log.Printf("Resource %s discovered by the %s backend is served by the %s backend", res.Name, backend.Name(),
+					m.cfg.Backends.ForResource(fmt.Sprintf("%s/%s", DevicePluginNamespace, res.Name)))
+				continue
+			}
+			resources[backend] = append(resources[backend], res)
+		}
+	}
+	return resources
+}
+
+// buildCDISpec renders the CDI devices of every backend, keeping only the
+// resources a backend is selected for. Backends return their devices in a
+// stable order so that regenerating the spec gives the same file.
+func (m *Manager) buildCDISpec() *cdihandler.CdiSpec {
+	cs := cdihandler.New()
+	cs.NewContainerEdits(nil)
+	for _, backend := range m.backends {
+		for _, dev := range backend.CDIDevices() {
+			if dev.Resource != "" && !m.selected(backend, dev.Resource) {
+				continue
+			}
+			nodes := []*cdihandler.DeviceNode{}
+			for _, path := range dev.DeviceNodes {
+				nodes = append(nodes, &cdihandler.DeviceNode{Path: path})
+			}
+			cs.NewDevice(dev.Name, dev.Annotations, nodes)
+		}
+	}
+	return cs
+}
+
+// usesBackend reports whether a backend of the given name is selected
+func (m *Manager) usesBackend(name string) bool {
+	for _, backend := range m.backends {
+		if backend.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// usesHostDevices reports whether a backend hands out devices of the host,
+// i.e. any but the simulated one
+func (m *Manager) usesHostDevices() bool {
+	for _, backend := range m.backends {
+		if backend.Name() != config.BackendSimulated {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceInUse reports whether a device of the resource is opened
+func (m *Manager) deviceInUse(resourceName, id string) (bool, error) {
+	m.statusMu.Lock()
+	plugins := m.plugins
+	m.statusMu.Unlock()
+	for _, dp := range plugins {
+		if dp.resourceName() == resourceName && dp.state.Has(id) {
+			return dp.backend.InUse(id)
+		}
+	}
+	return false, nil
+}
+
+// sortedResources orders resources by name for a stable startup
+func sortedResources(resources []BackendResource) []BackendResource {
+	sort.Slice(resources, func(i, j int) bool { return resources[i].Name < resources[j].Name })
+	return resources
+}
@@ -0,0 +1,162 @@
+package device_plugin
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+)
+
+// deviceMap keys of the CC-capable devices, advertised as a resource of their own
+const ccDeviceKeySuffix = "/cc"
+
+// Directories the firmware of a confidential computing technology shows up
+// in once initialized, the TDX module and the SEV firmware
+const (
+	tdxFirmwareDir = "firmware/tdx"
+	sevFirmwareDir = "firmware/sev"
+)
+
+// CCHost lists the confidential computing technologies the host kernel
+// enabled in KVM, and whether their firmware is initialized
+type CCHost struct {
+	TDX    bool `json:"tdx" yaml:"tdx"`
+	SEV    bool `json:"sev" yaml:"sev"`
+	SEVES  bool `json:"sevES" yaml:"sevES"`
+	SEVSNP bool `json:"sevSNP" yaml:"sevSNP"`
+	// TDXFirmware and SEVFirmware are set when /sys/firmware has the TDX
+	// module or the SEV firmware, KVM alone cannot start a confidential VM
+	TDXFirmware bool `json:"tdxFirmware" yaml:"tdxFirmware"`
+	SEVFirmware bool `json:"sevFirmware" yaml:"sevFirmware"`
+}
+
+// Platform names the confidential VM technology of the host, empty if none
+func (h CCHost) Platform() string {
+	switch {
+	case h.TDX && h.TDXFirmware:
+		return "tdx"
+	case h.SEVSNP && h.SEVFirmware:
+		return "sev-snp"
+	default:
+		return ""
+	}
+}
+
+// missingPlatform tells why the host has no confidential VM technology
+func (h CCHost) missingPlatform() string {
+	switch {
+	case h.TDX:
+		return fmt.Sprintf("KVM has TDX enabled but the TDX module is not initialized (no /sys/%s)", tdxFirmwareDir)
+	case h.SEVSNP:
+		return fmt.Sprintf("KVM has SEV-SNP enabled but the SEV firmware is not initialized (no /sys/%s)", sevFirmwareDir)
+	default:
+		return "host has neither TDX nor SEV-SNP enabled in KVM"
+	}
+}
+
+// CCDevice holds the confidential computing facts of an IOMMU group
+type CCDevice struct {
+	// IommuMode is the type of the IOMMU group, DMA translation is required
+	IommuMode string `json:"iommuMode" yaml:"iommuMode"`
+	ATS       bool   `json:"ats" yaml:"ats"`
+	PRI       bool   `json:"pri" yaml:"pri"`
+	PASID     bool   `json:"pasid" yaml:"pasid"`
+	// Capable is set when the device can be passed through to a confidential VM
+	Capable bool `json:"capable" yaml:"capable"`
+	// Reason tells why the device is not capable
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+// Capabilities lists the supported PCIe capabilities, e.g. "ats,pasid"
+func (d CCDevice) Capabilities() string {
+	caps := []string{}
+	for _, c := range []struct {
+		name string
+		ok   bool
+	}{{"ats", d.ATS}, {"pri", d.PRI}, {"pasid", d.PASID}} {
+		if c.ok {
+			caps = append(caps, c.name)
+		}
+	}
+	return strings.Join(caps, ",")
+}
+
+// readCCHost reads the KVM module parameters enabling TDX and SEV, and the
+// state of their firmware
+func (m *Manager) readCCHost() CCHost {
+	param := func(module, name string) bool {
+		data, err := m.sysfs.ReadFile(path.Join("module", module, "parameters", name))
+		if err != nil {
+			return false
+		}
+		value := strings.TrimSpace(string(data))
+		return value == "Y" || value == "1"
+	}
+	return CCHost{
+		TDX:    param("kvm_intel", "tdx"),
+		SEV:    param("kvm_amd", "sev"),
+		SEVES:  param("kvm_amd", "sev_es"),
+		SEVSNP: param("kvm_amd", "sev_snp"),
+
+		TDXFirmware: m.firmwareInitialized(tdxFirmwareDir),
+		SEVFirmware: m.firmwareInitialized(sevFirmwareDir),
+	}
+}
+
+// firmwareInitialized reports whether the firmware directory exists in sysfs
+func (m *Manager) firmwareInitialized(dir string) bool {
+	info, err := m.sysfs.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+// readCCDevice collects the facts of the function at deviceAddress and
+// decides whether it can be passed through to a confidential VM
+func (m *Manager) readCCDevice(deviceAddress string, host CCHost, required []string) CCDevice {
+	dev := CCDevice{}
+	if mode, err := readAttribute(m.sysfs, deviceAddress, "iommu_group", "type"); err == nil {
+		dev.IommuMode = mode
+	}
+	caps, err := m.readExtCapabilities(deviceAddress)
+	if err != nil {
+		dev.Reason = fmt.Sprintf("cannot read PCI config space: %v", err)
+		return dev
+	}
+	dev.ATS, dev.PRI, dev.PASID = caps[extCapATS] != 0, caps[extCapPRI] != 0, caps[extCapPASID] != 0
+
+	switch {
+	case host.Platform() == "":
+		dev.Reason = host.missingPlatform()
+	case dev.IommuMode != "" && !strings.HasPrefix(dev.IommuMode, "DMA"):
+		dev.Reason = fmt.Sprintf("IOMMU group is in %s mode, DMA translation is required", dev.IommuMode)
+	default:
+		dev.Capable = true
+		for _, c := range required {
+			if !strings.Contains(","+dev.Capabilities()+",", ","+strings.ToLower(c)+",") {
+				dev.Capable = false
+				dev.Reason = fmt.Sprintf("missing required PCIe capability %s", c)
+				break
+			}
+		}
+	}
+	return dev
+}
+
+// addCCAnnotations tells the runtime whether the group can go to a
+// confidential VM and how, so it can pick the guest configuration. Groups
+// have CC facts only when confidential computing is enabled.
+func (d *discovery) addCCAnnotations(annotations map[string]string, iommuGroup string) {
+	dev, ok := d.ccDevices[iommuGroup]
+	if !ok {
+		return
+	}
+	annotations[cdihandler.CCCapableAnnotation] = strconv.FormatBool(dev.Capable)
+	if dev.Capable {
+		annotations[cdihandler.CCPlatformAnnotation] = d.ccHost.Platform()
+	}
+	if dev.IommuMode != "" {
+		annotations[cdihandler.IommuModeAnnotation] = dev.IommuMode
+	}
+	annotations[cdihandler.PCIeCapabilitiesAnnotation] = dev.Capabilities()
+}
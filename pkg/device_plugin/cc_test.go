@@ -0,0 +1,48 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfidentialComputingFirmware(t *testing.T) {
+	env := newEnvironment(t)
+	if err := env.AddHGXBoard(0x18, 10, 0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	// A config space without extended capabilities, readable without root
+	config := filepath.Join(env.Sysfs.Root, pciDevicesDir, "0000:18:00.0", "config")
+	if err := os.WriteFile(config, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Sysfs.LoadModule("kvm_intel", map[string]string{"tdx": "Y"}); err != nil {
+		t.Fatal(err)
+	}
+	env.Config.ConfidentialComputing.Enabled = true
+	m := NewManager(env.Config, Options{})
+
+	result := m.Discover()
+	if result.Host == nil || !result.Host.TDX || result.Host.TDXFirmware || result.Host.Platform() != "" {
+		t.Fatalf("expected TDX enabled in KVM without its firmware, got %+v", result.Host)
+	}
+	cc := result.Devices[0].ConfidentialComputing
+	if cc == nil || cc.Capable || !strings.Contains(cc.Reason, "TDX module is not initialized") {
+		t.Fatalf("expected the device not CC-capable for lack of the TDX module, got %+v", cc)
+	}
+	if name := result.Devices[0].ResourceName; name != gpuResource {
+		t.Fatalf("expected the plain resource, got %s", name)
+	}
+
+	if err := os.MkdirAll(filepath.Join(env.Sysfs.Root, tdxFirmwareDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	result = m.Discover()
+	if result.Host.Platform() != "tdx" || !result.Devices[0].ConfidentialComputing.Capable {
+		t.Fatalf("expected the device CC-capable on TDX, got %+v and %+v", result.Host, result.Devices[0].ConfidentialComputing)
+	}
+	if name := result.Devices[0].ResourceName; name != gpuResource+env.Config.ConfidentialComputing.ResourceSuffix {
+		t.Fatalf("expected the CC resource, got %s", name)
+	}
+}
@@ -0,0 +1,156 @@
+package device_plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+)
+
+// ValidateCDISpec runs the checks specific to the specs written by the plugin:
+// device nodes exist below devRoot and the vfio and bdf annotations of every
+// device agree with the IOMMU groups found in the sysfs tree of the manager.
+// Mediated devices are checked by UUID instead of bdf, simulated devices are
+// only checked for their device nodes.
+func (m *Manager) ValidateCDISpec(spec *cdihandler.CdiSpec, devRoot string) []error {
+	errs := []error{}
+	names := map[string]bool{}
+	bdfs := map[string]string{}
+	for _, dev := range spec.Devices {
+		if names[dev.Name] {
+			errs = append(errs, fmt.Errorf("device %q: duplicate device name", dev.Name))
+		}
+		names[dev.Name] = true
+
+		for _, err := range m.validateCDIDevice(spec.Kind, dev, devRoot) {
+			errs = append(errs, fmt.Errorf("device %q: %w", dev.Name, err))
+		}
+
+		if bdf := dev.Annotations["bdf"]; bdf != "" {
+			if other, ok := bdfs[bdf]; ok {
+				errs = append(errs, fmt.Errorf("device %q: bdf %s is also used by device %q", dev.Name, bdf, other))
+			}
+			bdfs[bdf] = dev.Name
+		}
+	}
+	return errs
+}
+
+func (m *Manager) validateCDIDevice(kind string, dev cdihandler.Device, devRoot string) []error {
+	errs := []error{}
+
+	nodes := map[string]bool{}
+	for _, node := range dev.ContainerEdits.DeviceNodes {
+		if node == nil {
+			continue
+		}
+		nodes[node.Path] = true
+		if _, err := os.Stat(filepath.Join(devRoot, node.Path)); err != nil {
+			errs = append(errs, fmt.Errorf("device node %s: %v", node.Path, err))
+		}
+	}
+	if len(nodes) == 0 {
+		errs = append(errs, fmt.Errorf("no device nodes"))
+	}
+	if dev.Annotations[cdihandler.SimulatedAnnotation] == "true" {
+		// Backed by a harmless node, not by a function of the host
+		return errs
+	}
+
+	// Kata looks up the IOMMU group of a device through its vfio annotation
+	group := ""
+	vfioPrefix := cdihandler.CdiK8SPrefix + "vfio"
+	for key, value := range dev.Annotations {
+		if !strings.HasPrefix(key, vfioPrefix) {
+			continue
+		}
+		if group != "" {
+			errs = append(errs, fmt.Errorf("more than one %s* annotation", vfioPrefix))
+			continue
+		}
+		group = strings.TrimPrefix(key, vfioPrefix)
+		if want := fmt.Sprintf("%s=%s", kind, dev.Name); value != want {
+			errs = append(errs, fmt.Errorf("annotation %s is %q, expected %q", key, value, want))
+		}
+		if node := fmt.Sprintf("/dev/vfio/%s", group); !nodes[node] {
+			errs = append(errs, fmt.Errorf("annotation %s does not match a device node %s", key, node))
+		}
+	}
+	if group == "" {
+		errs = append(errs, fmt.Errorf("missing %s<group> annotation", vfioPrefix))
+	}
+	if uuid, ok := dev.Annotations[cdihandler.MdevUUIDAnnotation]; ok {
+		// Mediated devices have no PCI address of their own
+		return append(errs, m.validateMdev(uuid, group)...)
+	}
+
+	bdf, ok := dev.Annotations["bdf"]
+	if !ok {
+		errs = append(errs, fmt.Errorf("missing bdf annotation"))
+		return errs
+	}
+	if _, err := m.sysfs.Stat(devicePath(bdf)); err != nil {
+		errs = append(errs, fmt.Errorf("bdf %s: device not found in sysfs", bdf))
+		return errs
+	}
+	if group != "" {
+		actual, err := m.readLink(bdf, "iommu_group")
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("bdf %s: %v", bdf, err))
+		case actual != group:
+			errs = append(errs, fmt.Errorf("bdf %s is in IOMMU group %s, annotation says %s", bdf, actual, group))
+		}
+	}
+	if driver, err := m.readLink(bdf, "driver"); err == nil {
+		if !m.isVFIODriver(driver) {
+			errs = append(errs, fmt.Errorf("bdf %s is bound to %s, not a VFIO driver", bdf, driver))
+		} else if variant, ok := dev.Annotations[cdihandler.VFIODriverAnnotation]; ok && variant != driver {
+			errs = append(errs, fmt.Errorf("bdf %s is bound to %s, annotation says %s", bdf, driver, variant))
+		}
+	}
+	if value, ok := dev.Annotations[cdihandler.GroupMembersAnnotation]; ok {
+		errs = append(errs, m.validateGroupMembers(bdf, value)...)
+	}
+	return errs
+}
+
+// validateMdev checks that the mdev exists in the IOMMU group of its annotation
+func (m *Manager) validateMdev(uuid string, group string) []error {
+	mdev, err := m.readMdev(uuid)
+	if err != nil {
+		return []error{fmt.Errorf("mdev %s: device not found in sysfs: %v", uuid, err)}
+	}
+	if group != "" && mdev.group != group {
+		return []error{fmt.Errorf("mdev %s is in IOMMU group %s, annotation says %s", uuid, mdev.group, group)}
+	}
+	return nil
+}
+
+// validateGroupMembers checks the listed members against the IOMMU group of bdf
+func (m *Manager) validateGroupMembers(bdf string, value string) []error {
+	listed, err := parseGroupFunctions(value)
+	if err != nil {
+		return []error{fmt.Errorf("annotation %s: %v", cdihandler.GroupMembersAnnotation, err)}
+	}
+
+	actual := map[string]PCIFunction{}
+	for _, fn := range m.readGroupFunctions(bdf) {
+		actual[fn.BDF] = fn
+	}
+	errs := []error{}
+	for _, fn := range listed {
+		member, ok := actual[fn.BDF]
+		if !ok {
+			errs = append(errs, fmt.Errorf("group member %s is not in the IOMMU group of %s", fn.BDF, bdf))
+			continue
+		}
+		if member.VendorID != fn.VendorID || member.DeviceID != fn.DeviceID || member.Class != fn.Class {
+			errs = append(errs, fmt.Errorf("group member %s is %s:%s:%s, annotation says %s:%s:%s", fn.BDF,
+				member.VendorID, member.DeviceID, member.Class, fn.VendorID, fn.DeviceID, fn.Class))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,274 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+	"k8s.io/utils/clock"
+)
+
+// CordonEntry takes an IOMMU group out of service. It selects the group by
+// its number, by the BDF of one of its functions or by the PCIe serial
+// number of one of its functions, exactly one of which is set.
+type CordonEntry struct {
+	IommuGroup string    `json:"iommuGroup,omitempty" yaml:"iommuGroup,omitempty"`
+	BDF        string    `json:"bdf,omitempty" yaml:"bdf,omitempty"`
+	Serial     string    `json:"serial,omitempty" yaml:"serial,omitempty"`
+	Reason     string    `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Since      time.Time `json:"since,omitempty" yaml:"since,omitempty"`
+}
+
+// cordonFile is the layout of the cordon file
+type cordonFile struct {
+	Devices []CordonEntry `yaml:"devices"`
+}
+
+func (e CordonEntry) validate() error {
+	selectors := 0
+	for _, s := range []string{e.IommuGroup, e.BDF, e.Serial} {
+		if s != "" {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		return fmt.Errorf("a cordon entry needs exactly one of iommuGroup, bdf and serial")
+	}
+	return nil
+}
+
+func (e CordonEntry) String() string {
+	switch {
+	case e.IommuGroup != "":
+		return "iommuGroup " + e.IommuGroup
+	case e.BDF != "":
+		return "bdf " + e.BDF
+	default:
+		return "serial " + e.Serial
+	}
+}
+
+// sameDevice reports whether both entries use the same selector
+func (e CordonEntry) sameDevice(other CordonEntry) bool {
+	return e.IommuGroup == other.IommuGroup && strings.EqualFold(e.BDF, other.BDF) && strings.EqualFold(e.Serial, other.Serial)
+}
+
+// matches reports whether the entry selects the IOMMU group
+func (e CordonEntry) matches(iommuGroup string, devs []NvidiaGpuDevice) bool {
+	if e.IommuGroup != "" {
+		return e.IommuGroup == iommuGroup
+	}
+	for _, dev := range devs {
+		if e.BDF != "" && bdfMatches(dev.addr, []string{e.BDF}) {
+			return true
+		}
+		if e.Serial != "" && strings.EqualFold(e.Serial, dev.serial) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e CordonEntry) reason() string {
+	if e.Reason == "" {
+		return "cordoned"
+	}
+	return "cordoned: " + e.Reason
+}
+
+// cordonManager keeps the cordon file and the health of the devices in sync.
+// The file is the only state: the admin API rewrites it and operators may
+// edit it, both are picked up by the watcher.
+type cordonManager struct {
+	path  string
+	clock clock.PassiveClock
+	// groups returns the functions of the discovered IOMMU groups
+	groups func() map[string][]NvidiaGpuDevice
+
+	mu      sync.Mutex
+	entries []CordonEntry
+	plugins []*GenericDevicePlugin
+}
+
+func newCordonManager(path string, clk clock.PassiveClock, groups func() map[string][]NvidiaGpuDevice) *cordonManager {
+	return &cordonManager{path: path, clock: clk, groups: groups}
+}
+
+// Entries returns a copy of the cordoned devices
+func (c *cordonManager) Entries() []CordonEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CordonEntry{}, c.entries...)
+}
+
+// SetPlugins sets the device plugins whose devices are cordoned and applies
+// the current entries to them
+func (c *cordonManager) SetPlugins(plugins []*GenericDevicePlugin) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.plugins = plugins
+	c.applyLocked()
+}
+
+// Reload reads the cordon file and applies it, a missing file cordons nothing
+func (c *cordonManager) Reload() error {
+	var file cordonFile
+	data, err := os.ReadFile(c.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse cordon file %s: %v", c.path, err)
+	}
+	entries := []CordonEntry{}
+	for _, entry := range file.Devices {
+		if err := entry.validate(); err != nil {
+			log.Printf("Ignoring cordon entry %+v in %s: %v", entry, c.path, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = entries
+	c.applyLocked()
+	return nil
+}
+
+// Cordon adds the entry, replacing any entry for the same device
+func (c *cordonManager) Cordon(entry CordonEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	if entry.Since.IsZero() {
+		entry.Since = c.clock.Now().UTC().Truncate(time.Second)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := []CordonEntry{}
+	for _, e := range c.entries {
+		if !e.sameDevice(entry) {
+			entries = append(entries, e)
+		}
+	}
+	entries = append(entries, entry)
+	if err := c.saveLocked(entries); err != nil {
+		return err
+	}
+	c.entries = entries
+	c.applyLocked()
+	log.Printf("Cordoned %s: %s", entry, entry.reason())
+	return nil
+}
+
+// Uncordon removes the entry for the same device, it returns false if there is none
+func (c *cordonManager) Uncordon(entry CordonEntry) (bool, error) {
+	if err := entry.validate(); err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := []CordonEntry{}
+	for _, e := range c.entries {
+		if !e.sameDevice(entry) {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == len(c.entries) {
+		return false, nil
+	}
+	if err := c.saveLocked(entries); err != nil {
+		return false, err
+	}
+	c.entries = entries
+	c.applyLocked()
+	log.Printf("Uncordoned %s", entry)
+	return true, nil
+}
+
+// saveLocked atomically writes the cordon file
+func (c *cordonManager) saveLocked(entries []CordonEntry) error {
+	data, err := yaml.Marshal(cordonFile{Devices: entries})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// applyLocked marks the devices selected by an entry unhealthy and clears
+// the others
+func (c *cordonManager) applyLocked() {
+	groups := c.groups()
+	for _, dp := range c.plugins {
+		for _, dev := range dp.state.List() {
+			reason := ""
+			for _, entry := range c.entries {
+				if entry.matches(dev.ID, groups[dev.ID]) {
+					reason = entry.reason()
+					break
+				}
+			}
+			if reason != "" {
+				dp.state.SetUnhealthy(dev.ID, healthSourceCordon, reason)
+			} else {
+				dp.state.ClearUnhealthy(dev.ID, healthSourceCordon)
+			}
+		}
+	}
+}
+
+// Run watches the directory of the cordon file, editors and the admin API
+// replace the file, and reloads it on every change until stop is closed
+func (c *cordonManager) Run(stop <-chan struct{}) {
+	if err := c.Reload(); err != nil {
+		log.Printf("Error loading cordon file: %v", err)
+	}
+
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Error creating cordon file directory %s: %v", dir, err)
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Error watching cordon file: %v", err)
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(dir); err != nil {
+		log.Printf("Error watching cordon file directory %s: %v", dir, err)
+		return
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-watcher.Events:
+			if filepath.Clean(event.Name) != filepath.Clean(c.path) {
+				continue
+			}
+			if err := c.Reload(); err != nil {
+				log.Printf("Error reloading cordon file: %v", err)
+			}
+		case err := <-watcher.Errors:
+			log.Printf("Error watching cordon file: %v", err)
+		}
+	}
+}
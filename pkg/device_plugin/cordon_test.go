@@ -0,0 +1,28 @@
+package device_plugin
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestCordon(t *testing.T) {
+	env := newHGXEnvironment(t)
+	_, client := startDevicePlugins(t, env, gpuResource)
+	ctx := testContext(t)
+	updates, _ := watchDevices(t, ctx, client)
+
+	entry := CordonEntry{IommuGroup: "21", Reason: "maintenance"}
+	if err := CordonDevice(env.Config.Admin.Socket, entry, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(t, ctx, updates, "21", pluginapi.Unhealthy)
+	expectRejected(t, ctx, client, codes.FailedPrecondition, AllocationReasonUnhealthy, "21")
+	waitForEvent(t, ctx, env, eventDeviceUnhealthy)
+
+	if err := UncordonDevice(env.Config.Admin.Socket, entry, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(t, ctx, updates, "21", pluginapi.Healthy)
+}
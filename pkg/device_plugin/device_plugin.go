@@ -2,197 +2,280 @@ package device_plugin
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/pkg/config"
 
+	v1 "k8s.io/api/core/v1"
 	klog "k8s.io/klog/v2"
-	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-const (
-	nvidiaVendorID = "10de"
-	cdiConfigPath  = "/var/run/cdi/"
-)
+const nvidiaVendorID = "10de"
+
+// CDISpecName is the name of the CDI spec file, without the suffix of its format
+const CDISpecName = "cdi-vfio-xxxx"
 
 // Structure to hold details about Nvidia GPU Device
 type NvidiaGpuDevice struct {
-	addr  string // PCI address of device
-	index uint   // PCI device index on PCI Bus
-
+	addr     string // PCI address of device
+	index    uint   // PCI device index on PCI Bus
+	vendorID string // PCI vendor ID, without 0x prefix
+	deviceID string // PCI device ID, without 0x prefix
+	class    string // PCI class code, without 0x prefix
+	numaNode int    // NUMA node of the device, -1 if unknown
+	driver   string // kernel driver bound to the device
+	serial   string // PCIe device serial number, empty if not exposed
 }
 
-// Key is iommu group id and value is a list of gpu devices part of the iommu group
-var iommuMap map[string][]NvidiaGpuDevice
-
-// Keys are the distinct Nvidia GPU device ids present on system and value is the list of all iommu group ids which are of that device id
-var deviceMap map[string][]string
-
-var basePath = "/sys/bus/pci/devices"
-var pciIdsFilePath = "/usr/pci.ids"
-var readLink = readLinkFunc
-var readIDFromFile = readIDFromFileFunc
-var startDevicePlugin = startDevicePluginFunc
-
-var stop = make(chan struct{})
-
-func InitiateDevicePlugin() {
-	//Identifies GPUs and represents it in appropriate structures
-	createIommuDeviceMap()
-
-	// Generate cdi spec for vfio devices
-	generateCDISpec(iommuMap)
-
-	//Creates and starts device plugin
-	createDevicePlugins()
+// discovery is the outcome of one walk of sysfs. It is not modified once
+// built, rediscovery replaces it as a whole.
+type discovery struct {
+	// Key is iommu group id and value is a list of gpu devices part of the iommu group
+	iommuMap map[string][]NvidiaGpuDevice
+	// Keys are the distinct Nvidia GPU device ids present on system and value is the list of all iommu group ids which are of that device id
+	deviceMap map[string][]string
+	// Key is iommu group id and value is every PCI function of the group
+	groupFunctions map[string][]PCIFunction
+	// NVIDIA functions skipped by the filters
+	filtered []FilteredDevice
+	// Devices reserved for host use, by vendor:device
+	reserved map[string]int
+	// Key is iommu group id and value the NVSwitch functions of the group, only
+	// filled in include mode where the switches are not advertised themselves
+	nvswitchMap map[string][]NvidiaGpuDevice
+	// Key is iommu group id and value the name of the fabric partition of the group
+	groupPartition map[string]string
+	// Key is the partition name
+	fabricPartitions map[string]*fabricPartition
+	// Host facts and per group facts, only collected when confidential
+	// computing is enabled in the configuration
+	ccHost    CCHost
+	ccDevices map[string]CCDevice
 }
 
-func generateCDISpec(iommuMap map[string][]NvidiaGpuDevice) {
-	cs := cdihandler.New()
-	cs.NewContainerEdits(nil)
-
-	for devName, devices := range iommuMap {
-		//devName string, annotations map[string]string, devices []*DeviceNode
-		for _, dev := range devices {
-			annotations := map[string]string{
-				"attach-pci": "true",
-			}
-			key := fmt.Sprintf("%svfio%v", cdihandler.CdiK8SPrefix, devName)
-			value := fmt.Sprintf("%s=%v", cdihandler.DefaultKind, dev.index)
-			annotations[key] = value
-			annotations["bdf"] = dev.addr
-
-			cdiDevs := []*cdihandler.DeviceNode{}
-			node := cdihandler.DeviceNode{
-				Path: fmt.Sprintf("/dev/vfio/%s", devName),
-			}
-			cdiDevs = append(cdiDevs, &node)
-			cs.NewDevice(fmt.Sprintf("%v", dev.index), annotations, cdiDevs)
-		}
+// writeCDISpec writes the CDI spec of the devices of every backend
+func (m *Manager) writeCDISpec() {
+	cs := m.buildCDISpec()
+	specDir := m.cfg.CDI.SpecDir + "/"
+	specPath := filepath.Join(specDir, CDISpecName+".yaml")
+	// The spec of the previous run tells what discovery found different
+	previous, _ := cdihandler.Load(specPath)
+	err := cs.Save(specDir, CDISpecName, "YAML")
+	if err != nil {
+		log.Printf("Error writing CDI spec: %v", err)
+		m.events.event(v1.EventTypeWarning, eventCDISpecFailed, "Could not write the CDI spec %s: %v", specPath, err)
+	} else {
+		log.Printf("Wrote %d devices to the CDI spec %s", len(cs.Devices), specPath)
+		m.events.specChanges(previous, cs)
 	}
+	m.recordCDIWrite(specPath, len(cs.Devices), err)
+}
 
-	cs.Save(cdiConfigPath, "cdi-vfio-xxxx", "YAML")
+// GenerateCDISpec runs the discovery of every backend and returns the CDI
+// spec the daemon would write, without saving it
+func (m *Manager) GenerateCDISpec() *cdihandler.CdiSpec {
+	m.backendResources()
+	return m.buildCDISpec()
 }
 
-// Starts gpu pass through device plugin
-func createDevicePlugins() {
-	var devicePlugins []*GenericDevicePlugin
-	var devs []*pluginapi.Device
-	// Iommu Map map[214:[{0000:c1:00.0}] 215:[{0000:c5:00.0}] 75:[{0000:3d:00.0}] 76:[{0000:41:00.0}]]
-	log.Printf("createDevicePlugins Iommu Map %v", iommuMap)
-	log.Printf("createDevicePlugins Device Map %v", deviceMap)
-
-	//Iterate over deivceMap to create device plugin for each type of GPU on the host
-	for k, v := range deviceMap {
-		devs = nil
-		for _, dev := range v {
-			devs = append(devs, &pluginapi.Device{
-				ID:     dev,
-				Health: pluginapi.Healthy,
-			})
-		}
-		devpluginName := getDeviceName(k)
-		if devpluginName == "" {
-			log.Printf("Error: Could not find device name for device id: %s", k)
-			devpluginName = k
-		}
-		log.Printf("Device Plugin Name %s", devpluginName)
-		dp := NewGenericDevicePlugin(devpluginName, "/dev/vfio/", devs)
-		err := startDevicePlugin(dp)
-		if err != nil {
-			log.Printf("Error starting %s device plugin: %v", dp.devpluginName, err)
-		} else {
-			devicePlugins = append(devicePlugins, dp)
-		}
+// cdiDeviceGroups returns the groups described in the CDI spec, the advertised
+// ones and the NVSwitches passed through with them
+func (d *discovery) cdiDeviceGroups() map[string][]NvidiaGpuDevice {
+	groups := make(map[string][]NvidiaGpuDevice, len(d.iommuMap)+len(d.nvswitchMap))
+	for group, devs := range d.iommuMap {
+		groups[group] = devs
+	}
+	for group, devs := range d.nvswitchMap {
+		groups[group] = devs
 	}
+	return groups
+}
+
+// DiscoveryResult is the inventory with the devices left out by the filters
+type DiscoveryResult struct {
+	Devices  []DeviceInfo     `json:"devices" yaml:"devices"`
+	Filtered []FilteredDevice `json:"filtered" yaml:"filtered"`
+	// Host holds the confidential computing facts, when enabled
+	Host *CCHost `json:"confidentialComputing,omitempty" yaml:"confidentialComputing,omitempty"`
+}
 
-	<-stop
-	log.Printf("Shutting down device plugin controller")
-	for _, v := range devicePlugins {
-		v.Stop()
+// Discover runs device discovery only, without writing the CDI spec or
+// talking to kubelet, and returns the resulting inventory
+func (m *Manager) Discover() DiscoveryResult {
+	d := m.discover()
+	filtered := append([]FilteredDevice{}, d.filtered...)
+	result := DiscoveryResult{Devices: m.inventory(d), Filtered: filtered}
+	if m.cfg.ConfidentialComputing.Enabled {
+		host := d.ccHost
+		result.Host = &host
 	}
+	return result
 }
 
-func startDevicePluginFunc(dp *GenericDevicePlugin) error {
-	return dp.Start(stop)
+// discover walks sysfs for the NVIDIA functions bound to a VFIO driver and
+// makes the outcome the current discovery
+func (m *Manager) discover() *discovery {
+	d := m.scan()
+	m.mu.Lock()
+	m.discovery = d
+	m.mu.Unlock()
+	return d
 }
 
-// Discovers all Nvidia GPUs which are loaded with VFIO-PCI driver and creates corresponding maps
-func createIommuDeviceMap() {
-	iommuMap = make(map[string][]NvidiaGpuDevice)
-	deviceMap = make(map[string][]string)
+// scan walks sysfs for the NVIDIA functions bound to a VFIO driver, the
+// current discovery is left alone
+func (m *Manager) scan() *discovery {
+	cfg := m.cfg
+	filters := cfg.Discovery.Filters
+	d := &discovery{
+		iommuMap:       make(map[string][]NvidiaGpuDevice),
+		deviceMap:      make(map[string][]string),
+		groupFunctions: make(map[string][]PCIFunction),
+		reserved:       make(map[string]int),
+		nvswitchMap:    make(map[string][]NvidiaGpuDevice),
+		ccDevices:      make(map[string]CCDevice),
+	}
+	if cfg.ConfidentialComputing.Enabled {
+		d.ccHost = m.readCCHost()
+	}
+
+	entries, err := m.sysfs.ReadDir(pciDevicesDir)
+	if err != nil {
+		log.Printf("Error accessing file path %q: %v\n", pciDevicesDir, err)
+	}
 	// pci device index on PCI bus, begin at index=0
 	busIndex := uint(0)
-	//Walk directory to discover pci devices
-	filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Printf("Error accessing file path %q: %v\n", path, err)
-			return err
-		}
-		if info.IsDir() {
-			log.Println("Not a device, continuing")
-			return nil
-		}
+	for _, entry := range entries {
+		name := entry.Name()
 		//Retrieve vendor for the device
-		vendorID, err := readIDFromFile(basePath, info.Name(), "vendor")
+		vendorID, err := m.readID(name, "vendor")
 		if err != nil {
-			log.Println("Could not get vendor ID for device ", info.Name())
-			return nil
+			log.Println("Could not get vendor ID for device ", name)
+			continue
 		}
 
 		//Nvidia vendor id is "10de". Proceed if vendor id is 10de
-		if vendorID == "10de" {
-			//Retrieve iommu group for the device
-			driver, err := readLink(basePath, info.Name(), "driver")
-			if err != nil {
-				log.Println("Could not get driver for device ", info.Name())
-				return nil
-			}
-			if driver == "vfio-pci" {
-				iommuGroup, err := readLink(basePath, info.Name(), "iommu_group")
-				if err != nil {
-					log.Println("Could not get IOMMU Group for device ", info.Name())
-					return nil
-				}
-				_, exists := iommuMap[iommuGroup]
-				if !exists {
-					deviceID, err := readIDFromFile(basePath, info.Name(), "device")
-					if err != nil {
-						log.Println("Could get deviceID for PCI address ", info.Name())
-						return nil
-					}
-					deviceMap[deviceID] = append(deviceMap[deviceID], iommuGroup)
-				}
-				iommuMap[iommuGroup] = append(iommuMap[iommuGroup], NvidiaGpuDevice{
-					addr:  info.Name(),
-					index: busIndex,
-				})
-				busIndex += 1
+		if vendorID != nvidiaVendorID {
+			continue
+		}
+		if _, vf := m.physicalFunction(name); vf && m.usesBackend(config.BackendSRIOVVF) {
+			// Advertised by the sriov-vf backend
+			continue
+		}
+		//Retrieve iommu group for the device
+		driver, err := m.readLink(name, "driver")
+		if err != nil {
+			log.Println("Could not get driver for device ", name)
+			driver = ""
+		}
+		deviceID, err := m.readID(name, "device")
+		if err != nil {
+			log.Println("Could get deviceID for PCI address ", name)
+			continue
+		}
+		class, _ := m.readID(name, "class")
+		fn := PCIFunction{BDF: name, VendorID: vendorID, DeviceID: deviceID, Class: class, Driver: driver}
+		nvswitch := cfg.Fabric.Mode != config.FabricModeOff && isNVSwitch(fn)
+		var reason string
+		if nvswitch {
+			// NVSwitches are selected by the fabric mode, not the include filters
+			reason = filterReason(fn, config.DeviceFilters{Exclude: filters.Exclude})
+		} else {
+			reason = filterReason(fn, filters)
+		}
+		if reason == "" && !m.isVFIODriver(driver) {
+			reason = "not bound to a VFIO driver"
+		}
+		if reason == "" && !nvswitch && d.reserveForHost(fn, cfg.Discovery.Reserve) {
+			reason = "reserved for host use"
+		}
+		if reason != "" {
+			log.Printf("Skipping device %s: %s", name, reason)
+			d.filtered = append(d.filtered, FilteredDevice{
+				BDF: fn.BDF, VendorID: vendorID, DeviceID: deviceID, Class: class, Driver: driver, Reason: reason,
+			})
+			continue
+		}
+		iommuGroup, err := m.readLink(name, "iommu_group")
+		if err != nil {
+			log.Println("Could not get IOMMU Group for device ", name)
+			continue
+		}
+		dev := NvidiaGpuDevice{
+			addr:     name,
+			index:    busIndex,
+			vendorID: vendorID,
+			deviceID: deviceID,
+			class:    class,
+			numaNode: m.readNumaNode(name),
+			driver:   driver,
+			serial:   m.readSerialNumber(name),
+		}
+		busIndex += 1
+		if _, exists := d.groupFunctions[iommuGroup]; !exists {
+			// Companion functions, e.g. HDMI audio or USB-C controllers
+			d.groupFunctions[iommuGroup] = m.readGroupFunctions(name)
+			if cfg.ConfidentialComputing.Enabled {
+				d.ccDevices[iommuGroup] = m.readCCDevice(name, d.ccHost, cfg.ConfidentialComputing.RequiredCapabilities)
 			}
 		}
-		return nil
-	})
+		if nvswitch && cfg.Fabric.Mode == config.FabricModeInclude {
+			// Passed through with the GPUs of its partition, not advertised
+			d.nvswitchMap[iommuGroup] = append(d.nvswitchMap[iommuGroup], dev)
+			continue
+		}
+		_, exists := d.iommuMap[iommuGroup]
+		if !exists {
+			mapKey := d.deviceMapKey(iommuGroup, deviceID)
+			d.deviceMap[mapKey] = append(d.deviceMap[mapKey], iommuGroup)
+		}
+		d.iommuMap[iommuGroup] = append(d.iommuMap[iommuGroup], dev)
+	}
+
+	d.buildFabricPartitions(cfg.Fabric)
+	return d
 }
 
 // Read a file to retrieve ID
-func readIDFromFileFunc(basePath string, deviceAddress string, property string) (string, error) {
-	data, err := os.ReadFile(filepath.Join(basePath, deviceAddress, property))
+func (m *Manager) readID(deviceAddress string, property string) (string, error) {
+	data, err := m.sysfs.ReadFile(devicePath(deviceAddress, property))
 	if err != nil {
 		klog.Errorf("Could not read %s for device %s: %s", property, deviceAddress, err)
 		return "", err
 	}
-	id := strings.Trim(string(data[2:]), "\n")
+	// IDs are hex with a 0x prefix, e.g. 0x10de
+	id, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "0x")
+	if !ok || id == "" {
+		return "", fmt.Errorf("invalid %s %q of device %s", property, strings.TrimSpace(string(data)), deviceAddress)
+	}
 	return id, nil
 }
 
+// Read the NUMA node of a device, -1 if the platform does not report one
+func (m *Manager) readNumaNode(deviceAddress string) int {
+	data, err := readAttribute(m.sysfs, deviceAddress, "numa_node")
+	if err != nil {
+		return -1
+	}
+	node, err := strconv.Atoi(data)
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
 // Read a file link
-func readLinkFunc(basePath string, deviceAddress string, link string) (string, error) {
-	path, err := os.Readlink(filepath.Join(basePath, deviceAddress, link))
+func (m *Manager) readLink(deviceAddress string, link string) (string, error) {
+	path, err := m.sysfs.ReadLink(devicePath(deviceAddress, link))
 	if err != nil {
 		klog.Errorf("Could not read link %s for device %s: %s", link, deviceAddress, err)
 		return "", err
@@ -201,21 +284,56 @@ func readLinkFunc(basePath string, deviceAddress string, link string) (string, e
 	return file, nil
 }
 
-func getIommuMap() map[string][]NvidiaGpuDevice {
-	return iommuMap
+// pluginNameForDevice names the device plugin, and so the resource, of a
+// device ID after its pci.ids name, falling back to the ID itself
+func (m *Manager) pluginNameForDevice(deviceID string) string {
+	name := m.deviceName(deviceID)
+	if name == "" {
+		log.Printf("Error: Could not find device name for device id: %s", deviceID)
+		return deviceID
+	}
+	return name
 }
 
-func getDeviceName(deviceID string) string {
-	devpluginName := ""
-	file, err := os.Open(pciIdsFilePath)
+// deviceMapKey returns the deviceMap key of a group: its device ID, with a
+// suffix when it is advertised as a CC-capable resource
+func (d *discovery) deviceMapKey(iommuGroup string, deviceID string) string {
+	if d.ccDevices[iommuGroup].Capable {
+		return deviceID + ccDeviceKeySuffix
+	}
+	return deviceID
+}
+
+// pluginNameForKey names the device plugin of a deviceMap key
+func (m *Manager) pluginNameForKey(key string) string {
+	deviceID := strings.TrimSuffix(key, ccDeviceKeySuffix)
+	name := m.pluginNameForDevice(deviceID)
+	if deviceID != key {
+		name += m.cfg.ConfidentialComputing.ResourceSuffix
+	}
+	return name
+}
+
+// deviceName looks the device ID up in the pci.ids database of the
+// manager, the configured file unless one was given in the options
+func (m *Manager) deviceName(deviceID string) string {
+	if m.pciIds != nil {
+		return getDeviceName(bytes.NewReader(m.pciIds), deviceID)
+	}
+	file, err := os.Open(m.cfg.Discovery.PciIdsPath)
 	if err != nil {
-		log.Printf("Error opening pci ids file %s", pciIdsFilePath)
+		log.Printf("Error opening pci ids file %s", m.cfg.Discovery.PciIdsPath)
 		return ""
 	}
 	defer file.Close()
+	return getDeviceName(file, deviceID)
+}
+
+func getDeviceName(pciIds io.Reader, deviceID string) string {
+	devpluginName := ""
 
 	// Locate beginning of NVIDIA device list in pci.ids file
-	scanner, err := locateVendor(file, nvidiaVendorID)
+	scanner, err := locateVendor(pciIds, nvidiaVendorID)
 	if err != nil {
 		log.Printf("Error locating NVIDIA in pci.ds file: %v", err)
 		return ""
@@ -258,7 +376,7 @@ func getDeviceName(deviceID string) string {
 	return devpluginName
 }
 
-func locateVendor(pciIdsFile *os.File, vendorID string) (*bufio.Scanner, error) {
+func locateVendor(pciIdsFile io.Reader, vendorID string) (*bufio.Scanner, error) {
 	scanner := bufio.NewScanner(pciIdsFile)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -0,0 +1,60 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+)
+
+func TestDiscover(t *testing.T) {
+	env := newHGXEnvironment(t)
+	result := NewManager(env.Config, Options{}).Discover()
+	if len(result.Devices) != 4 {
+		t.Fatalf("expected 4 GPUs, discovered %d", len(result.Devices))
+	}
+	// The audio companions are filtered by class but still listed in the groups
+	if len(result.Filtered) != 4 || len(result.Devices[0].GroupMembers) != 2 {
+		t.Fatalf("expected 4 filtered audio functions, got %d", len(result.Filtered))
+	}
+}
+
+func TestReadID(t *testing.T) {
+	env := newEnvironment(t)
+	if err := env.AddHGXBoard(0x18, 10, 0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(env.Config, Options{})
+	if id, err := m.readID("0000:18:00.0", "vendor"); err != nil || id != "10de" {
+		t.Fatalf("expected vendor 10de, got %q, %v", id, err)
+	}
+
+	// A truncated attribute is an error, and its device is skipped
+	vendor := filepath.Join(env.Sysfs.Root, pciDevicesDir, "0000:19:00.0", "vendor")
+	for _, content := range []string{"", "0", "0x", "10de\n"} {
+		if err := os.WriteFile(vendor, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if id, err := m.readID("0000:19:00.0", "vendor"); err == nil {
+			t.Fatalf("expected an error for vendor %q, got %q", content, id)
+		}
+		if n := len(m.Discover().Devices); n != 1 {
+			t.Fatalf("expected the GPU with vendor %q skipped, discovered %d", content, n)
+		}
+	}
+}
+
+func TestCDISpec(t *testing.T) {
+	env := newHGXEnvironment(t)
+	startDevicePlugins(t, env, gpuResource)
+
+	spec, err := cdihandler.Load(cdiSpecPath(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 GPUs and the NVSwitch passed through with them
+	if len(spec.Devices) != 5 {
+		t.Fatalf("expected 5 CDI devices, got %d", len(spec.Devices))
+	}
+}
@@ -0,0 +1,227 @@
+package device_plugin
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"strings"
+	"time"
+
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+const resetPollInterval = 100 * time.Millisecond
+
+// resetIommuGroup makes sure that every endpoint function of the IOMMU
+// group is idle, resets it and verifies that it came back as the same
+// device. A group already opened by a VMM or used by a host driver fails
+// the reset.
+func (m *Manager) resetIommuGroup(iommuGroup string, cfg config.PreStartConfig) error {
+	devs, ok := m.current().iommuMap[iommuGroup]
+	if !ok || len(devs) == 0 {
+		return fmt.Errorf("unknown IOMMU group %s", iommuGroup)
+	}
+	return m.resetGroupOf(iommuGroup, devs[0].addr, cfg)
+}
+
+// resetGroupOf resets the IOMMU group of the function at deviceAddress, for
+// backends whose devices are not in the discovered groups, e.g. SR-IOV VFs
+func (m *Manager) resetGroupOf(iommuGroup string, deviceAddress string, cfg config.PreStartConfig) error {
+	members, err := m.iommuGroupMembers(deviceAddress)
+	if err != nil {
+		return fmt.Errorf("failed to list functions of IOMMU group %s: %v", iommuGroup, err)
+	}
+
+	// Only sysfs is looked at: opening the VFIO group to probe it would
+	// race with the VMM opening it. A VMM enables the functions it opened,
+	// e.g. when Kata cold-plugged them into the sandbox before the
+	// container starts, resetting them would pull them from under the VM.
+	endpoints := m.endpointFunctions(members)
+	for _, addr := range endpoints {
+		if err := m.checkFunctionIdle(addr); err != nil {
+			return fmt.Errorf("IOMMU group %s is in use, not resetting it: %v", iommuGroup, err)
+		}
+	}
+
+	for _, addr := range endpoints {
+		if err := m.resetFunction(addr, cfg.ResetMethods, cfg.Timeout); err != nil {
+			return fmt.Errorf("IOMMU group %s: %v", iommuGroup, err)
+		}
+	}
+
+	return nil
+}
+
+// iommuGroupMembers lists the PCI addresses of all the functions sharing
+// the IOMMU group of the given device
+func (m *Manager) iommuGroupMembers(deviceAddress string) ([]string, error) {
+	entries, err := m.sysfs.ReadDir(devicePath(deviceAddress, "iommu_group", "devices"))
+	if err != nil {
+		return nil, err
+	}
+
+	members := []string{}
+	for _, entry := range entries {
+		members = append(members, entry.Name())
+	}
+	return members, nil
+}
+
+// pciClassBridge is the class of PCI-to-PCI bridges, e.g. the switch ports
+// sharing the IOMMU group of the GPU behind them
+const pciClassBridge = "0604"
+
+// endpointFunctions leaves the bridges out of the members of a group. The
+// port driver keeps a bridge enabled while the endpoints below it are idle,
+// and resetting it would reset every function behind it.
+func (m *Manager) endpointFunctions(members []string) []string {
+	endpoints := []string{}
+	for _, addr := range members {
+		class, err := m.readID(addr, "class")
+		if err == nil && strings.HasPrefix(class, pciClassBridge) {
+			continue
+		}
+		endpoints = append(endpoints, addr)
+	}
+	return endpoints
+}
+
+// checkFunctionIdle fails if the function is bound to a host driver, or
+// enabled, i.e. a driver or a VFIO user still has it in use. Unbound
+// functions are idle.
+func (m *Manager) checkFunctionIdle(deviceAddress string) error {
+	if driver, err := m.readLink(deviceAddress, "driver"); err == nil && !m.isVFIODriver(driver) {
+		return fmt.Errorf("device %s is bound to the host driver %s", deviceAddress, driver)
+	}
+	enabled, err := m.functionEnableCount(deviceAddress)
+	if err != nil {
+		return err
+	}
+	if enabled != "0" {
+		return fmt.Errorf("device %s is not idle (enable count %s)", deviceAddress, enabled)
+	}
+	return nil
+}
+
+func (m *Manager) functionEnableCount(deviceAddress string) (string, error) {
+	enabled, err := readAttribute(m.sysfs, deviceAddress, "enable")
+	if err != nil {
+		return "", fmt.Errorf("failed to read enable state of device %s: %v", deviceAddress, err)
+	}
+	return enabled, nil
+}
+
+// iommuGroupInUse reports whether any endpoint function of the IOMMU group
+// is enabled, which for a VFIO device means a VMM has opened it. Unlike
+// probing the VFIO group it never races with a VMM opening the group.
+func (m *Manager) iommuGroupInUse(iommuGroup string) (bool, error) {
+	devs, ok := m.current().iommuMap[iommuGroup]
+	if !ok || len(devs) == 0 {
+		return false, fmt.Errorf("unknown IOMMU group %s", iommuGroup)
+	}
+	return m.groupOfInUse(devs[0].addr)
+}
+
+// groupOfInUse reports whether any endpoint function of the IOMMU group of
+// the function at deviceAddress is enabled
+func (m *Manager) groupOfInUse(deviceAddress string) (bool, error) {
+	members, err := m.iommuGroupMembers(deviceAddress)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range m.endpointFunctions(members) {
+		enabled, err := m.functionEnableCount(addr)
+		if err != nil {
+			return false, err
+		}
+		if enabled != "0" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// resetFunction resets a single PCI function through sysfs using the first
+// of the given methods supported by the device, and waits until the function
+// reports its original vendor and device IDs again.
+func (m *Manager) resetFunction(deviceAddress string, methods []string, timeout time.Duration) error {
+	vendorID, err := m.readID(deviceAddress, "vendor")
+	if err != nil {
+		return fmt.Errorf("failed to read vendor ID of device %s: %v", deviceAddress, err)
+	}
+	deviceID, err := m.readID(deviceAddress, "device")
+	if err != nil {
+		return fmt.Errorf("failed to read device ID of device %s: %v", deviceAddress, err)
+	}
+
+	resetPath := devicePath(deviceAddress, "reset")
+	if _, err := m.sysfs.Stat(resetPath); err != nil {
+		return fmt.Errorf("device %s does not support reset: %v", deviceAddress, err)
+	}
+
+	restore, err := m.selectResetMethod(deviceAddress, methods)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	log.Printf("Resetting device %s (%s:%s)", deviceAddress, vendorID, deviceID)
+	if err := m.sysfs.WriteFile(resetPath, []byte("1")); err != nil {
+		return fmt.Errorf("failed to reset device %s: %v", deviceAddress, err)
+	}
+
+	deadline := m.clock.Now().Add(timeout)
+	for {
+		vendor, verr := m.readID(deviceAddress, "vendor")
+		device, derr := m.readID(deviceAddress, "device")
+		if verr == nil && derr == nil && vendor == vendorID && device == deviceID {
+			return nil
+		}
+		if m.clock.Now().After(deadline) {
+			return fmt.Errorf("device %s did not come back after reset: expected %s:%s, got %s:%s",
+				deviceAddress, vendorID, deviceID, vendor, device)
+		}
+		m.clock.Sleep(resetPollInterval)
+	}
+}
+
+// selectResetMethod restricts the reset methods of the device to the first
+// preferred one it supports. The returned function restores the original
+// setting. Kernels without reset_method support keep their default reset.
+func (m *Manager) selectResetMethod(deviceAddress string, methods []string) (func(), error) {
+	noop := func() {}
+	methodPath := devicePath(deviceAddress, "reset_method")
+
+	data, err := m.sysfs.ReadFile(methodPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return noop, nil
+		}
+		return noop, fmt.Errorf("failed to read reset methods of device %s: %v", deviceAddress, err)
+	}
+	if len(methods) == 0 {
+		return noop, nil
+	}
+
+	original := strings.TrimSpace(string(data))
+	supported := strings.Fields(original)
+	for _, method := range methods {
+		for _, s := range supported {
+			if method != s {
+				continue
+			}
+			if err := m.sysfs.WriteFile(methodPath, []byte(method)); err != nil {
+				return noop, fmt.Errorf("failed to select reset method %s for device %s: %v", method, deviceAddress, err)
+			}
+			return func() {
+				if err := m.sysfs.WriteFile(methodPath, []byte(original)); err != nil {
+					log.Printf("Error restoring reset methods of device %s: %v", deviceAddress, err)
+				}
+			}, nil
+		}
+	}
+
+	return noop, fmt.Errorf("device %s supports none of the reset methods %v (supported: %s)",
+		deviceAddress, methods, original)
+}
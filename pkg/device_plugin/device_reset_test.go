@@ -0,0 +1,191 @@
+package device_plugin
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	testingclock "k8s.io/utils/clock/testing"
+
+	"kata-xpu-device-plugin/internal/harness"
+)
+
+// resettingSysFS is a sysfs tree whose functions read as absent for a
+// number of reads of their IDs after a reset, like a GPU going through FLR
+type resettingSysFS struct {
+	SysFS
+	absentReads int
+	pending     map[string]int
+	// resets records bdf=reset_method at the time of every reset
+	resets []string
+}
+
+func (s *resettingSysFS) WriteFile(name string, data []byte) error {
+	if path.Base(name) == "reset" {
+		bdf := path.Base(path.Dir(name))
+		method, _ := readAttribute(s.SysFS, bdf, "reset_method")
+		s.resets = append(s.resets, bdf+"="+method)
+		s.pending[bdf] = s.absentReads
+	}
+	return s.SysFS.WriteFile(name, data)
+}
+
+func (s *resettingSysFS) ReadFile(name string) ([]byte, error) {
+	bdf := path.Base(path.Dir(name))
+	if base := path.Base(name); (base == "vendor" || base == "device") && s.pending[bdf] > 0 {
+		s.pending[bdf]--
+		return []byte("0xffff\n"), nil
+	}
+	return s.SysFS.ReadFile(name)
+}
+
+// newResetEnvironment has a GPU and its audio function in IOMMU group 10
+// behind an enabled switch port of the same group. The GPU supports the
+// flr and bus reset methods, the audio function only the default reset.
+func newResetEnvironment(t *testing.T, absentReads int) (*harness.Environment, *Manager, *resettingSysFS, *testingclock.FakeClock) {
+	t.Helper()
+	env := newEnvironment(t)
+	if err := env.AddHGXBoard(0x18, 10, 0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	bridge := harness.PCIDevice{BDF: "0000:17:00.0", Vendor: "10b5", Device: "c010", Class: "060400", Driver: "pcieport", IommuGroup: 10}
+	if err := env.Sysfs.AddDevice(bridge); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Sysfs.SetEnabled(bridge.BDF, 1); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"0000:18:00.0/reset":        "",
+		"0000:18:00.0/reset_method": "flr bus\n",
+		"0000:18:00.1/reset":        "",
+	} {
+		if err := os.WriteFile(filepath.Join(env.Sysfs.Root, pciDevicesDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sysfs := &resettingSysFS{SysFS: DirSysFS(env.Sysfs.Root), absentReads: absentReads, pending: map[string]int{}}
+	clk := testingclock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	env.Config.PreStart.ResetMethods = []string{"bus", "flr"}
+	m := NewManager(env.Config, Options{Sysfs: sysfs, Clock: clk})
+	m.discover()
+	return env, m, sysfs, clk
+}
+
+func TestResetIommuGroup(t *testing.T) {
+	env, m, sysfs, clk := newResetEnvironment(t, 4)
+	start := clk.Now()
+
+	if err := m.resetIommuGroup("10", env.Config.PreStart); err != nil {
+		t.Fatal(err)
+	}
+	// The bridge is neither required idle nor reset
+	expected := []string{"0000:18:00.0=bus", "0000:18:00.1="}
+	if !reflect.DeepEqual(sysfs.resets, expected) {
+		t.Fatalf("expected resets %v, got %v", expected, sysfs.resets)
+	}
+	if method, _ := readAttribute(sysfs, "0000:18:00.0", "reset_method"); method != "flr bus" {
+		t.Fatalf("expected the reset methods restored to \"flr bus\", got %q", method)
+	}
+	// Each function read as absent twice, once for every poll
+	if waited := clk.Since(start); waited != 4*resetPollInterval {
+		t.Fatalf("expected 4 polls of %v, waited %v", resetPollInterval, waited)
+	}
+	if inUse, err := m.iommuGroupInUse("10"); err != nil || inUse {
+		t.Fatalf("expected the group with an enabled bridge not in use, got %v, %v", inUse, err)
+	}
+
+	if err := env.Sysfs.SetEnabled("0000:18:00.1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.resetIommuGroup("10", env.Config.PreStart); err == nil || !strings.Contains(err.Error(), "0000:18:00.1 is not idle") {
+		t.Fatalf("expected the enabled audio function to fail the reset, got %v", err)
+	}
+	if inUse, err := m.iommuGroupInUse("10"); err != nil || !inUse {
+		t.Fatalf("expected the group with an enabled endpoint in use, got %v, %v", inUse, err)
+	}
+
+	// A function bound to a host driver fails the reset even while disabled
+	if err := env.Sysfs.SetEnabled("0000:18:00.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Sysfs.SetDriver("0000:18:00.1", "snd_hda_intel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.resetIommuGroup("10", env.Config.PreStart); err == nil || !strings.Contains(err.Error(), "bound to the host driver snd_hda_intel") {
+		t.Fatalf("expected the audio function bound to the host to fail the reset, got %v", err)
+	}
+	if len(sysfs.resets) != 2 {
+		t.Fatalf("expected no reset of a group in use, got %v", sysfs.resets)
+	}
+}
+
+// TestPreStartGroupInUse checks that the start of a container fails when its
+// group is already opened, e.g. by the VMM of a cold-plugged Kata sandbox
+func TestPreStartGroupInUse(t *testing.T) {
+	env := newHGXEnvironment(t)
+	env.Config.PreStart.ResetDevices = true
+	if err := env.Sysfs.SetEnabled("0000:18:00.0", 1); err != nil {
+		t.Fatal(err)
+	}
+	_, client := startDevicePlugins(t, env, gpuResource)
+
+	err := client.PreStartContainer(testContext(t), "10")
+	if err == nil || !strings.Contains(err.Error(), "IOMMU group 10 is in use, not resetting it: device 0000:18:00.0 is not idle (enable count 1)") {
+		t.Fatalf("expected the start to fail on the opened group, got %v", err)
+	}
+}
+
+func TestResetTimeout(t *testing.T) {
+	env, m, sysfs, clk := newResetEnvironment(t, 1000)
+	start := clk.Now()
+
+	err := m.resetFunction("0000:18:00.0", env.Config.PreStart.ResetMethods, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "did not come back after reset: expected 10de:2330, got ffff:ffff") {
+		t.Fatalf("expected the device to time out, got %v", err)
+	}
+	if waited := clk.Since(start); waited <= time.Second || waited > time.Second+resetPollInterval {
+		t.Fatalf("expected to give up after the 1s timeout, waited %v", waited)
+	}
+	// The reset methods are restored on failure too
+	if method, _ := readAttribute(sysfs, "0000:18:00.0", "reset_method"); method != "flr bus" {
+		t.Fatalf("expected the reset methods restored to \"flr bus\", got %q", method)
+	}
+}
+
+func TestSelectResetMethod(t *testing.T) {
+	_, m, sysfs, _ := newResetEnvironment(t, 0)
+	const gpu = "0000:18:00.0"
+
+	restore, err := m.selectResetMethod(gpu, []string{"pm", "flr", "bus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method, _ := readAttribute(sysfs, gpu, "reset_method"); method != "flr" {
+		t.Fatalf("expected the first supported preferred method flr, got %q", method)
+	}
+	restore()
+	if method, _ := readAttribute(sysfs, gpu, "reset_method"); method != "flr bus" {
+		t.Fatalf("expected the reset methods restored to \"flr bus\", got %q", method)
+	}
+
+	if _, err := m.selectResetMethod(gpu, []string{"pm"}); err == nil || !strings.Contains(err.Error(), "supports none of the reset methods [pm]") {
+		t.Fatalf("expected no supported method, got %v", err)
+	}
+	// Without a preference, or without reset_method, the kernel default is kept
+	for bdf, methods := range map[string][]string{gpu: nil, "0000:18:00.1": {"bus"}} {
+		restore, err := m.selectResetMethod(bdf, methods)
+		if err != nil {
+			t.Fatalf("%s: %v", bdf, err)
+		}
+		restore()
+	}
+	if method, _ := readAttribute(sysfs, gpu, "reset_method"); method != "flr bus" {
+		t.Fatalf("expected the reset methods untouched, got %q", method)
+	}
+}
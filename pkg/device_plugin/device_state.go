@@ -0,0 +1,181 @@
+package device_plugin
+
+import (
+	"sync"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Sources of unhealthy reasons tracked per device
+const (
+	healthSourceDeviceNode = "device-node"
+	healthSourceLedger     = "ledger"
+	healthSourceCordon     = "cordon"
+	healthSourceSimulated  = "simulated"
+)
+
+// deviceState is the thread-safe store of the devices advertised by a
+// GenericDevicePlugin. Every ListAndWatch stream subscribes to it and is
+// sent the complete device list whenever a device changes.
+//
+// A device is unhealthy as long as at least one source reports a reason
+// for it, so independent checks never overwrite each other.
+type deviceState struct {
+	mu          sync.RWMutex
+	devs        []*pluginapi.Device
+	reasons     map[string]map[string]string // device ID -> source -> reason
+	subscribers map[int]chan []*pluginapi.Device
+	nextID      int
+	// onHealthChange is called with the new health and reasons of a device
+	// whenever its health changes, with the store locked
+	onHealthChange func(id string, health string, reasons map[string]string)
+}
+
+func newDeviceState(devices []*pluginapi.Device) *deviceState {
+	s := &deviceState{
+		devs:        copyDevices(devices),
+		reasons:     make(map[string]map[string]string),
+		subscribers: make(map[int]chan []*pluginapi.Device),
+	}
+	for _, dev := range s.devs {
+		s.reasons[dev.ID] = make(map[string]string)
+		dev.Health = pluginapi.Healthy
+	}
+	return s
+}
+
+// List returns a copy of the current device list
+func (s *deviceState) List() []*pluginapi.Device {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyDevices(s.devs)
+}
+
+// SetUnhealthy records why the given source considers the device unhealthy.
+// It returns true if the health of the device changed.
+func (s *deviceState) SetUnhealthy(id string, source string, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reasons, ok := s.reasons[id]
+	if !ok {
+		return false
+	}
+	reasons[source] = reason
+	return s.updateHealthLocked(id)
+}
+
+// ClearUnhealthy drops the reason recorded by the given source for the device.
+// It returns true if the health of the device changed.
+func (s *deviceState) ClearUnhealthy(id string, source string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reasons, ok := s.reasons[id]
+	if !ok {
+		return false
+	}
+	delete(reasons, source)
+	return s.updateHealthLocked(id)
+}
+
+// Has reports whether the device is advertised
+func (s *deviceState) Has(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.reasons[id]
+	return ok
+}
+
+// Reasons returns a copy of the unhealthy reasons of the device, by source
+func (s *deviceState) Reasons(id string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reasons := make(map[string]string, len(s.reasons[id]))
+	for source, reason := range s.reasons[id] {
+		reasons[source] = reason
+	}
+	return reasons
+}
+
+// updateHealthLocked derives the health of the device from its reasons and
+// notifies all subscribers if it changed
+func (s *deviceState) updateHealthLocked(id string) bool {
+	health := pluginapi.Healthy
+	if len(s.reasons[id]) > 0 {
+		health = pluginapi.Unhealthy
+	}
+
+	changed := false
+	for _, dev := range s.devs {
+		if dev.ID == id && dev.Health != health {
+			dev.Health = health
+			changed = true
+		}
+	}
+	if changed {
+		s.broadcastLocked()
+		if s.onHealthChange != nil {
+			reasons := make(map[string]string, len(s.reasons[id]))
+			for source, reason := range s.reasons[id] {
+				reasons[source] = reason
+			}
+			s.onHealthChange(id, health, reasons)
+		}
+	}
+	return changed
+}
+
+// Subscribe registers a new watcher. The returned channel immediately holds
+// the current device list and afterwards always holds the latest one, so a
+// slow reader only ever skips stale intermediate lists.
+func (s *deviceState) Subscribe() (int, <-chan []*pluginapi.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.nextID
+	s.nextID++
+	ch := make(chan []*pluginapi.Device, 1)
+	ch <- copyDevices(s.devs)
+	s.subscribers[id] = ch
+	return id, ch
+}
+
+// Unsubscribe removes the watcher with the given ID
+func (s *deviceState) Unsubscribe(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, id)
+}
+
+// Subscribers returns the number of active watchers
+func (s *deviceState) Subscribers() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.subscribers)
+}
+
+// broadcastLocked replaces any pending list of every subscriber with the
+// current one. It never blocks since s.mu is held and only the store sends.
+func (s *deviceState) broadcastLocked() {
+	for _, ch := range s.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- copyDevices(s.devs)
+	}
+}
+
+func copyDevices(devices []*pluginapi.Device) []*pluginapi.Device {
+	devs := make([]*pluginapi.Device, 0, len(devices))
+	for _, dev := range devices {
+		devs = append(devs, &pluginapi.Device{
+			ID:       dev.ID,
+			Health:   dev.Health,
+			Topology: dev.Topology,
+		})
+	}
+	return devs
+}
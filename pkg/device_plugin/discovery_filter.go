@@ -0,0 +1,86 @@
+package device_plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// FilteredDevice is an NVIDIA function discovery did not advertise
+type FilteredDevice struct {
+	BDF      string `json:"bdf" yaml:"bdf"`
+	VendorID string `json:"vendorID" yaml:"vendorID"`
+	DeviceID string `json:"deviceID" yaml:"deviceID"`
+	Class    string `json:"class" yaml:"class"`
+	Driver   string `json:"driver" yaml:"driver"`
+	Reason   string `json:"reason" yaml:"reason"`
+}
+
+// reserveForHost reports whether fn is among the first devices of its model
+// reserve keeps for the host, and counts it if so
+func (d *discovery) reserveForHost(fn PCIFunction, reserve map[string]int) bool {
+	key := fn.VendorID + ":" + fn.DeviceID
+	limit := 0
+	for device, count := range reserve {
+		if strings.EqualFold(device, key) {
+			limit = count
+		}
+	}
+	if d.reserved[key] >= limit {
+		return false
+	}
+	d.reserved[key]++
+	return true
+}
+
+// filterReason tells why fn is not advertised, empty if it passes the filters
+func filterReason(fn PCIFunction, filters config.DeviceFilters) string {
+	include := filters.Include
+	if len(include.Classes) > 0 && !classMatches(fn.Class, include.Classes) {
+		return fmt.Sprintf("class %s not in included classes %s", fn.Class, strings.Join(include.Classes, ","))
+	}
+	if len(include.Devices) > 0 && !deviceMatches(fn, include.Devices) {
+		return fmt.Sprintf("device %s:%s not in included devices %s", fn.VendorID, fn.DeviceID, strings.Join(include.Devices, ","))
+	}
+	if len(include.BDFs) > 0 && !bdfMatches(fn.BDF, include.BDFs) {
+		return fmt.Sprintf("bdf %s not in included bdfs", fn.BDF)
+	}
+
+	exclude := filters.Exclude
+	if classMatches(fn.Class, exclude.Classes) {
+		return fmt.Sprintf("class %s excluded", fn.Class)
+	}
+	if deviceMatches(fn, exclude.Devices) {
+		return fmt.Sprintf("device %s:%s excluded", fn.VendorID, fn.DeviceID)
+	}
+	if bdfMatches(fn.BDF, exclude.BDFs) {
+		return fmt.Sprintf("bdf %s excluded", fn.BDF)
+	}
+	return ""
+}
+
+// deviceMatches reports whether fn matches one of the vendor:device patterns
+func deviceMatches(fn PCIFunction, patterns []string) bool {
+	for _, pattern := range patterns {
+		vendor, device, _ := strings.Cut(strings.ToLower(pattern), ":")
+		if (vendor == "*" || vendor == fn.VendorID) && (device == "*" || device == fn.DeviceID) {
+			return true
+		}
+	}
+	return false
+}
+
+// bdfMatches compares PCI addresses, the domain may be omitted
+func bdfMatches(bdf string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.Count(pattern, ":") == 1 {
+			pattern = "0000:" + pattern
+		}
+		if pattern == bdf {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,398 @@
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	resourceapi "k8s.io/api/resource/v1alpha2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+const (
+	draSocketName = "dra.sock"
+	// draInstancePrefix prefixes the IOMMU group in named resource instances
+	draInstancePrefix = "iommu-group-"
+)
+
+// DRAPlugin serves the discovered IOMMU groups through the Dynamic Resource
+// Allocation kubelet plugin API. Each IOMMU group is a named resource
+// instance; preparing a claim returns the CDI devices of its groups, and in
+// fabric include mode of the NVSwitches of their partitions. Only the vfio
+// backend is served, config.Load rejects the others with this frontend.
+type DRAPlugin struct {
+	m            *Manager
+	driverName   string
+	nodeName     string
+	pluginSocket string
+	registrar    *registrationServer
+	server       *grpc.Server
+
+	// client looks the claims up and publishes the ResourceSlices
+	client kubernetes.Interface
+	// publish makes the plugin write the ResourceSlices instead of kubelet
+	publish bool
+
+	mu       sync.Mutex          // never held across API calls
+	prepared map[string][]string // claim UID -> CDI devices
+}
+
+// NewDRAPlugin returns a DRA kubelet plugin for the driver. The client looks
+// up the claims to prepare. With publish the plugin writes its ResourceSlices
+// itself, otherwise it reports the resources to kubelet which publishes them.
+func (m *Manager) NewDRAPlugin(driverName, nodeName, pluginDir, registryDir string, client kubernetes.Interface, publish bool) *DRAPlugin {
+	pluginSocket := filepath.Join(pluginDir, driverName, draSocketName)
+	return &DRAPlugin{
+		m:            m,
+		driverName:   driverName,
+		nodeName:     nodeName,
+		pluginSocket: pluginSocket,
+		client:       client,
+		publish:      publish,
+		prepared:     make(map[string][]string),
+		registrar: newRegistrationServer(
+			filepath.Join(registryDir, driverName+"-reg.sock"),
+			registerapi.PluginInfo{
+				Type:              registerapi.DRAPlugin,
+				Name:              driverName,
+				Endpoint:          pluginSocket,
+				SupportedVersions: []string{"1.0.0"},
+			}),
+	}
+}
+
+// Start serves the DRA node service, publishes the ResourceSlices if
+// requested and finally announces the plugin to kubelet
+func (p *DRAPlugin) Start(ctx context.Context) error {
+	if p.server != nil {
+		return fmt.Errorf("gRPC server already started")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.pluginSocket), 0750); err != nil {
+		return err
+	}
+	if err := os.Remove(p.pluginSocket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sock, err := net.Listen("unix", p.pluginSocket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", p.pluginSocket, err)
+	}
+
+	p.server = grpc.NewServer()
+	drapb.RegisterNodeServer(p.server, p)
+	go p.server.Serve(sock)
+
+	if p.publish {
+		if err := p.PublishResourceSlices(ctx); err != nil {
+			p.Stop(ctx)
+			return err
+		}
+	}
+
+	if err := p.registrar.Start(); err != nil {
+		p.Stop(ctx)
+		return err
+	}
+
+	log.Printf("[%s] DRA plugin server ready", p.driverName)
+	return nil
+}
+
+// Stop unregisters from kubelet, stops serving and withdraws the ResourceSlices
+func (p *DRAPlugin) Stop(ctx context.Context) {
+	p.registrar.Stop()
+	if p.server != nil {
+		p.server.Stop()
+		p.server = nil
+	}
+	if err := os.Remove(p.pluginSocket); err != nil && !os.IsNotExist(err) {
+		log.Printf("[%s] Error removing plugin socket: %v", p.driverName, err)
+	}
+	if p.publish {
+		if err := p.DeleteResourceSlices(ctx); err != nil {
+			log.Printf("[%s] Error deleting ResourceSlices: %v", p.driverName, err)
+		}
+	}
+}
+
+// NodePrepareResources returns the CDI devices of the IOMMU groups allocated to each claim
+func (p *DRAPlugin) NodePrepareResources(ctx context.Context, req *drapb.NodePrepareResourcesRequest) (*drapb.NodePrepareResourcesResponse, error) {
+	resp := &drapb.NodePrepareResourcesResponse{Claims: map[string]*drapb.NodePrepareResourceResponse{}}
+
+	for _, claim := range req.Claims {
+		devices, err := p.prepareClaim(ctx, claim)
+		if err != nil {
+			log.Printf("[%s] Error preparing claim %s/%s: %v", p.driverName, claim.Namespace, claim.Name, err)
+			resp.Claims[claim.Uid] = &drapb.NodePrepareResourceResponse{Error: err.Error()}
+			continue
+		}
+		resp.Claims[claim.Uid] = &drapb.NodePrepareResourceResponse{CDIDevices: devices}
+	}
+	return resp, nil
+}
+
+// prepareClaim returns the CDI devices of a claim. The claim is looked up
+// without holding the lock, preparing it twice concurrently yields the same
+// devices.
+func (p *DRAPlugin) prepareClaim(ctx context.Context, claim *drapb.Claim) ([]string, error) {
+	p.mu.Lock()
+	devices, ok := p.prepared[claim.Uid]
+	p.mu.Unlock()
+	if ok {
+		return devices, nil
+	}
+	if len(claim.StructuredResourceHandle) == 0 {
+		return nil, fmt.Errorf("claim has no structured resource handle")
+	}
+	if err := p.checkClaimDriver(ctx, claim); err != nil {
+		return nil, err
+	}
+
+	d := p.m.current()
+	groups := []string{}
+	for _, handle := range claim.StructuredResourceHandle {
+		if handle.NodeName != "" && handle.NodeName != p.nodeName {
+			return nil, fmt.Errorf("claim is allocated on node %s", handle.NodeName)
+		}
+		for _, result := range handle.Results {
+			if result.NamedResources == nil {
+				continue
+			}
+			group, ok := iommuGroupFromInstance(result.NamedResources.Name)
+			if !ok {
+				return nil, fmt.Errorf("unknown instance %s", result.NamedResources.Name)
+			}
+			if _, ok := d.iommuMap[group]; !ok {
+				return nil, fmt.Errorf("IOMMU group %s of instance %s is not present", group, result.NamedResources.Name)
+			}
+			groups = append(groups, group)
+		}
+	}
+
+	// Several results may name the same group, or share the NVSwitches of a
+	// partition
+	seen := map[string]bool{}
+	devices = []string{}
+	for _, name := range p.m.groupCDIDevices(d, groups) {
+		if !seen[name] {
+			seen[name] = true
+			devices = append(devices, name)
+		}
+	}
+	sort.Strings(devices)
+
+	p.mu.Lock()
+	p.prepared[claim.Uid] = devices
+	p.mu.Unlock()
+	return devices, nil
+}
+
+// checkClaimDriver looks the claim up and checks that it is allocated by
+// this driver, the driver is not part of the claim kubelet hands over
+func (p *DRAPlugin) checkClaimDriver(ctx context.Context, claim *drapb.Claim) error {
+	rc, err := p.client.ResourceV1alpha2().ResourceClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get the claim: %v", err)
+	}
+	if string(rc.UID) != claim.Uid {
+		return fmt.Errorf("claim was replaced, UID %s instead of %s", rc.UID, claim.Uid)
+	}
+	if rc.Status.Allocation == nil {
+		return fmt.Errorf("claim is not allocated")
+	}
+	drivers := []string{}
+	for _, handle := range rc.Status.Allocation.ResourceHandles {
+		if handle.DriverName == p.driverName {
+			return nil
+		}
+		drivers = append(drivers, handle.DriverName)
+	}
+	return fmt.Errorf("claim is allocated by %v, not by driver %s", drivers, p.driverName)
+}
+
+// NodeUnprepareResources forgets the claims, the devices need no cleanup
+func (p *DRAPlugin) NodeUnprepareResources(ctx context.Context, req *drapb.NodeUnprepareResourcesRequest) (*drapb.NodeUnprepareResourcesResponse, error) {
+	resp := &drapb.NodeUnprepareResourcesResponse{Claims: map[string]*drapb.NodeUnprepareResourceResponse{}}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, claim := range req.Claims {
+		delete(p.prepared, claim.Uid)
+		resp.Claims[claim.Uid] = &drapb.NodeUnprepareResourceResponse{}
+	}
+	return resp, nil
+}
+
+// NodeListAndWatchResources reports the resources for kubelet to publish,
+// unless the plugin publishes the ResourceSlices itself
+func (p *DRAPlugin) NodeListAndWatchResources(req *drapb.NodeListAndWatchResourcesRequest, stream drapb.Node_NodeListAndWatchResourcesServer) error {
+	if p.publish {
+		return status.Error(codes.Unimplemented, "ResourceSlices are published by the plugin")
+	}
+
+	model := p.resourceModel()
+	if err := stream.Send(&drapb.NodeListAndWatchResourcesResponse{Resources: []*resourceapi.ResourceModel{&model}}); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+// PublishResourceSlices creates or updates the ResourceSlice of the node
+// and removes any other slice of the driver on the node
+func (p *DRAPlugin) PublishResourceSlices(ctx context.Context) error {
+	slices, err := p.listResourceSlices(ctx)
+	if err != nil {
+		return err
+	}
+
+	model := p.resourceModel()
+	if len(slices) == 0 {
+		slice := &resourceapi.ResourceSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: p.nodeName + "-" + p.driverName,
+			},
+			NodeName:      p.nodeName,
+			DriverName:    p.driverName,
+			ResourceModel: model,
+		}
+		if _, err := p.client.ResourceV1alpha2().ResourceSlices().Create(ctx, slice, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create ResourceSlice: %v", err)
+		}
+		log.Printf("[%s] Published ResourceSlice with %d instances", p.driverName, len(model.NamedResources.Instances))
+		return nil
+	}
+
+	slice := slices[0].DeepCopy()
+	slice.ResourceModel = model
+	if _, err := p.client.ResourceV1alpha2().ResourceSlices().Update(ctx, slice, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ResourceSlice %s: %v", slice.Name, err)
+	}
+	for _, obsolete := range slices[1:] {
+		err := p.client.ResourceV1alpha2().ResourceSlices().Delete(ctx, obsolete.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete ResourceSlice %s: %v", obsolete.Name, err)
+		}
+	}
+	log.Printf("[%s] Updated ResourceSlice %s with %d instances", p.driverName, slice.Name, len(model.NamedResources.Instances))
+	return nil
+}
+
+// DeleteResourceSlices removes all slices of the driver on the node
+func (p *DRAPlugin) DeleteResourceSlices(ctx context.Context) error {
+	slices, err := p.listResourceSlices(ctx)
+	if err != nil {
+		return err
+	}
+	for _, slice := range slices {
+		err := p.client.ResourceV1alpha2().ResourceSlices().Delete(ctx, slice.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete ResourceSlice %s: %v", slice.Name, err)
+		}
+	}
+	return nil
+}
+
+func (p *DRAPlugin) listResourceSlices(ctx context.Context) ([]resourceapi.ResourceSlice, error) {
+	list, err := p.client.ResourceV1alpha2().ResourceSlices().List(ctx, metav1.ListOptions{
+		FieldSelector: fields.Set{"nodeName": p.nodeName, "driverName": p.driverName}.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ResourceSlices: %v", err)
+	}
+
+	// Field selectors are not honoured by every client, e.g. the fake one
+	slices := []resourceapi.ResourceSlice{}
+	for _, slice := range list.Items {
+		if slice.NodeName == p.nodeName && slice.DriverName == p.driverName {
+			slices = append(slices, slice)
+		}
+	}
+	return slices, nil
+}
+
+// resourceModel describes every discovered IOMMU group as a named resource instance
+func (p *DRAPlugin) resourceModel() resourceapi.ResourceModel {
+	instances := []resourceapi.NamedResourcesInstance{}
+	for _, info := range p.m.Inventory() {
+		instances = append(instances, resourceapi.NamedResourcesInstance{
+			Name: draInstancePrefix + info.IommuGroup,
+			Attributes: []resourceapi.NamedResourcesAttribute{
+				stringAttribute("vendor", info.VendorID),
+				stringAttribute("device-id", info.DeviceID),
+				stringAttribute("bdf", info.BDF),
+				stringAttribute("model", info.ModelName),
+				stringAttribute("iommu-group", info.IommuGroup),
+				intAttribute("numa-node", int64(info.NumaNode)),
+			},
+		})
+	}
+	return resourceapi.ResourceModel{
+		NamedResources: &resourceapi.NamedResourcesResources{Instances: instances},
+	}
+}
+
+func iommuGroupFromInstance(name string) (string, bool) {
+	if len(name) <= len(draInstancePrefix) || name[:len(draInstancePrefix)] != draInstancePrefix {
+		return "", false
+	}
+	group := name[len(draInstancePrefix):]
+	if _, err := strconv.Atoi(group); err != nil {
+		return "", false
+	}
+	return group, true
+}
+
+func stringAttribute(name, value string) resourceapi.NamedResourcesAttribute {
+	return resourceapi.NamedResourcesAttribute{
+		Name:                         name,
+		NamedResourcesAttributeValue: resourceapi.NamedResourcesAttributeValue{StringValue: &value},
+	}
+}
+
+func intAttribute(name string, value int64) resourceapi.NamedResourcesAttribute {
+	return resourceapi.NamedResourcesAttribute{
+		Name:                         name,
+		NamedResourcesAttributeValue: resourceapi.NamedResourcesAttributeValue{IntValue: &value},
+	}
+}
+
+// runDRAPlugin serves the devices through the DRA frontend until the manager stops
+func (m *Manager) runDRAPlugin() {
+	cfg := m.cfg
+	client, err := m.newKubeClient(cfg.Kubeconfig)
+	if err != nil {
+		log.Printf("Error creating kubernetes client, the claims cannot be checked: %v", err)
+		return
+	}
+	if cfg.NodeName == "" {
+		log.Printf("Error: the node name is required by the DRA frontend, set NODE_NAME or nodeName")
+		return
+	}
+
+	ctx := context.Background()
+	dp := m.NewDRAPlugin(cfg.DRA.DriverName, cfg.NodeName, cfg.DRA.PluginDir, cfg.DRA.RegistryDir, client, cfg.DRA.PublishResourceSlices)
+	if err := dp.Start(ctx); err != nil {
+		log.Printf("Error starting %s DRA plugin: %v", cfg.DRA.DriverName, err)
+		return
+	}
+
+	<-m.stop
+	log.Printf("Shutting down DRA plugin")
+	dp.Stop(ctx)
+}
@@ -0,0 +1,220 @@
+package device_plugin
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	resourceapi "k8s.io/api/resource/v1alpha2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8stesting "k8s.io/client-go/testing"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+
+	"kata-xpu-device-plugin/internal/harness"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+func TestDRAResourceSlices(t *testing.T) {
+	env := newHGXEnvironment(t)
+	cfg := env.Config
+	cfg.Frontend = config.FrontendDRA
+	cfg.DRA.PublishResourceSlices = true
+	m := runManager(t, env)
+	ctx := testContext(t)
+
+	// The slices are published before the plugin shows up in the registry
+	info, err := env.PluginWatcher.WaitForPlugin(cfg.DRA.DriverName, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := filepath.Join(cfg.DRA.PluginDir, cfg.DRA.DriverName, draSocketName)
+	if info.Type != registerapi.DRAPlugin || info.Endpoint != endpoint || len(info.SupportedVersions) == 0 {
+		t.Fatalf("unexpected plugin info %+v", info)
+	}
+
+	slices := listSlices(t, ctx, env)
+	if len(slices) != 1 || slices[0].NodeName != cfg.NodeName || slices[0].DriverName != cfg.DRA.DriverName {
+		t.Fatalf("expected one ResourceSlice of node %s, got %+v", cfg.NodeName, slices)
+	}
+	instances := map[string]map[string]string{}
+	for _, instance := range slices[0].ResourceModel.NamedResources.Instances {
+		attributes := map[string]string{}
+		for _, attr := range instance.Attributes {
+			switch {
+			case attr.StringValue != nil:
+				attributes[attr.Name] = *attr.StringValue
+			case attr.IntValue != nil:
+				attributes[attr.Name] = strconv.FormatInt(*attr.IntValue, 10)
+			}
+		}
+		instances[instance.Name] = attributes
+	}
+	if len(instances) != 4 {
+		t.Fatalf("expected 4 instances, got %v", instances)
+	}
+	expected := map[string]string{
+		"vendor":      "10de",
+		"device-id":   harness.H100SXM5Device,
+		"bdf":         "0000:40:00.0",
+		"model":       "GH100_H100_SXM5_80GB",
+		"iommu-group": "20",
+		"numa-node":   "1",
+	}
+	if !reflect.DeepEqual(instances["iommu-group-20"], expected) {
+		t.Fatalf("expected instance iommu-group-20 %v, got %v", expected, instances["iommu-group-20"])
+	}
+
+	// Withdrawn on shutdown
+	m.Shutdown()
+	for len(listSlices(t, ctx, env)) != 0 {
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("ResourceSlice not deleted on shutdown")
+		}
+	}
+}
+
+func TestDRAPrepareResources(t *testing.T) {
+	env := newHGXEnvironment(t)
+	cfg := env.Config
+	m := NewManager(cfg, Options{})
+	m.discover()
+	p := m.NewDRAPlugin(cfg.DRA.DriverName, cfg.NodeName, cfg.DRA.PluginDir, cfg.DRA.RegistryDir, env.KubeClient, false)
+	ctx := testContext(t)
+
+	ours := createClaim(t, ctx, env, "ours", cfg.DRA.DriverName, "iommu-group-10")
+	other := createClaim(t, ctx, env, "other", "gpu.example.com", "iommu-group-11")
+	missing := drapbClaim("missing", cfg.NodeName, "iommu-group-20")
+	elsewhere := createClaim(t, ctx, env, "elsewhere", cfg.DRA.DriverName, "iommu-group-21")
+	elsewhere.StructuredResourceHandle[0].NodeName = "other-node"
+
+	resp, err := p.NodePrepareResources(ctx, &drapb.NodePrepareResourcesRequest{
+		Claims: []*drapb.Claim{ours, other, missing, elsewhere},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The NVSwitch of the partition of the GPU comes along in include mode
+	expected := []string{}
+	for _, dev := range append(m.current().iommuMap["10"], m.current().nvswitchMap["12"]...) {
+		expected = append(expected, cdiDeviceName(dev.index))
+	}
+	sort.Strings(expected)
+	if len(expected) != 2 {
+		t.Fatalf("expected the GPU and the NVSwitch of group 10, got %v", expected)
+	}
+	if got := resp.Claims[ours.Uid]; got.Error != "" || !reflect.DeepEqual(got.CDIDevices, expected) {
+		t.Fatalf("expected CDI devices %v for claim %s, got %+v", expected, ours.Name, got)
+	}
+	for claim, reason := range map[*drapb.Claim]string{
+		other:     "not by driver " + cfg.DRA.DriverName,
+		missing:   "failed to get the claim",
+		elsewhere: "allocated on node other-node",
+	} {
+		if got := resp.Claims[claim.Uid]; !strings.Contains(got.Error, reason) {
+			t.Errorf("claim %s: expected error %q, got %+v", claim.Name, reason, got)
+		}
+	}
+
+	if _, err := p.NodeUnprepareResources(ctx, &drapb.NodeUnprepareResourcesRequest{Claims: []*drapb.Claim{ours}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.prepared) != 0 {
+		t.Fatalf("claims still prepared after unprepare: %v", p.prepared)
+	}
+}
+
+// TestDRAPrepareWithoutLock checks that a claim looked up in the API server
+// does not hold up the other claims
+func TestDRAPrepareWithoutLock(t *testing.T) {
+	env := newHGXEnvironment(t)
+	cfg := env.Config
+	m := NewManager(cfg, Options{})
+	m.discover()
+	p := m.NewDRAPlugin(cfg.DRA.DriverName, cfg.NodeName, cfg.DRA.PluginDir, cfg.DRA.RegistryDir, env.KubeClient, false)
+	ctx := testContext(t)
+
+	slow := createClaim(t, ctx, env, "slow", cfg.DRA.DriverName, "iommu-group-20")
+	fast := createClaim(t, ctx, env, "fast", cfg.DRA.DriverName, "iommu-group-21")
+	blocked, release := make(chan struct{}), make(chan struct{})
+	env.KubeClient.PrependReactor("get", "resourceclaims", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.GetAction).GetName() == slow.Name {
+			close(blocked)
+			<-release
+		}
+		return false, nil, nil
+	})
+
+	done := make(chan *drapb.NodePrepareResourcesResponse)
+	go func() {
+		resp, _ := p.NodePrepareResources(ctx, &drapb.NodePrepareResourcesRequest{Claims: []*drapb.Claim{slow}})
+		done <- resp
+	}()
+	<-blocked
+	resp, err := p.NodePrepareResources(ctx, &drapb.NodePrepareResourcesRequest{Claims: []*drapb.Claim{fast}})
+	if err != nil || resp.Claims[fast.Uid].Error != "" {
+		t.Fatalf("expected the claim prepared while another one is looked up, got %+v, %v", resp, err)
+	}
+	if _, err := p.NodeUnprepareResources(ctx, &drapb.NodeUnprepareResourcesRequest{Claims: []*drapb.Claim{fast}}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if resp := <-done; resp.Claims[slow.Uid].Error != "" {
+		t.Fatalf("unexpected error preparing claim %s: %+v", slow.Name, resp)
+	}
+}
+
+// createClaim stores a ResourceClaim allocated by driver in the fake API
+// server and returns the claim kubelet hands over for it
+func createClaim(t *testing.T, ctx context.Context, env *harness.Environment, name, driver, instance string) *drapb.Claim {
+	t.Helper()
+	claim := drapbClaim(name, env.Config.NodeName, instance)
+	rc := &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: claim.Namespace, Name: name, UID: types.UID(claim.Uid)},
+		Status: resourceapi.ResourceClaimStatus{
+			DriverName: driver,
+			Allocation: &resourceapi.AllocationResult{
+				ResourceHandles: []resourceapi.ResourceHandle{{DriverName: driver}},
+			},
+		},
+	}
+	if _, err := env.KubeClient.ResourceV1alpha2().ResourceClaims(claim.Namespace).Create(ctx, rc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return claim
+}
+
+func drapbClaim(name, nodeName, instance string) *drapb.Claim {
+	return &drapb.Claim{
+		Namespace: metav1.NamespaceDefault,
+		Name:      name,
+		Uid:       "uid-" + name,
+		StructuredResourceHandle: []*resourceapi.StructuredResourceHandle{{
+			NodeName: nodeName,
+			Results: []resourceapi.DriverAllocationResult{{
+				AllocationResultModel: resourceapi.AllocationResultModel{
+					NamedResources: &resourceapi.NamedResourcesAllocationResult{Name: instance},
+				},
+			}},
+		}},
+	}
+}
+
+func listSlices(t *testing.T, ctx context.Context, env *harness.Environment) []resourceapi.ResourceSlice {
+	t.Helper()
+	list, err := env.KubeClient.ResourceV1alpha2().ResourceSlices().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list.Items
+}
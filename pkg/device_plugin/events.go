@@ -0,0 +1,154 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// Component reported as the source of the events
+const eventComponent = "kata-xpu-device-plugin"
+
+// Reasons of the events recorded on the Node
+const (
+	eventDeviceUnhealthy    = "DeviceUnhealthy"
+	eventDeviceHealthy      = "DeviceHealthy"
+	eventDeviceAdded        = "DeviceAdded"
+	eventDeviceRemoved      = "DeviceRemoved"
+	eventDeviceChanged      = "DeviceChanged"
+	eventCDISpecFailed      = "CDISpecFailed"
+	eventRegistrationFailed = "RegistrationFailed"
+	eventPluginRestarted    = "PluginRestarted"
+	eventPreflightFailed    = "PreflightFailed"
+)
+
+// eventRecorder records events on the Node the plugin runs on. A nil
+// recorder drops them, so callers never check whether events are enabled.
+type eventRecorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	node        *v1.ObjectReference
+}
+
+// newEventRecorder records the events of nodeName through client. The
+// broadcaster aggregates identical events and rate-limits them.
+func newEventRecorder(client kubernetes.Interface, nodeName string, cfg config.EventsConfig) *eventRecorder {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: cfg.Burst,
+		QPS:       cfg.QPS,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &eventRecorder{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent, Host: nodeName}),
+		// Like kubelet, the UID of the node is its name
+		node: &v1.ObjectReference{Kind: "Node", Name: nodeName, UID: types.UID(nodeName)},
+	}
+}
+
+// startEvents records the events of the plugin when an API server is
+// reachable, and leaves them disabled otherwise
+func (m *Manager) startEvents() {
+	cfg := m.cfg
+	if !cfg.Events.Enabled {
+		return
+	}
+	if cfg.NodeName == "" {
+		log.Printf("Kubernetes events disabled: the node name is not set, set NODE_NAME or nodeName")
+		return
+	}
+	client, err := m.newKubeClient(cfg.Kubeconfig)
+	if err != nil {
+		log.Printf("Kubernetes events disabled: %v", err)
+		return
+	}
+	m.events = newEventRecorder(client, cfg.NodeName, cfg.Events)
+}
+
+// Shutdown flushes the pending events and stops recording
+func (r *eventRecorder) Shutdown() {
+	if r == nil {
+		return
+	}
+	r.broadcaster.Shutdown()
+}
+
+func (r *eventRecorder) event(eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(r.node, eventType, reason, messageFmt, args...)
+}
+
+// deviceHealth records a health transition of an IOMMU group, located by groupLocation
+func (r *eventRecorder) deviceHealth(resourceName string, location string, health string, reasons map[string]string) {
+	if health == pluginapi.Healthy {
+		r.event(v1.EventTypeNormal, eventDeviceHealthy, "%s of %s is healthy again", location, resourceName)
+		return
+	}
+	r.event(v1.EventTypeWarning, eventDeviceUnhealthy, "%s of %s is unhealthy: %s", location, resourceName, formatHealthReasons(reasons))
+}
+
+// specChanges records the devices added, removed or changed since the
+// previous CDI spec, i.e. what discovery found different from the last run
+func (r *eventRecorder) specChanges(old, new *cdihandler.CdiSpec) {
+	if r == nil || old == nil {
+		return
+	}
+	diff := cdihandler.Diff(old, new)
+	for _, name := range diff.Added {
+		r.event(v1.EventTypeNormal, eventDeviceAdded, "CDI device %s, %s, discovered", name, cdiDeviceLocation(new.Device(name)))
+	}
+	for _, name := range diff.Removed {
+		r.event(v1.EventTypeWarning, eventDeviceRemoved, "CDI device %s, %s, no longer discovered", name, cdiDeviceLocation(old.Device(name)))
+	}
+	for _, change := range diff.Changed {
+		r.event(v1.EventTypeNormal, eventDeviceChanged, "CDI device %s, %s, changed: %s", change.Name,
+			cdiDeviceLocation(new.Device(change.Name)), strings.Join(change.Changes, "; "))
+	}
+}
+
+// groupLocation names an IOMMU group with the BDF of its first function
+func (d *discovery) groupLocation(iommuGroup string) string {
+	if devs := d.iommuMap[iommuGroup]; len(devs) > 0 {
+		return fmt.Sprintf("IOMMU group %s (%s)", iommuGroup, devs[0].addr)
+	}
+	return "IOMMU group " + iommuGroup
+}
+
+// cdiDeviceLocation names the IOMMU group and BDF of a CDI device from its annotations
+func cdiDeviceLocation(dev *cdihandler.Device) string {
+	if dev == nil {
+		return "unknown IOMMU group"
+	}
+	group := "unknown"
+	vfioPrefix := cdihandler.CdiK8SPrefix + "vfio"
+	for key := range dev.Annotations {
+		if strings.HasPrefix(key, vfioPrefix) {
+			group = strings.TrimPrefix(key, vfioPrefix)
+		}
+	}
+	return fmt.Sprintf("IOMMU group %s (%s)", group, dev.Annotations["bdf"])
+}
+
+// formatHealthReasons renders the unhealthy reasons by source, sorted
+func formatHealthReasons(reasons map[string]string) string {
+	parts := make([]string, 0, len(reasons))
+	for source, reason := range reasons {
+		parts = append(parts, source+": "+reason)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,170 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// NVSwitches are NVIDIA functions of class "bridge, other"
+const nvswitchClass = "0680"
+
+// fabricPartition is a set of GPUs and NVSwitches connected over NVLink
+type fabricPartition struct {
+	name         string
+	gpuGroups    []string
+	switchGroups []string
+}
+
+func isNVSwitch(fn PCIFunction) bool {
+	return fn.VendorID == nvidiaVendorID && classMatches(fn.Class, []string{nvswitchClass})
+}
+
+func (dev NvidiaGpuDevice) isNVSwitch() bool {
+	return isNVSwitch(PCIFunction{VendorID: dev.vendorID, Class: dev.class})
+}
+
+// buildFabricPartitions assigns the GPU and NVSwitch groups found by the
+// discovery to fabric partitions
+func (d *discovery) buildFabricPartitions(cfg config.FabricConfig) {
+	d.groupPartition = make(map[string]string)
+	d.fabricPartitions = make(map[string]*fabricPartition)
+	if cfg.Mode == config.FabricModeOff {
+		return
+	}
+
+	assign := func(group string, dev NvidiaGpuDevice, nvswitch bool) {
+		name := partitionName(cfg, dev)
+		if name == "" {
+			log.Printf("Device %s is not part of any fabric partition", dev.addr)
+			return
+		}
+		p, ok := d.fabricPartitions[name]
+		if !ok {
+			p = &fabricPartition{name: name}
+			d.fabricPartitions[name] = p
+		}
+		if nvswitch {
+			p.switchGroups = append(p.switchGroups, group)
+		} else {
+			p.gpuGroups = append(p.gpuGroups, group)
+		}
+		d.groupPartition[group] = name
+	}
+
+	for group, devs := range d.iommuMap {
+		if len(devs) > 0 {
+			assign(group, devs[0], devs[0].isNVSwitch())
+		}
+	}
+	for group, devs := range d.nvswitchMap {
+		if len(devs) > 0 {
+			assign(group, devs[0], true)
+		}
+	}
+
+	for _, p := range d.fabricPartitions {
+		sort.Slice(p.gpuGroups, func(i, j int) bool { return lessIommuGroup(p.gpuGroups[i], p.gpuGroups[j]) })
+		sort.Slice(p.switchGroups, func(i, j int) bool { return lessIommuGroup(p.switchGroups[i], p.switchGroups[j]) })
+		log.Printf("Fabric partition %s: GPU groups %v, NVSwitch groups %v", p.name, p.gpuGroups, p.switchGroups)
+	}
+}
+
+// partitionName returns the partition of a device, empty if it has none
+func partitionName(cfg config.FabricConfig, dev NvidiaGpuDevice) string {
+	if len(cfg.Partitions) > 0 {
+		for _, p := range cfg.Partitions {
+			if bdfMatches(dev.addr, p.BDFs) {
+				return p.Name
+			}
+		}
+		return ""
+	}
+
+	switch cfg.PartitionBy {
+	case config.PartitionByNuma:
+		if dev.numaNode < 0 {
+			return "numa-unknown"
+		}
+		return fmt.Sprintf("numa%d", dev.numaNode)
+	default:
+		return "node"
+	}
+}
+
+// partitionSwitchGroups returns the NVSwitch groups of the partitions of the
+// given GPU groups
+func (d *discovery) partitionSwitchGroups(gpuGroups []string) []string {
+	seen := map[string]bool{}
+	switches := []string{}
+	for _, group := range gpuGroups {
+		p, ok := d.fabricPartitions[d.groupPartition[group]]
+		if !ok || seen[p.name] {
+			continue
+		}
+		seen[p.name] = true
+		switches = append(switches, p.switchGroups...)
+	}
+	return switches
+}
+
+// preferredAllocation picks size devices among available, keeping them in as
+// few fabric partitions as possible. Partitions already used by mustInclude
+// come first, then the smallest partition the remaining devices fit in.
+func (d *discovery) preferredAllocation(available, mustInclude []string, size int) []string {
+	chosen := append([]string{}, mustInclude...)
+	picked := map[string]bool{}
+	usedPartitions := map[string]bool{}
+	for _, id := range mustInclude {
+		picked[id] = true
+		usedPartitions[d.groupPartition[id]] = true
+	}
+
+	byPartition := map[string][]string{}
+	for _, id := range available {
+		if !picked[id] {
+			partition := d.groupPartition[id]
+			byPartition[partition] = append(byPartition[partition], id)
+		}
+	}
+	names := make([]string, 0, len(byPartition))
+	for name, ids := range byPartition {
+		sort.Slice(ids, func(i, j int) bool { return lessIommuGroup(ids[i], ids[j]) })
+		names = append(names, name)
+	}
+
+	for len(chosen) < size && len(names) > 0 {
+		need := size - len(chosen)
+		sort.Slice(names, func(i, j int) bool {
+			a, b := names[i], names[j]
+			if usedPartitions[a] != usedPartitions[b] {
+				return usedPartitions[a]
+			}
+			fitA, fitB := len(byPartition[a]) >= need, len(byPartition[b]) >= need
+			if fitA != fitB {
+				return fitA
+			}
+			if fitA {
+				// Best fit, leave the larger partitions whole
+				if len(byPartition[a]) != len(byPartition[b]) {
+					return len(byPartition[a]) < len(byPartition[b])
+				}
+			} else if len(byPartition[a]) != len(byPartition[b]) {
+				return len(byPartition[a]) > len(byPartition[b])
+			}
+			return a < b
+		})
+
+		name := names[0]
+		names = names[1:]
+		ids := byPartition[name]
+		if len(ids) > need {
+			ids = ids[:need]
+		}
+		chosen = append(chosen, ids...)
+		usedPartitions[name] = true
+	}
+	return chosen
+}
@@ -9,12 +9,16 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	v1 "k8s.io/api/core/v1"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
 
 	cdiutils "kata-xpu-device-plugin/cdi"
 
@@ -25,28 +29,31 @@ import (
 const (
 	DevicePluginNamespace = "nvidia.com"
 	connectionTimeout     = 5 * time.Second
-	vfioDevicePath        = "/dev/vfio"
 	gpuPrefix             = "PCI_RESOURCE_NVIDIA_COM"
 	K8SCDIVendorClass     = "KUBERNETES_CDI_VENDOR_CLASS"
 	CdiVendorClass        = "nvidia.com/gpu"
 )
 
-var returnIommuMap = getIommuMap
-
 // Implements the kubernetes device plugin API
 type GenericDevicePlugin struct {
-	devs                 []*pluginapi.Device
+	m                    *Manager
+	backend              DeviceBackend
+	state                *deviceState
+	mu                   sync.Mutex // protects server, stop, term and the registration state
 	server               *grpc.Server
+	registered           bool
+	registerError        string
+	registeredAt         time.Time
 	socketPath           string
 	stop                 chan struct{} // this channel signals to stop the DP
-	term                 chan bool     // this channel detects kubelet restarts
-	healthy              chan string
-	unhealthy            chan string
-	devicePath           string
+	term                 chan struct{} // this channel is closed when the gRPC server stops
 	devpluginName        string
 	devsHealth           []*pluginapi.Device
 	cdiAnnotationPrefix  string
 	deviceListStrategies DeviceListStrategies
+
+	// registrar serves the plugin watcher registration, nil when dialing kubelet.sock
+	registrar *registrationServer
 }
 
 // DeviceListStrategies defines which strategies are enabled and should
@@ -70,20 +77,37 @@ func (s DeviceListStrategies) Includes(strategy string) bool {
 	return s[strategy]
 }
 
-// Returns an initialized instance of GenericDevicePlugin
-func NewGenericDevicePlugin(devpluginName string, devicePath string, devices []*pluginapi.Device) *GenericDevicePlugin {
+// Returns an initialized instance of GenericDevicePlugin serving a resource of the backend
+func (m *Manager) NewGenericDevicePlugin(backend DeviceBackend, devpluginName string, devices []*pluginapi.Device) *GenericDevicePlugin {
 	log.Println("DevicePlugin Name " + devpluginName)
-	serverSock := fmt.Sprintf(pluginapi.DevicePluginPath+"kata-xpu-%s.sock", devpluginName)
+	socketDir := m.cfg.Kubelet.DevicePluginDir
+	if m.cfg.Kubelet.PluginWatcher() {
+		socketDir = m.cfg.Kubelet.PluginDir
+	}
+	serverSock := filepath.Join(socketDir, fmt.Sprintf("kata-xpu-%s.sock", devpluginName))
 	dpi := &GenericDevicePlugin{
-		devs:                 devices,
+		m:                    m,
+		backend:              backend,
+		state:                newDeviceState(devices),
 		socketPath:           serverSock,
-		term:                 make(chan bool, 1),
-		healthy:              make(chan string),
-		unhealthy:            make(chan string),
 		devpluginName:        devpluginName,
-		devicePath:           devicePath,
 		deviceListStrategies: newDeviceListStrategies(),
 	}
+	dpi.state.onHealthChange = func(id string, health string, reasons map[string]string) {
+		m.events.deviceHealth(dpi.resourceName(), backend.Location(id), health, reasons)
+		m.refreshNodeFeatures()
+	}
+	if m.cfg.Kubelet.PluginWatcher() {
+		dpi.registrar = newRegistrationServer(
+			filepath.Join(m.cfg.Kubelet.RegistryDir, fmt.Sprintf("kata-xpu-%s-reg.sock", devpluginName)),
+			registerapi.PluginInfo{
+				Type:              registerapi.DevicePlugin,
+				Name:              dpi.resourceName(),
+				Endpoint:          serverSock,
+				SupportedVersions: []string{pluginapi.Version},
+			})
+		dpi.registrar.onStatus = dpi.registrationStatus
+	}
 	return dpi
 }
 
@@ -106,7 +130,8 @@ func waitForGrpcServer(socketPath string, timeout time.Duration) error {
 
 // dial establishes the gRPC communication with the registered device plugin.
 func connect(socketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 	c, err := grpc.DialContext(ctx, socketPath,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithBlock(),
@@ -126,7 +151,9 @@ func connect(socketPath string, timeout time.Duration) (*grpc.ClientConn, error)
 
 // Start starts the gRPC server of the device plugin
 func (dpi *GenericDevicePlugin) Start(stop chan struct{}) error {
+	dpi.mu.Lock()
 	if dpi.server != nil {
+		dpi.mu.Unlock()
 		return fmt.Errorf("gRPC server already started")
 	}
 
@@ -134,29 +161,58 @@ func (dpi *GenericDevicePlugin) Start(stop chan struct{}) error {
 
 	err := dpi.cleanup()
 	if err != nil {
+		dpi.mu.Unlock()
 		return err
 	}
+	if dpi.registrar != nil {
+		if err := os.MkdirAll(filepath.Dir(dpi.socketPath), 0750); err != nil {
+			dpi.mu.Unlock()
+			return err
+		}
+	}
 
 	sock, err := net.Listen("unix", dpi.socketPath)
 	if err != nil {
+		dpi.mu.Unlock()
 		log.Printf("[%s] Error creating GRPC server socket: %v", dpi.devpluginName, err)
 		return err
 	}
 
+	dpi.term = make(chan struct{})
 	dpi.server = grpc.NewServer([]grpc.ServerOption{}...)
 	pluginapi.RegisterDevicePluginServer(dpi.server, dpi)
 
 	go dpi.server.Serve(sock)
+	dpi.mu.Unlock()
 
 	err = waitForGrpcServer(dpi.socketPath, connectionTimeout)
 	if err != nil {
-		// this err is returned at the end of the Start function
 		log.Printf("[%s] Error connecting to GRPC server: %v", dpi.devpluginName, err)
+		// Neither the server nor its socket may outlive a failed start
+		dpi.Stop()
+		return err
+	}
+
+	if dpi.registrar != nil {
+		// Kubelet discovers the socket and reports back, through
+		// registrationStatus, now and after each of its restarts
+		if err := dpi.registrar.Start(); err != nil {
+			dpi.setRegistration(err)
+			log.Printf("[%s] Error serving the plugin watcher registration: %v", dpi.devpluginName, err)
+			dpi.m.events.event(v1.EventTypeWarning, eventRegistrationFailed, "%s could not register with kubelet: %v", dpi.resourceName(), err)
+			dpi.Stop()
+			return err
+		}
+		log.Println(dpi.devpluginName + " Device plugin server ready")
+		return nil
 	}
 
 	err = dpi.Register()
+	dpi.setRegistration(err)
 	if err != nil {
 		log.Printf("[%s] Error registering with device plugin manager: %v", dpi.devpluginName, err)
+		dpi.m.events.event(v1.EventTypeWarning, eventRegistrationFailed, "%s could not register with kubelet: %v", dpi.resourceName(), err)
+		dpi.Stop()
 		return err
 	}
 
@@ -169,15 +225,23 @@ func (dpi *GenericDevicePlugin) Start(stop chan struct{}) error {
 
 // Stop stops the gRPC server
 func (dpi *GenericDevicePlugin) Stop() error {
-	if dpi.server == nil {
+	dpi.mu.Lock()
+	server, term := dpi.server, dpi.term
+	dpi.server = nil
+	dpi.mu.Unlock()
+	if server == nil {
 		return nil
 	}
 
-	// Send terminate signal to ListAndWatch()
-	dpi.term <- true
+	// Removing the registration socket unregisters the plugin
+	if dpi.registrar != nil {
+		dpi.registrar.Stop()
+	}
 
-	dpi.server.Stop()
-	dpi.server = nil
+	// Send terminate signal to every ListAndWatch() stream
+	close(term)
+
+	server.Stop()
 
 	return dpi.cleanup()
 }
@@ -185,20 +249,23 @@ func (dpi *GenericDevicePlugin) Stop() error {
 // Restarts DP server
 func (dpi *GenericDevicePlugin) restart() error {
 	log.Printf("Restarting %s device plugin server", dpi.devpluginName)
+	dpi.mu.Lock()
 	if dpi.server == nil {
+		dpi.mu.Unlock()
 		return fmt.Errorf("grpc server instance not found for %s", dpi.devpluginName)
 	}
+	stop := dpi.stop
+	dpi.mu.Unlock()
 
 	dpi.Stop()
 
-	// Create new instance of a grpc server
-	var stop = make(chan struct{})
+	// Create new instance of a grpc server, still bound to the controller stop channel
 	return dpi.Start(stop)
 }
 
 // Register registers the device plugin for the given resourceName with Kubelet.
 func (dpi *GenericDevicePlugin) Register() error {
-	conn, err := connect(pluginapi.KubeletSocket, connectionTimeout)
+	conn, err := connect(filepath.Join(dpi.m.cfg.Kubelet.DevicePluginDir, "kubelet.sock"), connectionTimeout)
 	if err != nil {
 		return err
 	}
@@ -208,7 +275,7 @@ func (dpi *GenericDevicePlugin) Register() error {
 	reqt := &pluginapi.RegisterRequest{
 		Version:      pluginapi.Version,
 		Endpoint:     path.Base(dpi.socketPath),
-		ResourceName: fmt.Sprintf("%s/%s", DevicePluginNamespace, dpi.devpluginName),
+		ResourceName: dpi.resourceName(),
 	}
 
 	_, err = client.Register(context.Background(), reqt)
@@ -218,32 +285,65 @@ func (dpi *GenericDevicePlugin) Register() error {
 	return nil
 }
 
+func (dpi *GenericDevicePlugin) setRegistration(err error) {
+	dpi.mu.Lock()
+	defer dpi.mu.Unlock()
+	dpi.registered = err == nil
+	dpi.registerError = ""
+	if err != nil {
+		dpi.registerError = err.Error()
+	} else {
+		dpi.registeredAt = dpi.m.clock.Now()
+	}
+}
+
+// registrationStatus records the registration status reported by kubelet in
+// plugin watcher mode. Kubelet registers the plugin again after a restart.
+func (dpi *GenericDevicePlugin) registrationStatus(status *registerapi.RegistrationStatus) {
+	dpi.mu.Lock()
+	again := !dpi.registeredAt.IsZero()
+	dpi.mu.Unlock()
+
+	if !status.PluginRegistered {
+		dpi.setRegistration(fmt.Errorf("rejected by kubelet: %s", status.Error))
+		dpi.m.events.event(v1.EventTypeWarning, eventRegistrationFailed, "%s was rejected by kubelet: %s", dpi.resourceName(), status.Error)
+		return
+	}
+	dpi.setRegistration(nil)
+	if again {
+		dpi.m.events.event(v1.EventTypeNormal, eventPluginRestarted, "%s registered again with kubelet", dpi.resourceName())
+	}
+}
+
+// resourceName returns the extended resource name advertised to kubelet
+func (dpi *GenericDevicePlugin) resourceName() string {
+	return fmt.Sprintf("%s/%s", DevicePluginNamespace, dpi.devpluginName)
+}
+
 // ListAndWatch lists devices and update that list according to the health status
+// Every stream receives the full device list on subscription and on every change.
 func (dpi *GenericDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	dpi.mu.Lock()
+	stop, term := dpi.stop, dpi.term
+	dpi.mu.Unlock()
 
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
+	id, updates := dpi.state.Subscribe()
+	defer dpi.state.Unsubscribe(id)
+	log.Printf("[%s] ListAndWatch stream %d opened", dpi.devpluginName, id)
 
 	for {
 		select {
-		case unhealthy := <-dpi.unhealthy:
-			log.Printf("In watch unhealthy")
-			for _, dev := range dpi.devs {
-				if unhealthy == dev.ID {
-					dev.Health = pluginapi.Unhealthy
-				}
+		case devs := <-updates:
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+				log.Printf("[%s] ListAndWatch stream %d failed to send: %v", dpi.devpluginName, id, err)
+				return err
 			}
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
-		case healthy := <-dpi.healthy:
-			log.Printf("In watch healthy")
-			for _, dev := range dpi.devs {
-				if healthy == dev.ID {
-					dev.Health = pluginapi.Healthy
-				}
-			}
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
-		case <-dpi.stop:
+		case <-s.Context().Done():
+			log.Printf("[%s] ListAndWatch stream %d closed by kubelet", dpi.devpluginName, id)
 			return nil
-		case <-dpi.term:
+		case <-stop:
+			return nil
+		case <-term:
 			return nil
 		}
 	}
@@ -269,14 +369,9 @@ func (plugin *GenericDevicePlugin) getCDIDeviceAnnotations(id string, devices ..
 	return updatedAnnotations, nil
 }
 
-// updateResponseForCDI updates the specified response for the given device IDs.
+// updateResponseForCDI updates the specified response for the given CDI devices.
 // This response contains the annotations required to trigger CDI injection in the container engine or nvidia-container-runtime.
-func (plugin *GenericDevicePlugin) updateResponseForCDI(response *pluginapi.ContainerAllocateResponse, responseID string, deviceIDs ...uint) error {
-	var devices []string
-	for _, id := range deviceIDs {
-		devices = append(devices, cdiutils.QualifiedName("nvidia.com", "gpu", fmt.Sprintf("%v", id)))
-	}
-
+func (plugin *GenericDevicePlugin) updateResponseForCDI(response *pluginapi.ContainerAllocateResponse, responseID string, devices ...string) error {
 	if len(devices) == 0 {
 		log.Println("devices empty.")
 		return nil
@@ -301,7 +396,7 @@ func (plugin *GenericDevicePlugin) updateResponseForCDI(response *pluginapi.Cont
 	return nil
 }
 
-func (plugin *GenericDevicePlugin) getAllocateResponse(deviceIDs []uint) (*pluginapi.ContainerAllocateResponse, error) {
+func (plugin *GenericDevicePlugin) getAllocateResponse(cdiDevices []string) (*pluginapi.ContainerAllocateResponse, error) {
 	// Create an empty response that will be updated as required below.
 	response := &pluginapi.ContainerAllocateResponse{
 		Envs: make(map[string]string),
@@ -309,7 +404,7 @@ func (plugin *GenericDevicePlugin) getAllocateResponse(deviceIDs []uint) (*plugi
 
 	// 120c8e49-a128-4186-bdbb-af37586bd602
 	responseID := uuid.New().String()
-	if err := plugin.updateResponseForCDI(response, responseID, deviceIDs...); err != nil {
+	if err := plugin.updateResponseForCDI(response, responseID, cdiDevices...); err != nil {
 		return nil, fmt.Errorf("failed to get allocate response for CDI: %v", err)
 	}
 
@@ -320,34 +415,32 @@ func (plugin *GenericDevicePlugin) getAllocateResponse(deviceIDs []uint) (*plugi
 func (dpi *GenericDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	responses := pluginapi.AllocateResponse{}
 	for _, req := range reqs.ContainerRequests {
-		devIndexes := []uint{}
-		for _, iommuId := range req.DevicesIDs {
-			returnedMap := returnIommuMap()
-			//Retrieve the devices associated with a Iommu group
-			nvDevs := returnedMap[iommuId]
-			for _, dev := range nvDevs {
-				iommuGroup, err := readLink(basePath, dev.addr, "iommu_group")
-				if err != nil || iommuGroup != iommuId {
-					log.Println("IommuGroup has changed on the system ", dev.addr)
-					return nil, fmt.Errorf("invalid allocation request: unknown device: %s", dev.addr)
-				}
-				vendorID, err := readIDFromFile(basePath, dev.addr, "vendor")
-				if err != nil || vendorID != "10de" {
-					log.Println("Vendor has changed on the system ", dev.addr)
-					return nil, fmt.Errorf("invalid allocation request: unknown device: %s", dev.addr)
-				}
-
-				devIndexes = append(devIndexes, dev.index)
-			}
+		if err := dpi.validateAllocation(req.DevicesIDs); err != nil {
+			log.Printf("[%s] Rejecting allocation of %v: %v", dpi.devpluginName, req.DevicesIDs, err)
+			return nil, err
+		}
+		cdiDevices, err := dpi.backend.Allocate(dpi.devpluginName, req.DevicesIDs)
+		if err != nil {
+			return nil, allocationError(codes.Internal, AllocationReasonResponseInternal, "", "",
+				"failed to allocate devices: %v", err)
 		}
 
-		allocated_response, err := dpi.getAllocateResponse(devIndexes)
+		allocated_response, err := dpi.getAllocateResponse(cdiDevices)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get allocate response: %v", err)
+			return nil, allocationError(codes.Internal, AllocationReasonResponseInternal, "", "",
+				"failed to get allocate response: %v", err)
 		}
 		allocated_response.Envs = map[string]string{
 			K8SCDIVendorClass: CdiVendorClass,
 		}
+		// Kata needs the ports of all the devices of the container up front
+		if allocated_response.Annotations == nil {
+			allocated_response.Annotations = map[string]string{}
+		}
+		addKataAnnotations(dpi.m.cfg.Kata, allocated_response.Annotations, dpi.resourceName(), len(cdiDevices))
+		if dpi.m.ledger != nil {
+			dpi.m.ledger.RecordAllocation(dpi.resourceName(), req.DevicesIDs)
+		}
 		responses.ContainerResponses = append(responses.ContainerResponses, allocated_response)
 	}
 
@@ -364,34 +457,50 @@ func (dpi *GenericDevicePlugin) cleanup() error {
 
 func (dpi *GenericDevicePlugin) GetDevicePluginOptions(ctx context.Context, e *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	options := &pluginapi.DevicePluginOptions{
-		PreStartRequired: false,
+		PreStartRequired:                dpi.m.cfg.PreStart.ResetDevices,
+		GetPreferredAllocationAvailable: true,
 	}
 	return options, nil
 }
 
+// PreStartContainer lets the backend prepare the allocated devices, e.g. reset
+// them so that no state of a previous VM leaks into the next one. It is only
+// called by kubelet when the reset is enabled in the configuration.
 func (dpi *GenericDevicePlugin) PreStartContainer(ctx context.Context, in *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
 	res := &pluginapi.PreStartContainerResponse{}
+	if !dpi.m.cfg.PreStart.ResetDevices {
+		return res, nil
+	}
+
+	if err := dpi.backend.PreStart(dpi.devpluginName, in.DevicesIDs); err != nil {
+		log.Printf("[%s] PreStartContainer failed: %v", dpi.devpluginName, err)
+		return nil, err
+	}
 	return res, nil
 }
 
-// GetPreferredAllocation is for compatible with new DevicePluginServer API for DevicePlugin service. It has not been implemented in kubevrit-gpu-device-plugin
+// GetPreferredAllocation lets the backend pick the devices of a container,
+// e.g. in as few NVLink fabric partitions as possible
 func (dpi *GenericDevicePlugin) GetPreferredAllocation(ctx context.Context, in *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	// TODO
-	// returns a preferred set of devices to allocate
-	// from a list of available ones. The resulting preferred allocation is not
-	// guaranteed to be the allocation ultimately performed by the
-	// devicemanager. It is only designed to help the devicemanager make a more
-	// informed allocation decision when possible.
-	return nil, nil
+	resp := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range in.ContainerRequests {
+		ids := dpi.backend.PreferredAllocation(dpi.devpluginName, req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+		resp.ContainerResponses = append(resp.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: ids,
+		})
+	}
+	return resp, nil
 }
 
-// Health check of GPU devices
+// healthCheck restarts the server when kubelet removes the socket on
+// restart. The health of the devices is watched by the backend.
 func (dpi *GenericDevicePlugin) healthCheck() error {
 	method := fmt.Sprintf("healthCheck(%s)", dpi.devpluginName)
 	log.Printf("%s: invoked", method)
-	var pathDeviceMap = make(map[string]string)
-	var path = dpi.devicePath
-	var health = ""
+
+	dpi.mu.Lock()
+	stop := dpi.stop
+	dpi.mu.Unlock()
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -406,42 +515,12 @@ func (dpi *GenericDevicePlugin) healthCheck() error {
 		return err
 	}
 
-	_, err = os.Stat(path)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("%s: Unable to stat device: %v", method, err)
-			return err
-		}
-	}
-
-	for _, dev := range dpi.devs {
-		devicePath := filepath.Join(path, dev.ID)
-		err = watcher.Add(devicePath)
-		log.Printf(" Adding Watcher to Path : %v", devicePath)
-		pathDeviceMap[devicePath] = dev.ID
-		if err != nil {
-			log.Printf("%s: Unable to add device path to fsnotify watcher: %v", method, err)
-			return err
-		}
-	}
-
 	for {
 		select {
-		case <-dpi.stop:
+		case <-stop:
 			return nil
 		case event := <-watcher.Events:
-			v, ok := pathDeviceMap[event.Name]
-			if ok {
-				// Health in this case is if the device path actually exists
-				if event.Op == fsnotify.Create {
-					health = v
-					dpi.healthy <- health
-				} else if (event.Op == fsnotify.Remove) || (event.Op == fsnotify.Rename) {
-					log.Printf("%s: Marking device unhealthy: %s", method, event.Name)
-					health = v
-					dpi.unhealthy <- health
-				}
-			} else if event.Name == dpi.socketPath && event.Op == fsnotify.Remove {
+			if event.Name == dpi.socketPath && event.Op == fsnotify.Remove {
 				// Watcher event for removal of socket file
 				log.Printf("%s: Socket path for GPU device was removed, kubelet likely restarted", method)
 				// Trigger restart of the DP servers
@@ -450,6 +529,7 @@ func (dpi *GenericDevicePlugin) healthCheck() error {
 					return err
 				}
 				log.Printf("%s: Successfully restarted %s device plugin server. Terminating.", method, dpi.devpluginName)
+				dpi.m.events.event(v1.EventTypeNormal, eventPluginRestarted, "%s registered again after a kubelet restart", dpi.resourceName())
 				return nil
 			}
 		}
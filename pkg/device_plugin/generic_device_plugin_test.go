@@ -0,0 +1,68 @@
+package device_plugin
+
+import (
+	"strings"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+)
+
+func TestRegistration(t *testing.T) {
+	env := newHGXEnvironment(t)
+	_, client := startDevicePlugins(t, env, gpuResource)
+
+	options, err := client.Options(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !options.GetPreferredAllocationAvailable {
+		t.Fatal("GetPreferredAllocation is not advertised")
+	}
+}
+
+func TestListAndWatch(t *testing.T) {
+	env := newHGXEnvironment(t)
+	_, client := startDevicePlugins(t, env, gpuResource)
+
+	_, devices := watchDevices(t, testContext(t), client)
+	if len(devices) != 4 {
+		t.Fatalf("expected 4 devices, got %v", devices)
+	}
+	for _, dev := range devices {
+		if dev.Health != pluginapi.Healthy {
+			t.Fatalf("device %s is %s", dev.ID, dev.Health)
+		}
+	}
+}
+
+func TestGetPreferredAllocation(t *testing.T) {
+	env := newHGXEnvironment(t)
+	_, client := startDevicePlugins(t, env, gpuResource)
+
+	preferred, err := client.GetPreferredAllocation(testContext(t), []string{"10", "11", "20", "21"}, []string{"20"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(preferred, ",") != "20,21" {
+		t.Fatalf("expected the partition of group 20, got %v", preferred)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	env := newHGXEnvironment(t)
+	_, client := startDevicePlugins(t, env, gpuResource)
+
+	resp, err := client.Allocate(testContext(t), "10", "11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// GPUs of groups 10 and 11 and the NVSwitch of their partition
+	if len(resp.CDIDevices) != 3 {
+		t.Fatalf("expected 3 CDI devices, got %v", resp.CDIDevices)
+	}
+	if resp.Annotations[cdihandler.PCIePortCountAnnotation] != "3" {
+		t.Fatalf("expected 3 PCIe ports, got %q", resp.Annotations[cdihandler.PCIePortCountAnnotation])
+	}
+}
@@ -0,0 +1,98 @@
+package device_plugin
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	cdiutils "kata-xpu-device-plugin/cdi"
+)
+
+// DeviceInfo describes a discovered IOMMU group the way it is advertised
+type DeviceInfo struct {
+	IommuGroup   string   `json:"iommuGroup" yaml:"iommuGroup"`
+	BDF          string   `json:"bdf" yaml:"bdf"`
+	VendorID     string   `json:"vendorID" yaml:"vendorID"`
+	DeviceID     string   `json:"deviceID" yaml:"deviceID"`
+	ModelName    string   `json:"modelName" yaml:"modelName"`
+	GroupMembers []string `json:"groupMembers" yaml:"groupMembers"`
+	// GroupFunctions describes every member of the IOMMU group
+	GroupFunctions []PCIFunction `json:"groupFunctions" yaml:"groupFunctions"`
+	Driver         string        `json:"driver" yaml:"driver"`
+	// Serial is the PCIe device serial number, empty if not exposed
+	Serial       string `json:"serial,omitempty" yaml:"serial,omitempty"`
+	NumaNode     int    `json:"numaNode" yaml:"numaNode"`
+	ResourceName string `json:"resourceName" yaml:"resourceName"`
+	// ConfidentialComputing holds the CC facts of the group, when enabled
+	ConfidentialComputing *CCDevice `json:"confidentialComputing,omitempty" yaml:"confidentialComputing,omitempty"`
+	// FabricPartition is the NVLink fabric partition, empty without fabric handling
+	FabricPartition string   `json:"fabricPartition,omitempty" yaml:"fabricPartition,omitempty"`
+	CDINames        []string `json:"cdiNames" yaml:"cdiNames"`
+}
+
+// Inventory returns the devices found by the last discovery, sorted by IOMMU group
+func (m *Manager) Inventory() []DeviceInfo {
+	return m.inventory(m.current())
+}
+
+func (m *Manager) inventory(d *discovery) []DeviceInfo {
+	names := map[string]string{}
+	inventory := []DeviceInfo{}
+	for group, devs := range d.iommuMap {
+		if len(devs) == 0 {
+			continue
+		}
+		dev := devs[0]
+
+		mapKey := d.deviceMapKey(group, dev.deviceID)
+		name, ok := names[mapKey]
+		if !ok {
+			name = m.pluginNameForKey(mapKey)
+			names[mapKey] = name
+		}
+
+		info := DeviceInfo{
+			IommuGroup:   group,
+			BDF:          dev.addr,
+			VendorID:     dev.vendorID,
+			DeviceID:     dev.deviceID,
+			ModelName:    m.pluginNameForDevice(dev.deviceID),
+			Driver:       dev.driver,
+			Serial:       dev.serial,
+			NumaNode:     dev.numaNode,
+			ResourceName: fmt.Sprintf("%s/%s", DevicePluginNamespace, name),
+		}
+		info.FabricPartition = d.groupPartition[group]
+		if cc, ok := d.ccDevices[group]; ok {
+			info.ConfidentialComputing = &cc
+		}
+		info.GroupFunctions = d.groupFunctions[group]
+		for _, fn := range info.GroupFunctions {
+			info.GroupMembers = append(info.GroupMembers, fn.BDF)
+		}
+		for _, d := range devs {
+			info.CDINames = append(info.CDINames, cdiDeviceName(d.index))
+		}
+		inventory = append(inventory, info)
+	}
+
+	sort.Slice(inventory, func(i, j int) bool {
+		return lessIommuGroup(inventory[i].IommuGroup, inventory[j].IommuGroup)
+	})
+	return inventory
+}
+
+// lessIommuGroup orders IOMMU group names numerically
+func lessIommuGroup(a, b string) bool {
+	x, xerr := strconv.Atoi(a)
+	y, yerr := strconv.Atoi(b)
+	if xerr == nil && yerr == nil {
+		return x < y
+	}
+	return a < b
+}
+
+// cdiDeviceName returns the fully qualified CDI name of a PCI function
+func cdiDeviceName(index uint) string {
+	return cdiutils.QualifiedName("nvidia.com", "gpu", fmt.Sprintf("%v", index))
+}
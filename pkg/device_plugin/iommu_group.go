@@ -0,0 +1,105 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// PCIFunction is a member of an IOMMU group. Every member has to be passed
+// through along with the GPU, whatever its vendor.
+type PCIFunction struct {
+	BDF      string `json:"bdf" yaml:"bdf"`
+	VendorID string `json:"vendorID" yaml:"vendorID"`
+	DeviceID string `json:"deviceID" yaml:"deviceID"`
+	// Class is the PCI class code, e.g. 030200 for a 3D controller
+	Class  string `json:"class" yaml:"class"`
+	Driver string `json:"driver" yaml:"driver"`
+}
+
+// readGroupFunctions describes all members of the IOMMU group of deviceAddress
+func (m *Manager) readGroupFunctions(deviceAddress string) []PCIFunction {
+	members, err := m.iommuGroupMembers(deviceAddress)
+	if err != nil {
+		log.Printf("Could not list IOMMU group members of %s: %v", deviceAddress, err)
+		return nil
+	}
+
+	functions := []PCIFunction{}
+	for _, member := range members {
+		fn := PCIFunction{BDF: member}
+		fn.VendorID, _ = m.readID(member, "vendor")
+		fn.DeviceID, _ = m.readID(member, "device")
+		fn.Class, _ = m.readID(member, "class")
+		// Functions without a driver are allowed in a viable group
+		fn.Driver, _ = m.readLink(member, "driver")
+		if fn.Driver != "" && !m.isVFIODriver(fn.Driver) {
+			log.Printf("IOMMU group member %s of %s is bound to %s, the group cannot be passed through", member, deviceAddress, fn.Driver)
+		}
+		functions = append(functions, fn)
+	}
+	return functions
+}
+
+// cdiGroupFunctions returns the members of a group advertised in the CDI
+// spec, without the classes excluded in the configuration
+func (m *Manager) cdiGroupFunctions(d *discovery, iommuGroup string) []PCIFunction {
+	functions := []PCIFunction{}
+	for _, fn := range d.groupFunctions[iommuGroup] {
+		if classMatches(fn.Class, m.cfg.CDI.ExcludeClasses) {
+			continue
+		}
+		functions = append(functions, fn)
+	}
+	return functions
+}
+
+// isVFIODriver reports whether driver is vfio-pci or one of its configured variants
+func (m *Manager) isVFIODriver(driver string) bool {
+	for _, d := range m.vfioDrivers {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
+
+// classMatches reports whether class matches one of the patterns, which are
+// a class (2 digits), class and subclass (4 digits) or a full class code
+func classMatches(class string, patterns []string) bool {
+	class = strings.ToLower(strings.TrimPrefix(class, "0x"))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "0x"))
+		if pattern != "" && strings.HasPrefix(class, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatGroupFunctions renders the group members as a CDI annotation value,
+// "<bdf>=<vendor>:<device>:<class>" separated by commas
+func formatGroupFunctions(functions []PCIFunction) string {
+	members := make([]string, 0, len(functions))
+	for _, fn := range functions {
+		members = append(members, fmt.Sprintf("%s=%s:%s:%s", fn.BDF, fn.VendorID, fn.DeviceID, fn.Class))
+	}
+	return strings.Join(members, ",")
+}
+
+// parseGroupFunctions is the reverse of formatGroupFunctions
+func parseGroupFunctions(value string) ([]PCIFunction, error) {
+	functions := []PCIFunction{}
+	if value == "" {
+		return functions, nil
+	}
+	for _, member := range strings.Split(value, ",") {
+		bdf, ids, ok := strings.Cut(member, "=")
+		fields := strings.Split(ids, ":")
+		if !ok || len(fields) != 3 {
+			return nil, fmt.Errorf("invalid group member %q", member)
+		}
+		functions = append(functions, PCIFunction{BDF: bdf, VendorID: fields[0], DeviceID: fields[1], Class: fields[2]})
+	}
+	return functions, nil
+}
@@ -0,0 +1,21 @@
+package device_plugin
+
+import (
+	"strconv"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// addKataAnnotations sets the plug hints configured for resourceName, with
+// the port count of the given number of devices
+func addKataAnnotations(cfg config.KataConfig, annotations map[string]string, resourceName string, devices int) {
+	rc := cfg.ForResource(resourceName)
+	if rc.AttachMode != "" {
+		annotations[cdihandler.AttachModeAnnotation] = rc.AttachMode
+	}
+	if rc.PCIePort != "" {
+		annotations[cdihandler.PCIePortAnnotation] = rc.PCIePort
+	}
+	annotations[cdihandler.PCIePortCountAnnotation] = strconv.Itoa(rc.PCIePortsPerDevice * devices)
+}
@@ -0,0 +1,252 @@
+package device_plugin
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/clock"
+
+	"kata-xpu-device-plugin/pkg/config"
+	"kata-xpu-device-plugin/pkg/preflight"
+	"kata-xpu-device-plugin/utils"
+)
+
+// Options are the dependencies of a Manager, zero values use the host
+type Options struct {
+	// Sysfs is the tree devices are discovered in, by default the one
+	// mounted at the configured sysfs root
+	Sysfs SysFS
+	// PciIds is the content of the pci.ids database, by default read from
+	// the configured path, e.g. the one of a snapshot
+	PciIds []byte
+	// Clock is the time source of the manager, by default the real clock
+	Clock clock.WithTicker
+	// KubeClient creates the API server client of the events and the DRA
+	// ResourceSlices from the configured kubeconfig
+	KubeClient func(kubeconfig string) (kubernetes.Interface, error)
+}
+
+// Manager discovers the devices of one configuration, writes their CDI spec
+// and serves them to kubelet. Managers share no state: several of them can
+// run in one process, each with its own sysfs tree and kubelet. Only the
+// Prometheus metrics are process wide.
+type Manager struct {
+	cfg            *config.Config
+	sysfs          SysFS
+	pciIds         []byte
+	clock          clock.WithTicker
+	newKubeClient  func(kubeconfig string) (kubernetes.Interface, error)
+	devRoot        string // root of the host /dev, e.g. mounted in the container
+	vfioDevicePath string
+	vfioDrivers    []string
+	backends       []DeviceBackend // selected in the configuration
+
+	mu        sync.RWMutex
+	discovery *discovery // outcome of the last discovery
+
+	featuresMu sync.Mutex // serializes the writes of the NFD feature file
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// Set up by Run before any device plugin starts
+	ledger  *allocationLedger
+	cordons *cordonManager
+	events  *eventRecorder
+	admin   *adminServer
+
+	statusMu        sync.Mutex // protects the fields below
+	plugins         []*GenericDevicePlugin
+	cdiWrite        CDIWriteStatus
+	preflightReport *preflight.Report
+}
+
+// NewManager returns a manager for cfg, nothing is read before it is used
+func NewManager(cfg *config.Config, opts Options) *Manager {
+	m := &Manager{
+		cfg:           cfg,
+		sysfs:         opts.Sysfs,
+		pciIds:        opts.PciIds,
+		clock:         opts.Clock,
+		newKubeClient: opts.KubeClient,
+		vfioDrivers:   cfg.Discovery.VFIODrivers,
+		discovery:     &discovery{},
+		stop:          make(chan struct{}),
+	}
+	if m.sysfs == nil {
+		root := cfg.Discovery.SysfsRoot
+		if root == "" {
+			root = "/sys"
+		}
+		m.sysfs = DirSysFS(root)
+	}
+	if m.clock == nil {
+		m.clock = clock.RealClock{}
+	}
+	if m.newKubeClient == nil {
+		m.newKubeClient = utils.NewKubeClient
+	}
+	m.devRoot = cfg.Discovery.DevRoot
+	if m.devRoot == "" {
+		m.devRoot = "/"
+	}
+	// Directory of the VFIO group nodes on the host
+	m.vfioDevicePath = filepath.Join(m.devRoot, "dev", "vfio")
+	if len(m.vfioDrivers) == 0 {
+		m.vfioDrivers = config.Default().Discovery.VFIODrivers
+	}
+	for _, name := range cfg.Backends.Names() {
+		backend, err := m.newBackend(name)
+		if err != nil {
+			log.Printf("Error creating device backend: %v", err)
+			continue
+		}
+		m.backends = append(m.backends, backend)
+	}
+	return m
+}
+
+// Run discovers the devices and serves them until Shutdown is called. A
+// manager runs only once.
+func (m *Manager) Run() {
+	cfg := m.cfg
+	m.ledger = newAllocationLedger(cfg.Ledger.CheckpointPath, cfg.Ledger.GracePeriod, m.clock, m.deviceInUse)
+	m.startEvents()
+	defer m.events.Shutdown()
+	if cfg.Cordon.File != "" {
+		m.cordons = newCordonManager(cfg.Cordon.File, m.clock, m.groupDevices)
+	}
+
+	if cfg.Metrics.ListenAddress != "" {
+		go serveMetrics(cfg.Metrics.ListenAddress)
+	}
+
+	if cfg.Admin.Socket != "" {
+		admin := newAdminServer(cfg.Admin.Socket, m)
+		if err := admin.Start(); err != nil {
+			log.Printf("Error starting admin API: %v", err)
+		} else {
+			m.admin = admin
+			defer admin.Stop()
+		}
+	}
+
+	// The checks are about the VFIO setup, simulated devices need none of it
+	if cfg.Preflight.Enabled && m.usesHostDevices() && !m.runPreflight() {
+		log.Printf("Preflight checks failed, not advertising any device")
+		<-m.stop
+		return
+	}
+
+	//Identifies the devices of every backend
+	resources := m.backendResources()
+
+	// Generate cdi spec for the devices
+	m.writeCDISpec()
+
+	// Publish the inventory as node features for NFD
+	m.updateNodeFeatures(m.current())
+	defer m.removeNodeFeatures()
+
+	if cfg.Frontend == config.FrontendDRA {
+		// Serves the devices through the DRA kubelet plugin API
+		m.runDRAPlugin()
+		return
+	}
+
+	//Creates and starts device plugin
+	m.createDevicePlugins(resources)
+}
+
+// Shutdown stops the device plugins started by Run, which then returns
+func (m *Manager) Shutdown() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// Config returns the configuration of the manager
+func (m *Manager) Config() *config.Config {
+	return m.cfg
+}
+
+// current returns the outcome of the last discovery, never modified
+func (m *Manager) current() *discovery {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.discovery
+}
+
+// groupDevices returns the functions of every discovered IOMMU group
+func (m *Manager) groupDevices() map[string][]NvidiaGpuDevice {
+	return m.current().iommuMap
+}
+
+// Starts a device plugin per resource of every backend
+func (m *Manager) createDevicePlugins(resources map[DeviceBackend][]BackendResource) {
+	var devicePlugins []*GenericDevicePlugin
+	for _, backend := range m.backends {
+		for _, res := range resources[backend] {
+			log.Printf("Device Plugin Name %s, %s backend, %d devices", res.Name, backend.Name(), len(res.Devices))
+			dp := m.NewGenericDevicePlugin(backend, res.Name, res.Devices)
+			err := dp.Start(m.stop)
+			if err != nil {
+				log.Printf("Error starting %s device plugin: %v", dp.devpluginName, err)
+				continue
+			}
+			devicePlugins = append(devicePlugins, dp)
+			// Outlives the restarts of the plugin after kubelet restarts
+			go backend.WatchHealth(res.Name, dp.state, m.stop)
+		}
+	}
+
+	m.statusMu.Lock()
+	m.plugins = devicePlugins
+	m.statusMu.Unlock()
+
+	go m.runLedgerReconciler(devicePlugins)
+	if m.cordons != nil {
+		m.cordons.SetPlugins(devicePlugins)
+		go m.cordons.Run(m.stop)
+	}
+
+	<-m.stop
+	log.Printf("Shutting down device plugin controller")
+	for _, v := range devicePlugins {
+		v.Stop()
+	}
+}
+
+// Writes the NFD feature file for the inventory of a discovery
+func (m *Manager) updateNodeFeatures(d *discovery) {
+	if !m.cfg.NodeFeatures.Enabled {
+		return
+	}
+	m.featuresMu.Lock()
+	defer m.featuresMu.Unlock()
+	if err := m.writeNodeFeatures(m.cfg.NodeFeatures.FeaturesDir, d); err != nil {
+		log.Printf("Error writing node features to %s: %v", m.cfg.NodeFeatures.FeaturesDir, err)
+	}
+}
+
+// refreshNodeFeatures rediscovers the devices for the NFD feature file. The
+// health of devices changes when they are unbound, rebound or removed, the
+// labels follow without replacing the discovery the plugins serve.
+func (m *Manager) refreshNodeFeatures() {
+	if !m.cfg.NodeFeatures.Enabled {
+		return
+	}
+	m.updateNodeFeatures(m.scan())
+}
+
+// Removes the NFD feature file, the labels go away with the plugin
+func (m *Manager) removeNodeFeatures() {
+	if !m.cfg.NodeFeatures.Enabled {
+		return
+	}
+	m.featuresMu.Lock()
+	defer m.featuresMu.Unlock()
+	removeNodeFeatures(m.cfg.NodeFeatures.FeaturesDir)
+}
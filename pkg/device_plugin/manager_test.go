@@ -0,0 +1,211 @@
+package device_plugin
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"kata-xpu-device-plugin/internal/harness"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+const (
+	gpuResource = "nvidia.com/GH100_H100_SXM5_80GB"
+	testTimeout = 10 * time.Second
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("KATA_XPU_TEST_LOGS") == "" {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// newEnvironment lays out an empty harness environment. The directory is
+// kept short, the sockets below it must fit in a unix socket address.
+func newEnvironment(t *testing.T) *harness.Environment {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "kata-xpu-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := harness.NewEnvironment(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { env.Close() })
+	return env
+}
+
+// newHGXEnvironment has two GPUs and one NVSwitch on NUMA node 0 in IOMMU
+// groups 10 to 12, and two GPUs on node 1 in groups 20 and 21, partitioned
+// by NUMA node with the NVSwitches passed through
+func newHGXEnvironment(t *testing.T) *harness.Environment {
+	t.Helper()
+	env := newEnvironment(t)
+	if err := env.AddHGXBoard(0x18, 10, 0, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.AddHGXBoard(0x40, 20, 1, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	env.Config.Fabric.Mode = config.FabricModeInclude
+	env.Config.Fabric.PartitionBy = config.PartitionByNuma
+	return env
+}
+
+// runManager runs a manager of the environment until the end of the test,
+// with the fake API server of the environment
+func runManager(t *testing.T, env *harness.Environment) *Manager {
+	t.Helper()
+	m := NewManager(env.Config, Options{
+		KubeClient: func(string) (kubernetes.Interface, error) {
+			return env.KubeClient, nil
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		m.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		m.Shutdown()
+		<-done
+	})
+	return m
+}
+
+// startDevicePlugins starts the fake kubelet and a manager, and connects to
+// the device plugin of resource once it registered
+func startDevicePlugins(t *testing.T, env *harness.Environment, resource string) (*Manager, *harness.PluginClient) {
+	t.Helper()
+	if err := env.Kubelet.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m := runManager(t, env)
+	reg, err := env.Kubelet.WaitForRegistration(resource, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := env.Kubelet.Dial(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return m, client
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// watchDevices opens a ListAndWatch stream and returns it with the first
+// device list
+func watchDevices(t *testing.T, ctx context.Context, client *harness.PluginClient) (<-chan []*pluginapi.Device, []*pluginapi.Device) {
+	t.Helper()
+	updates, err := client.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case devices := <-updates:
+		return updates, devices
+	case <-ctx.Done():
+		t.Fatal("no device list received")
+	}
+	return nil, nil
+}
+
+// waitForHealth reads device lists until the device has the given health
+func waitForHealth(t *testing.T, ctx context.Context, updates <-chan []*pluginapi.Device, id string, health string) {
+	t.Helper()
+	for {
+		select {
+		case devices, ok := <-updates:
+			if !ok {
+				t.Fatal("ListAndWatch stream closed")
+			}
+			for _, dev := range devices {
+				if dev.ID == id && dev.Health == health {
+					return
+				}
+			}
+		case <-ctx.Done():
+			t.Fatalf("device %s did not become %s", id, health)
+		}
+	}
+}
+
+// expectRejected allocates the devices and checks the gRPC code and the
+// reason of the ErrorInfo detail of the error
+func expectRejected(t *testing.T, ctx context.Context, client *harness.PluginClient, code codes.Code, reason string, ids ...string) {
+	t.Helper()
+	_, err := client.Allocate(ctx, ids...)
+	st, ok := status.FromError(err)
+	if err == nil || !ok || st.Code() != code {
+		t.Fatalf("allocating %v: expected %s, got %v", ids, code, err)
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Reason == reason {
+			return
+		}
+	}
+	t.Fatalf("allocating %v: expected reason %s, got %v", ids, reason, st.Details())
+}
+
+// waitForEvent polls the fake API server for an event with the given reason
+// on the node of the environment
+func waitForEvent(t *testing.T, ctx context.Context, env *harness.Environment, reason string) {
+	t.Helper()
+	for {
+		list, err := env.KubeClient.CoreV1().Events(metav1.NamespaceDefault).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range list.Items {
+			if event.Reason == reason && event.InvolvedObject.Name == env.Config.NodeName {
+				return
+			}
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("no %s event recorded", reason)
+		}
+	}
+}
+
+func TestIndependentManagers(t *testing.T) {
+	env := newHGXEnvironment(t)
+	m, _ := startDevicePlugins(t, env, gpuResource)
+
+	other := newEnvironment(t)
+	if err := other.AddHGXBoard(0x80, 30, 0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(NewManager(other.Config, Options{}).Discover().Devices); n != 1 {
+		t.Fatalf("expected 1 GPU in the other environment, discovered %d", n)
+	}
+	if n := len(m.Inventory()); n != 4 {
+		t.Fatalf("running manager lost its inventory, %d GPUs left", n)
+	}
+}
+
+// cdiSpecPath is where Run writes the CDI spec of the environment
+func cdiSpecPath(env *harness.Environment) string {
+	return filepath.Join(env.Config.CDI.SpecDir, CDISpecName+".yaml")
+}
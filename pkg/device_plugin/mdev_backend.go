@@ -0,0 +1,287 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// Prefix of the CDI device names of mediated devices, never a PCI index
+const mdevCDIPrefix = "mdev-"
+
+// Characters not allowed in a resource name
+var mdevResourceInvalid = regexp.MustCompile("[^A-Z0-9_-]+")
+
+// mediatedDevice is an mdev created on an NVIDIA function, e.g. a vGPU. Its
+// device ID is its UUID.
+type mediatedDevice struct {
+	uuid     string
+	typeID   string // e.g. nvidia-35
+	parent   string // PCI address of the parent function
+	group    string // IOMMU group of the mdev, its own
+	numaNode int
+	resource string
+}
+
+// mdevBackend passes the mediated devices created on NVIDIA functions
+// through, one resource per mdev type. The mdevs are created by the
+// administrator or the vGPU manager, the backend only hands them out.
+type mdevBackend struct {
+	m *Manager
+
+	mu    sync.RWMutex
+	mdevs map[string]mediatedDevice // by UUID
+}
+
+func (b *mdevBackend) Name() string {
+	return config.BackendMdev
+}
+
+// mdevResourceName names the resource of an mdev type after its name, e.g.
+// "GRID H100-4C" becomes GRID_H100-4C
+func mdevResourceName(typeName string) string {
+	name := strings.Join(strings.Fields(strings.ToUpper(typeName)), "_")
+	name = strings.NewReplacer("/", "_", ".", "_").Replace(name)
+	return mdevResourceInvalid.ReplaceAllString(name, "")
+}
+
+// readMdev reads the type, parent and IOMMU group of a mediated device
+func (m *Manager) readMdev(uuid string) (mediatedDevice, error) {
+	dir := path.Join(mdevDevicesDir, uuid)
+	mdev := mediatedDevice{uuid: uuid}
+	// The mdev lives in the directory of its parent function
+	target, err := m.sysfs.ReadLink(dir)
+	if err != nil {
+		return mdev, err
+	}
+	mdev.parent = filepath.Base(filepath.Dir(target))
+	typeLink, err := m.sysfs.ReadLink(path.Join(dir, "mdev_type"))
+	if err != nil {
+		return mdev, fmt.Errorf("failed to read the type of mdev %s: %v", uuid, err)
+	}
+	mdev.typeID = filepath.Base(typeLink)
+	group, err := m.sysfs.ReadLink(path.Join(dir, "iommu_group"))
+	if err != nil {
+		return mdev, fmt.Errorf("failed to read the IOMMU group of mdev %s: %v", uuid, err)
+	}
+	mdev.group = filepath.Base(group)
+
+	mdev.resource = mdev.typeID
+	if data, err := m.sysfs.ReadFile(path.Join(dir, "mdev_type", "name")); err == nil {
+		if name := mdevResourceName(string(data)); name != "" {
+			mdev.resource = name
+		}
+	}
+	return mdev, nil
+}
+
+// nodeFeatures flags the models of the parents of the mdevs as mdev capable
+func (b *mdevBackend) nodeFeatures() map[string]string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	features := map[string]string{}
+	for _, mdev := range b.mdevs {
+		if model, ok := b.m.functionModel(mdev.parent); ok {
+			features["device."+model+".mdev"] = "true"
+		}
+	}
+	return features
+}
+
+// Discover lists the mediated devices whose parent is an NVIDIA function
+// passing the filters, one resource per mdev type
+func (b *mdevBackend) Discover() ([]BackendResource, error) {
+	m := b.m
+	entries, err := m.sysfs.ReadDir(mdevDevicesDir)
+	if err != nil {
+		// No mdev was ever created, or the mdev module is not loaded
+		log.Printf("No mediated devices found in %s: %v", mdevDevicesDir, err)
+		entries = nil
+	}
+
+	mdevs := map[string]mediatedDevice{}
+	byResource := map[string]*BackendResource{}
+	for _, entry := range entries {
+		mdev, err := m.readMdev(entry.Name())
+		if err != nil {
+			log.Printf("Skipping mdev %s: %v", entry.Name(), err)
+			continue
+		}
+		vendorID, err := m.readID(mdev.parent, "vendor")
+		if err != nil || vendorID != nvidiaVendorID {
+			continue
+		}
+		deviceID, _ := m.readID(mdev.parent, "device")
+		class, _ := m.readID(mdev.parent, "class")
+		driver, _ := m.readLink(mdev.parent, "driver")
+		fn := PCIFunction{BDF: mdev.parent, VendorID: vendorID, DeviceID: deviceID, Class: class, Driver: driver}
+		if reason := filterReason(fn, m.cfg.Discovery.Filters); reason != "" {
+			log.Printf("Skipping mdev %s of device %s: %s", mdev.uuid, mdev.parent, reason)
+			continue
+		}
+		mdev.numaNode = m.readNumaNode(mdev.parent)
+
+		mdevs[mdev.uuid] = mdev
+		res, ok := byResource[mdev.resource]
+		if !ok {
+			res = &BackendResource{Name: mdev.resource}
+			byResource[mdev.resource] = res
+		}
+		pdev := &pluginapi.Device{ID: mdev.uuid, Health: pluginapi.Healthy}
+		if mdev.numaNode >= 0 {
+			pdev.Topology = &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: int64(mdev.numaNode)}}}
+		}
+		res.Devices = append(res.Devices, pdev)
+	}
+
+	b.mu.Lock()
+	b.mdevs = mdevs
+	b.mu.Unlock()
+	resources := make([]BackendResource, 0, len(byResource))
+	for _, res := range byResource {
+		resources = append(resources, *res)
+	}
+	return sortedResources(resources), nil
+}
+
+func (b *mdevBackend) mdev(id string) (mediatedDevice, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	mdev, ok := b.mdevs[id]
+	return mdev, ok
+}
+
+// sortedIDs returns the UUIDs of the mdevs of resource, or of every mdev
+// when resource is empty, ordered by IOMMU group
+func (b *mdevBackend) sortedIDs(resource string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ids := []string{}
+	for id, mdev := range b.mdevs {
+		if resource == "" || mdev.resource == resource {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return lessIommuGroup(b.mdevs[ids[i]].group, b.mdevs[ids[j]].group)
+	})
+	return ids
+}
+
+// CDIDevices describes one CDI device per mdev. Kata finds the mdev through
+// the VFIO node of its IOMMU group, there is no PCI address to annotate.
+func (b *mdevBackend) CDIDevices() []CDIDevice {
+	var devices []CDIDevice
+	for _, id := range b.sortedIDs("") {
+		mdev, _ := b.mdev(id)
+		name := mdevCDIPrefix + id
+		annotations := map[string]string{
+			"attach-pci":                   "true",
+			cdihandler.MdevUUIDAnnotation:  mdev.uuid,
+			cdihandler.MdevTypeAnnotation:  mdev.typeID,
+			cdihandler.ParentBDFAnnotation: mdev.parent,
+		}
+		addKataAnnotations(b.m.cfg.Kata, annotations, fmt.Sprintf("%s/%s", DevicePluginNamespace, mdev.resource), 1)
+		annotations[fmt.Sprintf("%svfio%s", cdihandler.CdiK8SPrefix, mdev.group)] = fmt.Sprintf("%s=%s", cdihandler.DefaultKind, name)
+		devices = append(devices, CDIDevice{
+			Resource:    mdev.resource,
+			Name:        name,
+			Annotations: annotations,
+			DeviceNodes: []string{fmt.Sprintf("/dev/vfio/%s", mdev.group)},
+		})
+	}
+	return devices
+}
+
+// WatchHealth marks an mdev unhealthy while its VFIO group node is missing
+func (b *mdevBackend) WatchHealth(resource string, devices HealthReporter, stop <-chan struct{}) {
+	groups := map[string]string{}
+	for _, id := range b.sortedIDs(resource) {
+		mdev, _ := b.mdev(id)
+		groups[id] = mdev.group
+	}
+	b.m.watchVFIONodes(resource, groups, devices, stop)
+}
+
+// ValidateAllocation checks that the mdevs still exist in their IOMMU group
+func (b *mdevBackend) ValidateAllocation(resource string, ids []string) error {
+	for _, id := range ids {
+		mdev, ok := b.mdev(id)
+		switch {
+		case !ok:
+			return allocationError(codes.NotFound, AllocationReasonUnknownDevice, id, "",
+				"invalid allocation request: unknown device %s", id)
+		case mdev.resource != resource:
+			return allocationError(codes.NotFound, AllocationReasonOtherResource, id, mdev.parent,
+				"invalid allocation request: device %s is not a %s/%s", id, DevicePluginNamespace, resource)
+		}
+		actual, err := b.m.readMdev(id)
+		if err != nil || actual.group != mdev.group {
+			return allocationError(codes.FailedPrecondition, AllocationReasonGroupChanged, id, mdev.parent,
+				"mdev %s was removed or its IOMMU group has changed on the system", id)
+		}
+		if actual.typeID != mdev.typeID {
+			return allocationError(codes.FailedPrecondition, AllocationReasonDeviceChanged, id, mdev.parent,
+				"type of mdev %s has changed on the system", id)
+		}
+		if _, err := os.Stat(filepath.Join(b.m.vfioDevicePath, mdev.group)); err != nil {
+			return allocationError(codes.FailedPrecondition, AllocationReasonVFIONodeMissing, id, mdev.parent,
+				"VFIO group node of device %s is missing: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// Allocate returns the CDI devices of the mdevs
+func (b *mdevBackend) Allocate(resource string, ids []string) ([]string, error) {
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, cdihandler.QualifiedName("nvidia.com", "gpu", mdevCDIPrefix+id))
+	}
+	return names, nil
+}
+
+// PreferredAllocation keeps the mdevs on the NUMA node of the first one
+func (b *mdevBackend) PreferredAllocation(resource string, available, mustInclude []string, size int) []string {
+	return numaPreferredAllocation(available, mustInclude, size, func(id string) int {
+		mdev, ok := b.mdev(id)
+		if !ok {
+			return -1
+		}
+		return mdev.numaNode
+	})
+}
+
+// PreStart does not reset mdevs, a function level reset of the parent would
+// hit every other mdev of the GPU
+func (b *mdevBackend) PreStart(resource string, ids []string) error {
+	log.Printf("[%s] Skipping the reset of mediated devices %v", resource, ids)
+	return nil
+}
+
+// InUse is always false: sysfs does not tell whether an mdev is opened, and
+// probing its VFIO group would race with a VMM opening it
+func (b *mdevBackend) InUse(id string) (bool, error) {
+	return false, nil
+}
+
+// Location names the mdev with its type and parent function
+func (b *mdevBackend) Location(id string) string {
+	mdev, ok := b.mdev(id)
+	if !ok {
+		return "mdev " + id
+	}
+	return fmt.Sprintf("mdev %s (%s) on %s", id, mdev.typeID, mdev.parent)
+}
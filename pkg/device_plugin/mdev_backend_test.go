@@ -0,0 +1,79 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/internal/harness"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+const (
+	mdevResource = "nvidia.com/GRID_H100-4C"
+	mdevA        = "0b3d5a1e-3f1c-4c56-9a0e-2f3b9f1a7c01"
+	mdevB        = "6f9e2c4d-8a7b-4e21-b5d3-1c0a9e8f7d02"
+)
+
+func TestMdevBackend(t *testing.T) {
+	env := newEnvironment(t)
+	err := env.Sysfs.AddDevice(harness.PCIDevice{
+		BDF: "0000:41:00.0", Vendor: "10de", Device: harness.H100SXM5Device, Class: "030200",
+		Driver: "nvidia", IommuGroup: 30, NumaNode: 0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, uuid := range []string{mdevA, mdevB} {
+		if err := env.Sysfs.AddMdev("0000:41:00.0", uuid, "nvidia-1", "GRID H100-4C", 40+i); err != nil {
+			t.Fatal(err)
+		}
+		if err := env.AddVFIOGroup(40 + i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.Config.Backends.Default = config.BackendMdev
+	m, client := startDevicePlugins(t, env, mdevResource)
+	ctx := testContext(t)
+
+	spec, err := cdihandler.Load(cdiSpecPath(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Devices) != 2 || spec.Devices[0].Name != "mdev-"+mdevA {
+		t.Fatalf("expected the CDI devices of the 2 mdevs, got %v", spec.Devices)
+	}
+	if errs := m.ValidateCDISpec(spec, env.Dir); len(errs) != 0 {
+		t.Fatalf("invalid mdev CDI spec: %v", errs)
+	}
+	annotations := spec.Devices[0].Annotations
+	if annotations[cdihandler.MdevTypeAnnotation] != "nvidia-1" || annotations[cdihandler.ParentBDFAnnotation] != "0000:41:00.0" {
+		t.Fatalf("unexpected mdev annotations %v", annotations)
+	}
+
+	updates, devices := watchDevices(t, ctx, client)
+	if len(devices) != 2 {
+		t.Fatalf("unexpected mdev devices %v", devices)
+	}
+
+	resp, err := client.Allocate(ctx, mdevA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.CDIDevices) != 1 || resp.CDIDevices[0].Name != "nvidia.com/gpu=mdev-"+mdevA {
+		t.Fatalf("unexpected mdev CDI devices %v", resp.CDIDevices)
+	}
+	if err := client.PreStartContainer(ctx, mdevA); err != nil {
+		t.Fatal(err)
+	}
+	expectRejected(t, ctx, client, codes.NotFound, AllocationReasonUnknownDevice, "40")
+
+	if err := os.Remove(filepath.Join(env.Dir, "dev", "vfio", "41")); err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(t, ctx, updates, mdevB, pluginapi.Unhealthy)
+}
@@ -0,0 +1,56 @@
+package device_plugin
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "kata_xpu_device_plugin"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	ledgerAllocations = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ledger_allocations",
+		Help:      "Number of devices recorded as allocated in the allocation ledger.",
+	})
+	ledgerLeakedGroups = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ledger_leaked_iommu_groups",
+		Help:      "Number of IOMMU groups in use without being assigned to any pod.",
+	})
+	ledgerDoubleAssignedGroups = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ledger_double_assigned_iommu_groups",
+		Help:      "Number of IOMMU groups assigned to more than one pod.",
+	})
+	ledgerReconcileErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ledger_reconcile_errors_total",
+		Help:      "Number of failed reconciliations against the pod-resources API.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		ledgerAllocations,
+		ledgerLeakedGroups,
+		ledgerDoubleAssignedGroups,
+		ledgerReconcileErrors,
+	)
+}
+
+// serveMetrics exposes the plugin metrics over HTTP on the given address
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	log.Printf("Serving metrics on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Printf("Error serving metrics: %v", err)
+	}
+}
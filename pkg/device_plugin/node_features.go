@@ -0,0 +1,168 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"kata-xpu-device-plugin/pkg/version"
+)
+
+const (
+	// nodeFeatureFile is the name of the NFD local feature file owned by the plugin
+	nodeFeatureFile = "kata-xpu-device-plugin"
+	// nodeFeaturePrefix prefixes every feature; NFD adds its own label namespace
+	nodeFeaturePrefix = "kata-xpu."
+	// NFD rejects label values longer than this
+	maxFeatureValueLength = 63
+	// iommufdDevicePath is the iommufd node, relative to the dev root
+	iommufdDevicePath = "dev/iommu"
+)
+
+// featureBackend is implemented by the backends whose devices add node
+// features, beyond the VFIO functions of the discovery
+type featureBackend interface {
+	// nodeFeatures returns the features of the last discovery of the backend
+	nodeFeatures() map[string]string
+}
+
+// nodeFeatures derives the NFD local features from the discovered devices
+// and the inventories of the backends
+func (m *Manager) nodeFeatures(d *discovery) map[string]string {
+	iommuMap := d.iommuMap
+	features := map[string]string{
+		"present":        strconv.FormatBool(len(iommuMap) > 0),
+		"count":          strconv.Itoa(len(iommuMap)),
+		"plugin-version": featureValue(version.Version),
+		"iommufd":        strconv.FormatBool(pathExists(filepath.Join(m.devRoot, iommufdDevicePath))),
+	}
+
+	vendors := map[string]int{}
+	models := map[string]int{}
+	numaNodes := map[int]int{}
+	iommuModes := map[string]bool{}
+	for _, devs := range iommuMap {
+		if len(devs) == 0 {
+			continue
+		}
+		// The first function of the group is the one advertised
+		dev := devs[0]
+		model := fmt.Sprintf("%s-%s", dev.vendorID, dev.deviceID)
+		vendors[dev.vendorID]++
+		models[model]++
+		if dev.numaNode >= 0 {
+			numaNodes[dev.numaNode]++
+		}
+
+		if _, ok := features["device."+model+".name"]; !ok {
+			if name := m.deviceName(dev.deviceID); name != "" {
+				features["device."+model+".name"] = featureValue(name)
+			}
+		}
+		if mode, err := readAttribute(m.sysfs, dev.addr, "iommu_group", "type"); err == nil {
+			iommuModes[mode] = true
+		}
+	}
+
+	for vendor, count := range vendors {
+		features["vendor."+vendor+".count"] = strconv.Itoa(count)
+	}
+	for model, count := range models {
+		features["device."+model+".count"] = strconv.Itoa(count)
+	}
+	for node, count := range numaNodes {
+		features["numa."+strconv.Itoa(node)+".count"] = strconv.Itoa(count)
+	}
+	features["numa.nodes"] = strconv.Itoa(len(numaNodes))
+	if len(iommuModes) > 0 {
+		modes := []string{}
+		for mode := range iommuModes {
+			modes = append(modes, mode)
+		}
+		sort.Strings(modes)
+		features["iommu-mode"] = featureValue(strings.Join(modes, "_"))
+	}
+
+	for _, backend := range m.backends {
+		if fb, ok := backend.(featureBackend); ok {
+			for key, value := range fb.nodeFeatures() {
+				features[key] = value
+			}
+		}
+	}
+	return features
+}
+
+// functionModel returns the vendor-device model of a PCI function, as used
+// in the feature names
+func (m *Manager) functionModel(deviceAddress string) (string, bool) {
+	vendorID, err := m.readID(deviceAddress, "vendor")
+	if err != nil {
+		return "", false
+	}
+	deviceID, err := m.readID(deviceAddress, "device")
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%s-%s", vendorID, deviceID), true
+}
+
+// writeNodeFeatures atomically writes the NFD local feature file into dir
+func (m *Manager) writeNodeFeatures(dir string, d *discovery) error {
+	features := m.nodeFeatures(d)
+	keys := make([]string, 0, len(features))
+	for key := range features {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by kata-xpu-device-plugin %s, do not edit\n", version.Version)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s%s=%s\n", nodeFeaturePrefix, key, features[key])
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, nodeFeatureFile)
+	// NFD may read the file at any time, never let it see a partial one
+	tmp := filepath.Join(dir, "."+nodeFeatureFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeNodeFeatures deletes the NFD local feature file from dir
+func removeNodeFeatures(dir string) {
+	path := filepath.Join(dir, nodeFeatureFile)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing node feature file %s: %v", path, err)
+	}
+}
+
+// featureValue sanitizes s into a valid label value
+func featureValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+	if len(s) > maxFeatureValueLength {
+		s = s[:maxFeatureValueLength]
+	}
+	return strings.Trim(s, "-_.")
+}
+
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
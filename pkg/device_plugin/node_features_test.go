@@ -0,0 +1,197 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"kata-xpu-device-plugin/internal/harness"
+	"kata-xpu-device-plugin/pkg/config"
+	"kata-xpu-device-plugin/pkg/version"
+)
+
+func TestNodeFeatures(t *testing.T) {
+	env := newHGXEnvironment(t)
+	m := NewManager(env.Config, Options{})
+	d := m.discover()
+
+	features := m.nodeFeatures(d)
+	expected := map[string]string{
+		"present":                "true",
+		"count":                  "4",
+		"device.10de-2330.count": "4",
+		"device.10de-2330.name":  "GH100_H100_SXM5_80GB",
+		"numa.0.count":           "2",
+		"numa.1.count":           "2",
+		"numa.nodes":             "2",
+		"iommufd":                "false",
+	}
+	for key, value := range expected {
+		if features[key] != value {
+			t.Errorf("expected feature %s=%s, got %q", key, value, features[key])
+		}
+	}
+	// No backend serves mdevs or VFs of the GPUs
+	for _, key := range []string{"device.10de-2330.mdev", "device.10de-2330.sriov"} {
+		if value, ok := features[key]; ok {
+			t.Errorf("unexpected feature %s=%s", key, value)
+		}
+	}
+
+	// The iommufd node is looked up below the dev root, not on the host
+	if err := os.WriteFile(filepath.Join(env.Dir, "dev", "iommu"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := env.Config.NodeFeatures.FeaturesDir
+	if err := m.writeNodeFeatures(dir, d); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, nodeFeatureFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "\nkata-xpu.iommufd=true\n") {
+		t.Fatalf("expected iommufd in the feature file, got:\n%s", data)
+	}
+	removeNodeFeatures(dir)
+	if _, err := os.Stat(filepath.Join(dir, nodeFeatureFile)); !os.IsNotExist(err) {
+		t.Fatalf("expected the feature file removed, got %v", err)
+	}
+}
+
+func TestNodeFeatureValues(t *testing.T) {
+	for value, expected := range map[string]string{
+		"v1.3.1":                 "v1.3.1",
+		"v1.4.0-rc.1+git/abc123": "v1.4.0-rc.1_git_abc123",
+		"GRID H100-4C":           "GRID_H100-4C",
+		"(unknown)":              "unknown",
+		strings.Repeat("a", 70):  strings.Repeat("a", maxFeatureValueLength),
+	} {
+		if got := featureValue(value); got != expected {
+			t.Errorf("featureValue(%q) = %q, expected %q", value, got, expected)
+		}
+	}
+
+	saved := version.Version
+	version.Version = "v1.4.0+dirty"
+	t.Cleanup(func() { version.Version = saved })
+	m := NewManager(newEnvironment(t).Config, Options{})
+	if value := m.nodeFeatures(m.discover())["plugin-version"]; value != "v1.4.0_dirty" {
+		t.Fatalf("expected the plugin version sanitized, got %q", value)
+	}
+}
+
+// TestBackendNodeFeatures checks that the mdev and SR-IOV capabilities come
+// from the devices the mdev and sriov-vf backends serve
+func TestBackendNodeFeatures(t *testing.T) {
+	env := newSRIOVEnvironment(t)
+	m := NewManager(env.Config, Options{})
+	m.backendResources()
+	features := m.nodeFeatures(m.current())
+	if features["device.10de-2330.sriov"] != "true" {
+		t.Fatalf("expected the model of the physical function SR-IOV capable, got %v", features)
+	}
+	if _, ok := features["device.10de-2330.mdev"]; ok {
+		t.Fatalf("unexpected mdev feature %v", features)
+	}
+
+	env = newEnvironment(t)
+	err := env.Sysfs.AddDevice(harness.PCIDevice{
+		BDF: "0000:41:00.0", Vendor: "10de", Device: harness.H100SXM5Device, Class: "030200",
+		Driver: "nvidia", IommuGroup: 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Sysfs.AddMdev("0000:41:00.0", mdevA, "nvidia-1", "GRID H100-4C", 40); err != nil {
+		t.Fatal(err)
+	}
+	env.Config.Backends.Default = config.BackendMdev
+	m = NewManager(env.Config, Options{})
+	m.backendResources()
+	features = m.nodeFeatures(m.current())
+	if features["device.10de-2330.mdev"] != "true" {
+		t.Fatalf("expected the model of the parent mdev capable, got %v", features)
+	}
+	if _, ok := features["device.10de-2330.sriov"]; ok {
+		t.Fatalf("unexpected SR-IOV feature %v", features)
+	}
+}
+
+// waitForFeature waits until the feature file holds the line
+func waitForFeature(t *testing.T, env *harness.Environment, line string) {
+	t.Helper()
+	path := filepath.Join(env.Config.NodeFeatures.FeaturesDir, nodeFeatureFile)
+	deadline := time.Now().Add(testTimeout)
+	for {
+		data, _ := os.ReadFile(path)
+		if strings.Contains(string(data), "\n"+line+"\n") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no %s in the feature file, got:\n%s", line, data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForFeaturesRemoved waits until the feature file is gone
+func waitForFeaturesRemoved(t *testing.T, env *harness.Environment) {
+	t.Helper()
+	path := filepath.Join(env.Config.NodeFeatures.FeaturesDir, nodeFeatureFile)
+	deadline := time.Now().Add(testTimeout)
+	for pathExists(path) {
+		if time.Now().After(deadline) {
+			t.Fatal("feature file not removed on shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestNodeFeaturesRediscovery checks that the features follow a device
+// removed from the host, and go away with the plugin
+func TestNodeFeaturesRediscovery(t *testing.T) {
+	env := newHGXEnvironment(t)
+	env.Config.NodeFeatures.Enabled = true
+	m, client := startDevicePlugins(t, env, gpuResource)
+	ctx := testContext(t)
+	waitForFeature(t, env, "kata-xpu.count=4")
+
+	updates, _ := watchDevices(t, ctx, client)
+	if err := env.Sysfs.RemoveDevice(m.current().iommuMap["21"][0].addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(env.Dir, "dev", "vfio", "21")); err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(t, ctx, updates, "21", pluginapi.Unhealthy)
+	waitForFeature(t, env, "kata-xpu.count=3")
+	waitForFeature(t, env, "kata-xpu.numa.1.count=1")
+	// The plugins keep serving the discovery of the startup
+	if n := len(m.current().iommuMap); n != 4 {
+		t.Fatalf("expected the served discovery untouched, got %d groups", n)
+	}
+
+	m.Shutdown()
+	waitForFeaturesRemoved(t, env)
+}
+
+// TestNodeFeaturesDRA checks that the DRA frontend removes the features on
+// shutdown too
+func TestNodeFeaturesDRA(t *testing.T) {
+	env := newHGXEnvironment(t)
+	env.Config.NodeFeatures.Enabled = true
+	env.Config.Frontend = config.FrontendDRA
+	m := runManager(t, env)
+	if _, err := env.PluginWatcher.WaitForPlugin(env.Config.DRA.DriverName, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	waitForFeature(t, env, "kata-xpu.count=4")
+
+	m.Shutdown()
+	waitForFeaturesRemoved(t, env)
+}
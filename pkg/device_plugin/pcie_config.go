@@ -0,0 +1,64 @@
+package device_plugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// PCIe extended capability IDs
+const (
+	extCapDSN   = 0x0003
+	extCapATS   = 0x000f
+	extCapPRI   = 0x0013
+	extCapPASID = 0x001b
+	// Extended capabilities start after the 256 bytes of legacy config space
+	extCapStart = 0x100
+)
+
+// readExtCapabilities walks the PCIe extended capability list of the config
+// space and returns the offset of every capability found, by ID. Reading
+// past the first 64 bytes of the config file needs root.
+func (m *Manager) readExtCapabilities(deviceAddress string) (map[uint16]int, error) {
+	config, err := m.sysfs.ReadFile(devicePath(deviceAddress, "config"))
+	if err != nil {
+		return nil, err
+	}
+	return extCapabilities(config), nil
+}
+
+func extCapabilities(config []byte) map[uint16]int {
+	caps := map[uint16]int{}
+	offset := extCapStart
+	// Bound the walk, a corrupted list could loop
+	for i := 0; i < 64 && offset >= extCapStart && offset+4 <= len(config); i++ {
+		header := binary.LittleEndian.Uint32(config[offset : offset+4])
+		if header == 0 || header == 0xffffffff {
+			break
+		}
+		caps[uint16(header&0xffff)] = offset
+		offset = int(header>>20) & 0xffc
+	}
+	return caps
+}
+
+// readSerialNumber returns the PCIe Device Serial Number of the function,
+// formatted like lspci does, e.g. 48-b0-2d-ff-ff-d1-8a-5c. It is empty when
+// the function has no DSN capability or the config space cannot be read.
+func (m *Manager) readSerialNumber(deviceAddress string) string {
+	config, err := m.sysfs.ReadFile(devicePath(deviceAddress, "config"))
+	if err != nil {
+		return ""
+	}
+	offset, ok := extCapabilities(config)[extCapDSN]
+	if !ok || offset+12 > len(config) {
+		return ""
+	}
+	// The lower dword comes first, lspci prints the most significant byte first
+	serial := uint64(binary.LittleEndian.Uint32(config[offset+8:]))<<32 | uint64(binary.LittleEndian.Uint32(config[offset+4:]))
+	bytes := make([]string, 8)
+	for i := range bytes {
+		bytes[i] = fmt.Sprintf("%02x", byte(serial>>(56-8*i)))
+	}
+	return strings.Join(bytes, "-")
+}
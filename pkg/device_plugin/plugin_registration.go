@@ -0,0 +1,94 @@
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// registrationServer serves the kubelet plugin watcher registration API on a
+// socket of the plugins_registry directory. Kubelet discovers the socket,
+// calls GetInfo and reports the outcome through NotifyRegistrationStatus.
+type registrationServer struct {
+	info       registerapi.PluginInfo
+	socketPath string
+	server     *grpc.Server
+	// onStatus, when set, receives every registration status kubelet reports
+	onStatus func(*registerapi.RegistrationStatus)
+
+	mu         sync.Mutex
+	registered bool
+	lastError  string
+}
+
+func newRegistrationServer(socketPath string, info registerapi.PluginInfo) *registrationServer {
+	return &registrationServer{
+		info:       info,
+		socketPath: socketPath,
+	}
+}
+
+// Start serves the registration API, kubelet picks it up asynchronously
+func (r *registrationServer) Start() error {
+	if err := os.Remove(r.socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	sock, err := net.Listen("unix", r.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on registration socket %s: %v", r.socketPath, err)
+	}
+
+	r.server = grpc.NewServer()
+	registerapi.RegisterRegistrationServer(r.server, r)
+	go r.server.Serve(sock)
+
+	log.Printf("[%s] Registration socket ready at %s", r.info.Name, r.socketPath)
+	return nil
+}
+
+// Stop stops serving and removes the socket, which unregisters the plugin
+func (r *registrationServer) Stop() {
+	if r.server != nil {
+		r.server.Stop()
+		r.server = nil
+	}
+	if err := os.Remove(r.socketPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("[%s] Error removing registration socket: %v", r.info.Name, err)
+	}
+}
+
+// Status returns whether kubelet accepted the plugin and its last error
+func (r *registrationServer) Status() (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.registered, r.lastError
+}
+
+func (r *registrationServer) GetInfo(ctx context.Context, req *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	info := r.info
+	return &info, nil
+}
+
+func (r *registrationServer) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	r.mu.Lock()
+	r.registered = status.PluginRegistered
+	r.lastError = status.Error
+	r.mu.Unlock()
+
+	if status.PluginRegistered {
+		log.Printf("[%s] Registered with kubelet", r.info.Name)
+	} else {
+		log.Printf("[%s] Registration with kubelet failed: %s", r.info.Name, status.Error)
+	}
+	if r.onStatus != nil {
+		r.onStatus(status)
+	}
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
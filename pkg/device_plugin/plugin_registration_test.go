@@ -0,0 +1,119 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+
+	"kata-xpu-device-plugin/internal/harness"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// TestPluginWatcherRegistration registers simulated resources through the
+// plugins_registry directory instead of kubelet.sock, one of them rejected by
+// kubelet, and restarts the plugin watcher like a kubelet restart
+func TestPluginWatcherRegistration(t *testing.T) {
+	env := newEnvironment(t)
+	env.Config.Kubelet.Registration = config.RegistrationPluginWatcher
+	env.Config.Backends.Default = config.BackendSimulated
+	env.Config.Backends.Simulated.Models = []config.SimulatedModel{
+		{Name: "SIM_A", Count: 2},
+		{Name: "SIM_B", Count: 1},
+	}
+	env.PluginWatcher.Reject["nvidia.com/SIM_B"] = "resource name not allowed"
+	runManager(t, env)
+	ctx := testContext(t)
+
+	info, err := env.PluginWatcher.WaitForPlugin("nvidia.com/SIM_A", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.PluginWatcher.WaitForPlugin("nvidia.com/SIM_B", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != registerapi.DevicePlugin || len(info.SupportedVersions) != 1 || info.SupportedVersions[0] != pluginapi.Version {
+		t.Fatalf("unexpected plugin info %+v", info)
+	}
+	client, err := harness.DialPlugin(info.Endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, devices := watchDevices(t, ctx, client); len(devices) != 2 {
+		t.Fatalf("expected 2 devices, got %v", devices)
+	}
+
+	status, err := QueryStatus(env.Config.Admin.Socket, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Plugins) != 2 || !status.Plugins[0].Registered ||
+		status.Plugins[1].Registered || !strings.Contains(status.Plugins[1].RegistrationError, "resource name not allowed") {
+		t.Fatalf("unexpected registration status %+v", status.Plugins)
+	}
+	waitForEvent(t, ctx, env, eventRegistrationFailed)
+
+	// Kubelet finds the socket again after a restart, the plugin keeps serving
+	env.PluginWatcher.Restart()
+	if _, err := env.PluginWatcher.WaitForPlugin("nvidia.com/SIM_A", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, ctx, env, eventPluginRestarted)
+	if len(env.Kubelet.Registrations()) != 0 {
+		t.Fatal("plugin registered through kubelet.sock")
+	}
+}
+
+// TestPluginWatcherRegistrationFailure checks that a plugin whose
+// registration socket cannot be served stops its gRPC server again
+func TestPluginWatcherRegistrationFailure(t *testing.T) {
+	env := newEnvironment(t)
+	env.Config.Kubelet.Registration = config.RegistrationPluginWatcher
+	env.Config.Kubelet.RegistryDir = filepath.Join(env.Dir, "missing")
+	env.Config.Backends.Default = config.BackendSimulated
+	env.Config.Backends.Simulated.Models = []config.SimulatedModel{{Name: "SIM_A", Count: 2}}
+	m := NewManager(env.Config, Options{})
+	resources := m.backendResources()
+
+	backend := m.backends[0]
+	dp := m.NewGenericDevicePlugin(backend, "SIM_A", resources[backend][0].Devices)
+	if err := dp.Start(make(chan struct{})); err == nil || !strings.Contains(err.Error(), "registration socket") {
+		t.Fatalf("expected the registration to fail, got %v", err)
+	}
+	if _, err := os.Stat(dp.socketPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the device plugin socket removed, got %v", err)
+	}
+	if dp.server != nil {
+		t.Fatal("gRPC server still running after a failed start")
+	}
+}
+
+// TestRegistrationFailure checks that a plugin kubelet refuses to register
+// stops its gRPC server and removes its socket
+func TestRegistrationFailure(t *testing.T) {
+	env := newEnvironment(t)
+	env.Config.Backends.Default = config.BackendSimulated
+	env.Config.Backends.Simulated.Models = []config.SimulatedModel{{Name: "SIM_A", Count: 2}}
+	if err := env.Kubelet.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(env.Config, Options{})
+	resources := m.backendResources()
+
+	backend := m.backends[0]
+	dp := m.NewGenericDevicePlugin(backend, "SIM_A", resources[backend][0].Devices)
+	env.Kubelet.Reject[dp.resourceName()] = "resource quota exceeded"
+	if err := dp.Start(make(chan struct{})); err == nil || !strings.Contains(err.Error(), "resource quota exceeded") {
+		t.Fatalf("expected the registration to fail, got %v", err)
+	}
+	if _, err := os.Stat(dp.socketPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the device plugin socket removed, got %v", err)
+	}
+	if dp.server != nil {
+		t.Fatal("gRPC server still running after a failed registration")
+	}
+}
@@ -0,0 +1,39 @@
+package device_plugin
+
+import (
+	"log"
+
+	v1 "k8s.io/api/core/v1"
+
+	"kata-xpu-device-plugin/pkg/preflight"
+)
+
+// runPreflight checks the host setup and logs the findings, it returns false
+// when a fatal problem keeps the devices from being passed through
+func (m *Manager) runPreflight() bool {
+	report := preflight.Run(preflight.Options{
+		Sysfs:    m.sysfs,
+		ProcRoot: m.cfg.Preflight.ProcRoot,
+		Ignore:   m.cfg.Preflight.Ignore,
+	})
+	for _, result := range report.Results {
+		if result.Status != preflight.StatusPass {
+			log.Printf("Preflight check %s: %s: %s", result.Name, result.Status, result.Message)
+		}
+		if result.Status == preflight.StatusFail {
+			m.events.event(v1.EventTypeWarning, eventPreflightFailed, "Preflight check %s failed, no device is advertised: %s", result.Name, result.Message)
+		}
+	}
+
+	m.statusMu.Lock()
+	m.preflightReport = &report
+	m.statusMu.Unlock()
+	return !report.Failed()
+}
+
+// lastPreflight returns the report of the startup checks, nil if they did not run
+func (m *Manager) lastPreflight() *preflight.Report {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	return m.preflightReport
+}
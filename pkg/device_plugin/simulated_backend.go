@@ -0,0 +1,242 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	cdiutils "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// Prefix of the CDI device names of simulated devices, never a PCI index
+const simulatedCDIPrefix = "sim-"
+
+// simulatedDevice is a fake device, its ID is its IOMMU group
+type simulatedDevice struct {
+	id       string
+	model    string
+	numaNode int
+}
+
+// simulatedBackend advertises the fake fleet of the configuration. The CDI
+// devices point at a harmless device node and are marked simulated so that
+// scheduling, allocation and CDI injection can be exercised without GPUs.
+type simulatedBackend struct {
+	m *Manager
+
+	mu      sync.RWMutex
+	devices map[string]simulatedDevice // by ID
+}
+
+func (b *simulatedBackend) Name() string {
+	return config.BackendSimulated
+}
+
+// Discover builds the fleet from the configuration, one resource per model
+func (b *simulatedBackend) Discover() ([]BackendResource, error) {
+	sim := b.m.cfg.Backends.Simulated
+	devices := map[string]simulatedDevice{}
+	var resources []BackendResource
+	for i, groups := range sim.IommuGroups() {
+		model := sim.Models[i]
+		res := BackendResource{Name: model.Name}
+		for j, group := range groups {
+			dev := simulatedDevice{id: strconv.Itoa(group), model: model.Name, numaNode: -1}
+			if len(model.NumaNodes) > 0 {
+				dev.numaNode = model.NumaNodes[j*len(model.NumaNodes)/len(groups)]
+			}
+			devices[dev.id] = dev
+			pdev := &pluginapi.Device{ID: dev.id, Health: pluginapi.Healthy}
+			if dev.numaNode >= 0 {
+				pdev.Topology = &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: int64(dev.numaNode)}}}
+			}
+			res.Devices = append(res.Devices, pdev)
+		}
+		log.Printf("Simulating %d %s devices", len(res.Devices), model.Name)
+		resources = append(resources, res)
+	}
+	b.mu.Lock()
+	b.devices = devices
+	b.mu.Unlock()
+	return sortedResources(resources), nil
+}
+
+func (b *simulatedBackend) device(id string) (simulatedDevice, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	dev, ok := b.devices[id]
+	return dev, ok
+}
+
+// modelDevices returns the IDs of the devices of a model, ordered by IOMMU group
+func (b *simulatedBackend) modelDevices(model string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ids := []string{}
+	for id, dev := range b.devices {
+		if dev.model == model {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return lessIommuGroup(ids[i], ids[j]) })
+	return ids
+}
+
+// CDIDevices describes every simulated device with the configured device
+// node and the Kata plug hints of its resource, without the VFIO annotations
+func (b *simulatedBackend) CDIDevices() []CDIDevice {
+	var devices []CDIDevice
+	for _, model := range b.m.cfg.Backends.Simulated.Models {
+		for _, id := range b.modelDevices(model.Name) {
+			dev, _ := b.device(id)
+			annotations := map[string]string{
+				cdiutils.SimulatedAnnotation: "true",
+				"numa-node":                  strconv.Itoa(dev.numaNode),
+			}
+			addKataAnnotations(b.m.cfg.Kata, annotations, fmt.Sprintf("%s/%s", DevicePluginNamespace, model.Name), 1)
+			devices = append(devices, CDIDevice{
+				Resource:    model.Name,
+				Name:        simulatedCDIPrefix + id,
+				Annotations: annotations,
+				DeviceNodes: []string{b.m.cfg.Backends.Simulated.DeviceNode},
+			})
+		}
+	}
+	return devices
+}
+
+// WatchHealth injects the configured health flaps: every interval the next
+// device of the model turns unhealthy for the flap duration
+func (b *simulatedBackend) WatchHealth(resource string, devices HealthReporter, stop <-chan struct{}) {
+	var flap config.SimulatedFlap
+	for _, model := range b.m.cfg.Backends.Simulated.Models {
+		if model.Name == resource {
+			flap = model.Flap
+		}
+	}
+	ids := b.modelDevices(resource)
+	if flap.Interval <= 0 || len(ids) == 0 {
+		return
+	}
+
+	ticker := b.m.clock.NewTicker(flap.Interval)
+	defer ticker.Stop()
+	next := 0
+	flapping := ""
+	var recovered <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			if flapping != "" {
+				devices.ClearUnhealthy(flapping, healthSourceSimulated)
+			}
+			flapping = ids[next%len(ids)]
+			next++
+			log.Printf("[%s] Injecting a health flap of device %s for %v", resource, flapping, flap.Duration)
+			devices.SetUnhealthy(flapping, healthSourceSimulated, "injected health flap")
+			recovered = b.m.clock.After(flap.Duration)
+		case <-recovered:
+			devices.ClearUnhealthy(flapping, healthSourceSimulated)
+			flapping = ""
+			recovered = nil
+		}
+	}
+}
+
+// ValidateAllocation only checks that the devices are of the resource
+func (b *simulatedBackend) ValidateAllocation(resource string, ids []string) error {
+	for _, id := range ids {
+		dev, ok := b.device(id)
+		switch {
+		case !ok:
+			return allocationError(codes.NotFound, AllocationReasonUnknownDevice, id, "",
+				"invalid allocation request: unknown device %s", id)
+		case dev.model != resource:
+			return allocationError(codes.NotFound, AllocationReasonOtherResource, id, "",
+				"invalid allocation request: device %s is not a %s/%s", id, DevicePluginNamespace, resource)
+		}
+	}
+	return nil
+}
+
+// Allocate returns the simulated CDI devices
+func (b *simulatedBackend) Allocate(resource string, ids []string) ([]string, error) {
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, cdiutils.QualifiedName("nvidia.com", "gpu", simulatedCDIPrefix+id))
+	}
+	return names, nil
+}
+
+// PreferredAllocation keeps the devices on the NUMA node of the first one,
+// the lowest IOMMU groups first
+func (b *simulatedBackend) PreferredAllocation(resource string, available, mustInclude []string, size int) []string {
+	return numaPreferredAllocation(available, mustInclude, size, func(id string) int {
+		dev, _ := b.device(id)
+		return dev.numaNode
+	})
+}
+
+// numaPreferredAllocation picks the devices on the NUMA node of the first
+// one, in IOMMU group order, before the devices of the other nodes
+func numaPreferredAllocation(available, mustInclude []string, size int, numaNodeOf func(id string) int) []string {
+	picked := map[string]bool{}
+	ids := []string{}
+	for _, id := range mustInclude {
+		if len(ids) < size && !picked[id] {
+			picked[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	candidates := append([]string{}, available...)
+	sort.Slice(candidates, func(i, j int) bool { return lessIommuGroup(candidates[i], candidates[j]) })
+	numaNode := -1
+	if len(ids) > 0 {
+		numaNode = numaNodeOf(ids[0])
+	} else if len(candidates) > 0 {
+		numaNode = numaNodeOf(candidates[0])
+	}
+	for _, sameNode := range []bool{true, false} {
+		for _, id := range candidates {
+			if len(ids) >= size {
+				return ids
+			}
+			if picked[id] || (sameNode && numaNodeOf(id) != numaNode) {
+				continue
+			}
+			picked[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// PreStart has nothing to reset
+func (b *simulatedBackend) PreStart(resource string, ids []string) error {
+	log.Printf("[%s] Skipping the reset of simulated devices %v", resource, ids)
+	return nil
+}
+
+// InUse is always false, no VM can open a simulated device
+func (b *simulatedBackend) InUse(id string) (bool, error) {
+	return false, nil
+}
+
+// Location names the model and NUMA node of the device
+func (b *simulatedBackend) Location(id string) string {
+	dev, ok := b.device(id)
+	if !ok {
+		return "simulated device " + id
+	}
+	return fmt.Sprintf("simulated %s device %s (NUMA node %d)", dev.model, id, dev.numaNode)
+}
@@ -0,0 +1,68 @@
+package device_plugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+func TestSimulatedBackend(t *testing.T) {
+	env := newEnvironment(t)
+	env.Config.Backends.Default = config.BackendSimulated
+	env.Config.Backends.Simulated.Models = []config.SimulatedModel{{
+		Name:            "SIM_H100",
+		Count:           4,
+		FirstIommuGroup: 100,
+		NumaNodes:       []int{0, 1},
+		Flap:            config.SimulatedFlap{Interval: 300 * time.Millisecond, Duration: 100 * time.Millisecond},
+	}}
+	m, client := startDevicePlugins(t, env, "nvidia.com/SIM_H100")
+	ctx := testContext(t)
+
+	spec, err := cdihandler.Load(cdiSpecPath(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Devices) != 4 {
+		t.Fatalf("expected 4 simulated CDI devices, got %d", len(spec.Devices))
+	}
+	if errs := m.ValidateCDISpec(spec, "/"); len(errs) != 0 {
+		t.Fatalf("invalid simulated CDI spec: %v", errs)
+	}
+
+	updates, devices := watchDevices(t, ctx, client)
+	available := []string{}
+	for _, dev := range devices {
+		available = append(available, dev.ID)
+	}
+	if len(devices) != 4 || devices[3].Topology == nil || devices[3].Topology.Nodes[0].ID != 1 {
+		t.Fatalf("unexpected simulated devices %v", devices)
+	}
+
+	preferred, err := client.GetPreferredAllocation(ctx, available, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(preferred, ",") != "100,101" {
+		t.Fatalf("expected the devices of NUMA node 0, got %v", preferred)
+	}
+
+	resp, err := client.Allocate(ctx, "102")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.CDIDevices) != 1 || resp.CDIDevices[0].Name != "nvidia.com/gpu=sim-102" {
+		t.Fatalf("unexpected simulated CDI devices %v", resp.CDIDevices)
+	}
+	expectRejected(t, ctx, client, codes.NotFound, AllocationReasonUnknownDevice, "10")
+
+	// The first flap hits the first device
+	waitForHealth(t, ctx, updates, "100", pluginapi.Unhealthy)
+	waitForHealth(t, ctx, updates, "100", pluginapi.Healthy)
+}
@@ -0,0 +1,320 @@
+package device_plugin
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"kata-xpu-device-plugin/pkg/version"
+)
+
+// Names in a snapshot archive: the sysfs tree below sys/, next to the files
+// read from procfs and the pci.ids database
+const (
+	snapshotInfoName    = "snapshot.yaml"
+	snapshotSysfsDir    = "sys"
+	snapshotCmdlineName = "proc/cmdline"
+	snapshotPciIdsName  = "pci.ids"
+)
+
+// Attributes of a PCI function read by discovery, allocation and reset
+var snapshotDeviceAttributes = []string{
+	"vendor", "device", "class", "numa_node", "config", "enable", "reset", "reset_method",
+	"sriov_totalvfs", "physfn", "driver", "iommu_group",
+}
+
+// Kernel modules whose parameters are read by preflight and the confidential
+// computing checks
+var snapshotModules = []string{"vfio", "vfio_pci", "vfio_iommu_type1", "iommufd", "kvm_intel", "kvm_amd"}
+
+// SnapshotInfo describes the host a snapshot was captured on
+type SnapshotInfo struct {
+	Version    string    `json:"version" yaml:"version"`
+	Hostname   string    `json:"hostname" yaml:"hostname"`
+	CapturedAt time.Time `json:"capturedAt" yaml:"capturedAt"`
+	SysfsRoot  string    `json:"sysfsRoot" yaml:"sysfsRoot"`
+	// Skipped lists the files that could not be read, captured empty
+	Skipped []string `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+}
+
+// Snapshot is a sysfs tree captured by CaptureSnapshot, with the kernel
+// command line and the pci.ids database of the host
+type Snapshot struct {
+	Info    SnapshotInfo
+	Sysfs   SysFS
+	Cmdline []byte
+	PciIds  []byte
+}
+
+// CaptureSnapshot writes a gzipped tar archive of every sysfs file discovery
+// reads: the attributes, driver, physfn and iommu_group links and mdev types
+// of all PCI functions, the mediated devices, the IOMMU groups and their
+// members, the confidential computing firmware and the parameters of the
+// VFIO and KVM modules. Symlinks are recorded with their targets as is.
+func CaptureSnapshot(w io.Writer, sysfsRoot, procRoot, pciIdsPath string) (SnapshotInfo, error) {
+	hostname, _ := os.Hostname()
+	info := SnapshotInfo{
+		Version:    version.Version,
+		Hostname:   hostname,
+		CapturedAt: time.Now().UTC(),
+		SysfsRoot:  sysfsRoot,
+	}
+	// Symlinks are resolved against the real root, e.g. when /sys is a link
+	root, err := filepath.EvalSymlinks(sysfsRoot)
+	if err != nil {
+		return info, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	c := &snapshotCapture{tw: tw, root: root, seen: map[string]bool{}, info: &info}
+
+	entries, err := os.ReadDir(filepath.Join(root, pciDevicesDir))
+	if err != nil {
+		return info, err
+	}
+	c.add(pciDevicesDir)
+	for _, entry := range entries {
+		link := path.Join(pciDevicesDir, entry.Name())
+		c.add(link)
+		// The attributes live in the directory of the function below devices/
+		dir, ok := c.deviceDir(link)
+		if !ok {
+			continue
+		}
+		for _, attr := range snapshotDeviceAttributes {
+			c.add(path.Join(dir, attr))
+		}
+		c.addTree(path.Join(dir, "mdev_supported_types"))
+	}
+	// Mediated devices live below their parent function, the names of their
+	// types are in the mdev_supported_types of the parent
+	mdevs, _ := os.ReadDir(filepath.Join(root, mdevDevicesDir))
+	for _, entry := range mdevs {
+		link := path.Join(mdevDevicesDir, entry.Name())
+		c.add(link)
+		if dir, ok := c.deviceDir(link); ok {
+			c.add(path.Join(dir, "mdev_type"))
+			c.add(path.Join(dir, "iommu_group"))
+		}
+	}
+	// Group type and membership, the members link to the functions above
+	c.addTree("kernel/iommu_groups")
+	// Firmware of the confidential computing technologies
+	c.addTree(tdxFirmwareDir)
+	c.addTree(sevFirmwareDir)
+	for _, module := range snapshotModules {
+		// Built-in modules may have no parameters but still show up
+		c.add(path.Join("module", module))
+		c.addTree(path.Join("module", module, "parameters"))
+	}
+
+	if err := c.addFile(snapshotCmdlineName, filepath.Join(procRoot, "cmdline")); err != nil {
+		log.Printf("Could not capture the kernel command line: %v", err)
+	}
+	if err := c.addFile(snapshotPciIdsName, pciIdsPath); err != nil {
+		log.Printf("Could not capture the pci.ids database: %v", err)
+	}
+	if c.err != nil {
+		return info, c.err
+	}
+
+	data, err := yaml.Marshal(info)
+	if err != nil {
+		return info, err
+	}
+	if err := c.write(&tar.Header{Name: snapshotInfoName, Mode: 0644, Size: int64(len(data)), ModTime: info.CapturedAt}, data); err != nil {
+		return info, err
+	}
+	if err := tw.Close(); err != nil {
+		return info, err
+	}
+	return info, gz.Close()
+}
+
+// snapshotCapture writes the entries of a snapshot, each one at most once
+type snapshotCapture struct {
+	tw   *tar.Writer
+	root string
+	seen map[string]bool
+	info *SnapshotInfo
+	err  error // first write error, reading errors only skip a file
+}
+
+func (c *snapshotCapture) write(hdr *tar.Header, data []byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.err = c.tw.WriteHeader(hdr); c.err == nil && len(data) > 0 {
+		_, c.err = c.tw.Write(data)
+	}
+	return c.err
+}
+
+// deviceDir resolves the bus link of a device to its directory below the root
+func (c *snapshotCapture) deviceDir(link string) (string, bool) {
+	real, err := filepath.EvalSymlinks(filepath.Join(c.root, filepath.FromSlash(link)))
+	if err != nil {
+		log.Printf("Could not resolve %s: %v", link, err)
+		return "", false
+	}
+	dir, err := filepath.Rel(c.root, real)
+	if err != nil || strings.HasPrefix(dir, "..") {
+		log.Printf("Device %s is outside of %s", link, c.root)
+		return "", false
+	}
+	return filepath.ToSlash(dir), true
+}
+
+// add records the sysfs entry at name, relative to the root, after the
+// directories above it. Missing entries are ignored.
+func (c *snapshotCapture) add(name string) {
+	if c.seen[name] {
+		return
+	}
+	if dir := path.Dir(name); dir != "." {
+		c.add(dir)
+	}
+	src := filepath.Join(c.root, filepath.FromSlash(name))
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return
+	}
+	c.seen[name] = true
+
+	hdr := &tar.Header{
+		Name:    path.Join(snapshotSysfsDir, name),
+		Mode:    int64(fi.Mode().Perm()),
+		ModTime: fi.ModTime(),
+	}
+	var data []byte
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		if hdr.Linkname, err = os.Readlink(src); err != nil {
+			c.info.Skipped = append(c.info.Skipped, name)
+			return
+		}
+	case fi.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	default:
+		hdr.Typeflag = tar.TypeReg
+		// Attributes report a size of a page, only reading tells theirs.
+		// Write-only ones, like reset, are recorded empty.
+		if data, err = os.ReadFile(src); err != nil {
+			c.info.Skipped = append(c.info.Skipped, name)
+			data = nil
+		}
+		hdr.Size = int64(len(data))
+	}
+	c.write(hdr, data)
+}
+
+// addTree records the sysfs directory at name and everything below it,
+// without following symlinks
+func (c *snapshotCapture) addTree(name string) {
+	c.add(name)
+	entries, err := os.ReadDir(filepath.Join(c.root, filepath.FromSlash(name)))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		child := path.Join(name, entry.Name())
+		if entry.IsDir() {
+			c.addTree(child)
+		} else {
+			c.add(child)
+		}
+	}
+}
+
+// addFile records a host file outside of sysfs under name
+func (c *snapshotCapture) addFile(name, src string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return c.write(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: c.info.CapturedAt}, data)
+}
+
+// OpenSnapshot loads an archive written by CaptureSnapshot
+func OpenSnapshot(archivePath string) (*Snapshot, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %v", archivePath, err)
+	}
+	defer gz.Close()
+
+	sysfs := newArchiveSysFS()
+	snapshot := &Snapshot{Sysfs: sysfs}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s: %v", archivePath, err)
+		}
+		name := path.Clean(strings.TrimSuffix(hdr.Name, "/"))
+		if !fs.ValidPath(name) {
+			return nil, fmt.Errorf("snapshot %s: invalid name %q", archivePath, hdr.Name)
+		}
+
+		var data []byte
+		if hdr.Typeflag == tar.TypeReg {
+			if data, err = io.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("snapshot %s: %v", archivePath, err)
+			}
+		}
+		switch name {
+		case snapshotInfoName:
+			if err := yaml.Unmarshal(data, &snapshot.Info); err != nil {
+				return nil, fmt.Errorf("snapshot %s: %v", archivePath, err)
+			}
+			continue
+		case snapshotCmdlineName:
+			snapshot.Cmdline = data
+			continue
+		case snapshotPciIdsName:
+			snapshot.PciIds = data
+			continue
+		}
+
+		rel, ok := strings.CutPrefix(name, snapshotSysfsDir+"/")
+		if !ok {
+			continue
+		}
+		e := &archiveEntry{mode: fs.FileMode(hdr.Mode).Perm(), modTime: hdr.ModTime}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			e.mode |= fs.ModeDir
+		case tar.TypeSymlink:
+			e.mode |= fs.ModeSymlink
+			e.target = hdr.Linkname
+		case tar.TypeReg:
+			e.data = data
+		default:
+			continue
+		}
+		sysfs.add(rel, e)
+	}
+	sysfs.index()
+	return snapshot, nil
+}
@@ -0,0 +1,31 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotReplay(t *testing.T) {
+	env := newHGXEnvironment(t)
+	result := NewManager(env.Config, Options{}).Discover()
+
+	archive, err := os.Create(filepath.Join(env.Dir, "snapshot.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CaptureSnapshot(archive, env.Config.Discovery.SysfsRoot, env.Config.Preflight.ProcRoot, env.Config.Discovery.PciIdsPath)
+	archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := OpenSnapshot(archive.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := NewManager(env.Config, Options{Sysfs: snapshot.Sysfs, PciIds: snapshot.PciIds}).Discover()
+	if !reflect.DeepEqual(replayed, result) {
+		t.Fatalf("discovery of the snapshot differs from the host: %+v", replayed)
+	}
+}
@@ -0,0 +1,308 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// Suffix of the resources of virtual functions, the physical functions of
+// the same model keep the plain name in the vfio backend
+const sriovResourceSuffix = "_VF"
+
+// Prefix of the CDI device names of virtual functions, never a PCI index
+const sriovCDIPrefix = "vf-"
+
+// virtualFunction is an SR-IOV VF, its device ID is its IOMMU group
+type virtualFunction struct {
+	NvidiaGpuDevice
+	group    string
+	physfn   string // PCI address of the physical function
+	resource string
+}
+
+// sriovBackend passes the SR-IOV virtual functions of NVIDIA GPUs bound to
+// a VFIO driver through, one device per IOMMU group. VFs only share a group
+// without ACS below their physical function, such a group is passed through
+// as a whole like the groups of the vfio backend. The physical functions
+// stay with the host, e.g. with the vGPU manager enabling the VFs.
+type sriovBackend struct {
+	m *Manager
+
+	mu  sync.RWMutex
+	vfs map[string][]virtualFunction // by IOMMU group, ordered by address
+}
+
+func (b *sriovBackend) Name() string {
+	return config.BackendSRIOVVF
+}
+
+// physicalFunction returns the address of the physical function of a
+// virtual function, false for any other function
+func (m *Manager) physicalFunction(deviceAddress string) (string, bool) {
+	path, err := m.sysfs.ReadLink(devicePath(deviceAddress, "physfn"))
+	if err != nil {
+		return "", false
+	}
+	return filepath.Base(path), true
+}
+
+// nodeFeatures flags the models of the physical functions of the VFs as
+// SR-IOV capable
+func (b *sriovBackend) nodeFeatures() map[string]string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	features := map[string]string{}
+	for _, vfs := range b.vfs {
+		for _, vf := range vfs {
+			if model, ok := b.m.functionModel(vf.physfn); ok {
+				features["device."+model+".sriov"] = "true"
+			}
+		}
+	}
+	return features
+}
+
+// Discover walks sysfs for the NVIDIA virtual functions, filtered like the
+// functions of the vfio backend. A resource is the model of the VF, or of
+// the first VF of a group shared by several.
+func (b *sriovBackend) Discover() ([]BackendResource, error) {
+	m := b.m
+	filters := m.cfg.Discovery.Filters
+	entries, err := m.sysfs.ReadDir(pciDevicesDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PCI devices: %v", err)
+	}
+
+	vfs := map[string][]virtualFunction{}
+	byResource := map[string]*BackendResource{}
+	for _, entry := range entries {
+		name := entry.Name()
+		physfn, ok := m.physicalFunction(name)
+		if !ok {
+			continue
+		}
+		vendorID, err := m.readID(name, "vendor")
+		if err != nil || vendorID != nvidiaVendorID {
+			continue
+		}
+		deviceID, err := m.readID(name, "device")
+		if err != nil {
+			continue
+		}
+		class, _ := m.readID(name, "class")
+		driver, _ := m.readLink(name, "driver")
+		fn := PCIFunction{BDF: name, VendorID: vendorID, DeviceID: deviceID, Class: class, Driver: driver}
+		reason := filterReason(fn, filters)
+		if reason == "" && !m.isVFIODriver(driver) {
+			reason = "not bound to a VFIO driver"
+		}
+		if reason != "" {
+			log.Printf("Skipping virtual function %s: %s", name, reason)
+			continue
+		}
+		group, err := m.readLink(name, "iommu_group")
+		if err != nil {
+			continue
+		}
+
+		vf := virtualFunction{
+			NvidiaGpuDevice: NvidiaGpuDevice{
+				addr:     name,
+				vendorID: vendorID,
+				deviceID: deviceID,
+				class:    class,
+				numaNode: m.readNumaNode(name),
+				driver:   driver,
+			},
+			group:    group,
+			physfn:   physfn,
+			resource: m.pluginNameForDevice(deviceID) + sriovResourceSuffix,
+		}
+		vfs[group] = append(vfs[group], vf)
+		if len(vfs[group]) > 1 {
+			// Advertised with the first VF of the group
+			log.Printf("Virtual function %s shares IOMMU group %s with %s", name, group, vfs[group][0].addr)
+			continue
+		}
+		res, ok := byResource[vf.resource]
+		if !ok {
+			res = &BackendResource{Name: vf.resource}
+			byResource[vf.resource] = res
+		}
+		pdev := &pluginapi.Device{ID: group, Health: pluginapi.Healthy}
+		if vf.numaNode >= 0 {
+			pdev.Topology = &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: int64(vf.numaNode)}}}
+		}
+		res.Devices = append(res.Devices, pdev)
+	}
+
+	b.mu.Lock()
+	b.vfs = vfs
+	b.mu.Unlock()
+	resources := make([]BackendResource, 0, len(byResource))
+	for _, res := range byResource {
+		resources = append(resources, *res)
+	}
+	return sortedResources(resources), nil
+}
+
+// vf returns the first VF of an IOMMU group, the one the group is
+// advertised with
+func (b *sriovBackend) vf(id string) (virtualFunction, bool) {
+	vfs := b.groupVFs(id)
+	if len(vfs) == 0 {
+		return virtualFunction{}, false
+	}
+	return vfs[0], true
+}
+
+// groupVFs returns every VF of an IOMMU group
+func (b *sriovBackend) groupVFs(id string) []virtualFunction {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.vfs[id]
+}
+
+// sortedIDs returns the IDs of the VFs of resource, or of every VF when
+// resource is empty, ordered by IOMMU group
+func (b *sriovBackend) sortedIDs(resource string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ids := []string{}
+	for id, vfs := range b.vfs {
+		if resource == "" || vfs[0].resource == resource {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return lessIommuGroup(ids[i], ids[j]) })
+	return ids
+}
+
+// CDIDevices describes one CDI device per IOMMU group of VFs, ordered by
+// IOMMU group
+func (b *sriovBackend) CDIDevices() []CDIDevice {
+	m := b.m
+	var devices []CDIDevice
+	for _, id := range b.sortedIDs("") {
+		vf, _ := b.vf(id)
+		name := sriovCDIPrefix + id
+		annotations := map[string]string{
+			"attach-pci": "true",
+			"bdf":        vf.addr,
+		}
+		addKataAnnotations(m.cfg.Kata, annotations, fmt.Sprintf("%s/%s", DevicePluginNamespace, vf.resource), 1)
+		annotations[cdihandler.GroupMembersAnnotation] = formatGroupFunctions(m.readGroupFunctions(vf.addr))
+		annotations[cdihandler.VFIODriverAnnotation] = vf.driver
+		annotations[cdihandler.PhysFnAnnotation] = vf.physfn
+		annotations[fmt.Sprintf("%svfio%s", cdihandler.CdiK8SPrefix, id)] = fmt.Sprintf("%s=%s", cdihandler.DefaultKind, name)
+		devices = append(devices, CDIDevice{
+			Resource:    vf.resource,
+			Name:        name,
+			Annotations: annotations,
+			DeviceNodes: []string{fmt.Sprintf("/dev/vfio/%s", id)},
+		})
+	}
+	return devices
+}
+
+// WatchHealth marks a VF unhealthy while its VFIO group node is missing
+func (b *sriovBackend) WatchHealth(resource string, devices HealthReporter, stop <-chan struct{}) {
+	groups := map[string]string{}
+	for _, id := range b.sortedIDs(resource) {
+		groups[id] = id
+	}
+	b.m.watchVFIONodes(resource, groups, devices, stop)
+}
+
+// ValidateAllocation checks every requested VF against the host
+func (b *sriovBackend) ValidateAllocation(resource string, ids []string) error {
+	for _, id := range ids {
+		vf, ok := b.vf(id)
+		switch {
+		case !ok:
+			return allocationError(codes.NotFound, AllocationReasonUnknownDevice, id, "",
+				"invalid allocation request: unknown device %s", id)
+		case vf.resource != resource:
+			return allocationError(codes.NotFound, AllocationReasonOtherResource, id, vf.addr,
+				"invalid allocation request: device %s is not a %s/%s", id, DevicePluginNamespace, resource)
+		}
+		for _, vf := range b.groupVFs(id) {
+			if err := b.m.validateAllocatedFunction(id, vf.NvidiaGpuDevice); err != nil {
+				return err
+			}
+		}
+		if _, err := os.Stat(filepath.Join(b.m.vfioDevicePath, id)); err != nil {
+			return allocationError(codes.FailedPrecondition, AllocationReasonVFIONodeMissing, id, vf.addr,
+				"VFIO group node of device %s is missing: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// Allocate returns the CDI devices of the VFs
+func (b *sriovBackend) Allocate(resource string, ids []string) ([]string, error) {
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, cdihandler.QualifiedName("nvidia.com", "gpu", sriovCDIPrefix+id))
+	}
+	return names, nil
+}
+
+// PreferredAllocation keeps the VFs on the NUMA node of the first one
+func (b *sriovBackend) PreferredAllocation(resource string, available, mustInclude []string, size int) []string {
+	return numaPreferredAllocation(available, mustInclude, size, func(id string) int {
+		vf, ok := b.vf(id)
+		if !ok {
+			return -1
+		}
+		return vf.numaNode
+	})
+}
+
+// PreStart resets the IOMMU groups of the VFs, a VF reset leaves its
+// physical function and the other VFs alone
+func (b *sriovBackend) PreStart(resource string, ids []string) error {
+	for _, id := range ids {
+		vf, ok := b.vf(id)
+		if !ok {
+			return fmt.Errorf("unknown device %s", id)
+		}
+		if err := b.m.resetGroupOf(id, vf.addr, b.m.cfg.PreStart); err != nil {
+			return fmt.Errorf("failed to reset device %s before container start: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// InUse reports whether the VF is enabled, i.e. opened by a VMM
+func (b *sriovBackend) InUse(id string) (bool, error) {
+	vf, ok := b.vf(id)
+	if !ok {
+		return false, fmt.Errorf("unknown IOMMU group %s", id)
+	}
+	return b.m.groupOfInUse(vf.addr)
+}
+
+// Location names the IOMMU group with the VFs and their physical function
+func (b *sriovBackend) Location(id string) string {
+	vfs := b.groupVFs(id)
+	if len(vfs) == 0 {
+		return "IOMMU group " + id
+	}
+	addrs := make([]string, 0, len(vfs))
+	for _, vf := range vfs {
+		addrs = append(addrs, vf.addr)
+	}
+	return fmt.Sprintf("IOMMU group %s (VF %s of %s)", id, strings.Join(addrs, ", "), vfs[0].physfn)
+}
@@ -0,0 +1,155 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/internal/harness"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+const vfResource = "nvidia.com/GH100_H100_SXM5_80GB_VF"
+
+// newSRIOVEnvironment has a GPU kept by the host driver with two VFs bound
+// to vfio-pci in IOMMU groups 31 and 32, served by the sriov-vf backend
+func newSRIOVEnvironment(t *testing.T) *harness.Environment {
+	t.Helper()
+	env := newEnvironment(t)
+	devices := []harness.PCIDevice{
+		{BDF: "0000:41:00.0", Driver: "nvidia", IommuGroup: 30, SriovTotalVFs: 2},
+		{BDF: "0000:41:00.4", Driver: "vfio-pci", IommuGroup: 31, PhysFn: "0000:41:00.0"},
+		{BDF: "0000:41:00.5", Driver: "vfio-pci", IommuGroup: 32, PhysFn: "0000:41:00.0"},
+	}
+	for _, dev := range devices {
+		dev.Vendor = "10de"
+		dev.Device = harness.H100SXM5Device
+		dev.Class = "030200"
+		dev.NumaNode = 1
+		if err := env.Sysfs.AddDevice(dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, group := range []int{31, 32} {
+		if err := env.AddVFIOGroup(group); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.Config.Backends.Resources = map[string]string{vfResource: config.BackendSRIOVVF}
+	return env
+}
+
+func TestSRIOVBackend(t *testing.T) {
+	env := newSRIOVEnvironment(t)
+	m, client := startDevicePlugins(t, env, vfResource)
+	ctx := testContext(t)
+
+	if n := len(m.Discover().Devices); n != 0 {
+		t.Fatalf("expected the VFs to be left out of the vfio backend, it discovered %d devices", n)
+	}
+
+	spec, err := cdihandler.Load(cdiSpecPath(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Devices) != 2 {
+		t.Fatalf("expected 2 VF CDI devices, got %d", len(spec.Devices))
+	}
+	if errs := m.ValidateCDISpec(spec, env.Dir); len(errs) != 0 {
+		t.Fatalf("invalid VF CDI spec: %v", errs)
+	}
+	if physfn := spec.Devices[0].Annotations[cdihandler.PhysFnAnnotation]; physfn != "0000:41:00.0" {
+		t.Fatalf("expected the physical function in the annotations, got %q", physfn)
+	}
+
+	_, devices := watchDevices(t, ctx, client)
+	if len(devices) != 2 || devices[0].Topology == nil || devices[0].Topology.Nodes[0].ID != 1 {
+		t.Fatalf("unexpected VF devices %v", devices)
+	}
+
+	resp, err := client.Allocate(ctx, "31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.CDIDevices) != 1 || resp.CDIDevices[0].Name != "nvidia.com/gpu=vf-31" {
+		t.Fatalf("unexpected VF CDI devices %v", resp.CDIDevices)
+	}
+
+	// Only the VF is reset, the physical function has no reset attribute
+	reset := filepath.Join(env.Sysfs.Root, "bus", "pci", "devices", "0000:41:00.4", "reset")
+	if err := os.WriteFile(reset, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PreStartContainer(ctx, "31"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRejected(t, ctx, client, codes.NotFound, AllocationReasonUnknownDevice, "30")
+	if err := env.Sysfs.SetDriver("0000:41:00.5", "nvidia"); err != nil {
+		t.Fatal(err)
+	}
+	expectRejected(t, ctx, client, codes.FailedPrecondition, AllocationReasonNotVFIO, "32")
+}
+
+// TestSRIOVSharedGroup checks that VFs sharing an IOMMU group, without ACS
+// below their physical function, are advertised as one device
+func TestSRIOVSharedGroup(t *testing.T) {
+	env := newSRIOVEnvironment(t)
+	err := env.Sysfs.AddDevice(harness.PCIDevice{
+		BDF: "0000:41:00.6", Vendor: "10de", Device: harness.H100SXM5Device, Class: "030200",
+		Driver: "vfio-pci", IommuGroup: 32, NumaNode: 1, PhysFn: "0000:41:00.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, client := startDevicePlugins(t, env, vfResource)
+	ctx := testContext(t)
+
+	_, devices := watchDevices(t, ctx, client)
+	if len(devices) != 2 || devices[0].ID != "31" || devices[1].ID != "32" {
+		t.Fatalf("expected one device per IOMMU group, got %v", devices)
+	}
+
+	spec, err := cdihandler.Load(cdiSpecPath(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Devices) != 2 {
+		t.Fatalf("expected 2 VF CDI devices, got %d", len(spec.Devices))
+	}
+	shared := spec.Devices[1]
+	if shared.Name != "vf-32" || shared.Annotations["bdf"] != "0000:41:00.5" ||
+		!strings.Contains(shared.Annotations[cdihandler.GroupMembersAnnotation], "0000:41:00.6") {
+		t.Fatalf("expected group 32 with both VFs, got %+v", shared)
+	}
+	if errs := m.ValidateCDISpec(spec, env.Dir); len(errs) != 0 {
+		t.Fatalf("invalid VF CDI spec: %v", errs)
+	}
+
+	resp, err := client.Allocate(ctx, "32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.CDIDevices) != 1 || resp.CDIDevices[0].Name != "nvidia.com/gpu=vf-32" {
+		t.Fatalf("unexpected VF CDI devices %v", resp.CDIDevices)
+	}
+	var backend DeviceBackend
+	for _, b := range m.backends {
+		if b.Name() == config.BackendSRIOVVF {
+			backend = b
+		}
+	}
+	if location := backend.Location("32"); location != "IOMMU group 32 (VF 0000:41:00.5, 0000:41:00.6 of 0000:41:00.0)" {
+		t.Fatalf("unexpected location %q", location)
+	}
+
+	// Every VF of the group is checked, not only the advertised one
+	if err := env.Sysfs.SetDriver("0000:41:00.6", "nvidia"); err != nil {
+		t.Fatal(err)
+	}
+	expectRejected(t, ctx, client, codes.FailedPrecondition, AllocationReasonNotVFIO, "32")
+}
@@ -0,0 +1,110 @@
+package device_plugin
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Directory of the PCI functions, relative to the sysfs mount point
+const pciDevicesDir = "bus/pci/devices"
+
+// Directory of the mediated devices, linked to their directory below the parent function
+const mdevDevicesDir = "bus/mdev/devices"
+
+// SysFS is the sysfs tree read by discovery. Names are slash separated and
+// relative to the sysfs mount point like in io/fs, e.g.
+// "bus/pci/devices/0000:41:00.0/vendor", and symlinks are followed except by
+// ReadLink.
+type SysFS interface {
+	fs.ReadFileFS
+	fs.ReadDirFS
+	fs.StatFS
+	// ReadLink returns the target of a symlink, like the driver and
+	// iommu_group links of a PCI function
+	ReadLink(name string) (string, error)
+	// WriteFile writes an attribute, e.g. the reset file of a function.
+	// Read-only trees fail with fs.ErrPermission.
+	WriteFile(name string, data []byte) error
+}
+
+// dirSysFS is a sysfs tree on the host, mounted at root
+type dirSysFS struct {
+	root string
+}
+
+// DirSysFS returns the sysfs tree mounted at root, e.g. /sys
+func DirSysFS(root string) SysFS {
+	return dirSysFS{root: root}
+}
+
+func (d dirSysFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(d.root, filepath.FromSlash(name)), nil
+}
+
+func (d dirSysFS) Open(name string) (fs.File, error) {
+	p, err := d.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (d dirSysFS) ReadFile(name string) ([]byte, error) {
+	p, err := d.path("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (d dirSysFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := d.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (d dirSysFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := d.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (d dirSysFS) ReadLink(name string) (string, error) {
+	p, err := d.path("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(p)
+}
+
+func (d dirSysFS) WriteFile(name string, data []byte) error {
+	p, err := d.path("writefile", name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0200)
+}
+
+// devicePath names an attribute of a PCI function in the sysfs tree
+func devicePath(deviceAddress string, elem ...string) string {
+	return path.Join(append([]string{pciDevicesDir, deviceAddress}, elem...)...)
+}
+
+// readAttribute reads an attribute of a PCI function, trimmed of whitespace
+func readAttribute(sysfs SysFS, deviceAddress string, elem ...string) (string, error) {
+	data, err := sysfs.ReadFile(devicePath(deviceAddress, elem...))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,253 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"google.golang.org/grpc/codes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	cdihandler "kata-xpu-device-plugin/cdi"
+	"kata-xpu-device-plugin/pkg/config"
+)
+
+// vfioBackend passes whole NVIDIA PCI functions bound to a VFIO driver
+// through. A device is an IOMMU group, handed out with every function of
+// the group and, in fabric include mode, the NVSwitches of its partition.
+type vfioBackend struct {
+	m *Manager
+
+	mu        sync.RWMutex
+	resources map[string]string // IOMMU group -> resource of the last discovery
+}
+
+func (b *vfioBackend) Name() string {
+	return config.BackendVFIO
+}
+
+// Discover walks sysfs, every device ID becomes a resource of its own
+func (b *vfioBackend) Discover() ([]BackendResource, error) {
+	d := b.m.discover()
+	groups := map[string]string{}
+	var resources []BackendResource
+	for key, ids := range d.deviceMap {
+		res := BackendResource{Name: b.m.pluginNameForKey(key)}
+		for _, id := range ids {
+			groups[id] = res.Name
+			res.Devices = append(res.Devices, &pluginapi.Device{ID: id, Health: pluginapi.Healthy})
+		}
+		resources = append(resources, res)
+	}
+	b.mu.Lock()
+	b.resources = groups
+	b.mu.Unlock()
+	return sortedResources(resources), nil
+}
+
+// resourceOf returns the resource of an IOMMU group, false if unknown
+func (b *vfioBackend) resourceOf(id string) (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	name, ok := b.resources[id]
+	return name, ok
+}
+
+// CDIDevices describes one CDI device per function, ordered by IOMMU group
+func (b *vfioBackend) CDIDevices() []CDIDevice {
+	m := b.m
+	d := m.current()
+	iommuMap := d.cdiDeviceGroups()
+	groups := make([]string, 0, len(iommuMap))
+	for group := range iommuMap {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return lessIommuGroup(groups[i], groups[j]) })
+
+	var devices []CDIDevice
+	names := map[string]string{}
+	for _, devName := range groups {
+		for _, dev := range iommuMap[devName] {
+			mapKey := d.deviceMapKey(devName, dev.deviceID)
+			name, ok := names[mapKey]
+			if !ok {
+				name = m.pluginNameForKey(mapKey)
+				names[mapKey] = name
+			}
+			annotations := map[string]string{
+				"attach-pci": "true",
+			}
+			addKataAnnotations(m.cfg.Kata, annotations, fmt.Sprintf("%s/%s", DevicePluginNamespace, name), 1)
+			d.addCCAnnotations(annotations, devName)
+			annotations[cdihandler.GroupMembersAnnotation] = formatGroupFunctions(m.cdiGroupFunctions(d, devName))
+			annotations[cdihandler.VFIODriverAnnotation] = dev.driver
+			if partition, ok := d.groupPartition[devName]; ok {
+				annotations[cdihandler.FabricPartitionAnnotation] = partition
+			}
+			key := fmt.Sprintf("%svfio%v", cdihandler.CdiK8SPrefix, devName)
+			value := fmt.Sprintf("%s=%v", cdihandler.DefaultKind, dev.index)
+			annotations[key] = value
+			annotations["bdf"] = dev.addr
+
+			resource := name
+			if _, advertised := d.iommuMap[devName]; !advertised {
+				// NVSwitch passed through with the GPUs of its partition
+				resource = ""
+			}
+			devices = append(devices, CDIDevice{
+				Resource:    resource,
+				Name:        fmt.Sprintf("%v", dev.index),
+				Annotations: annotations,
+				DeviceNodes: []string{fmt.Sprintf("/dev/vfio/%s", devName)},
+			})
+		}
+	}
+	return devices
+}
+
+// WatchHealth marks a device unhealthy while its VFIO group node is missing
+func (b *vfioBackend) WatchHealth(resource string, devices HealthReporter, stop <-chan struct{}) {
+	groups := map[string]string{}
+	b.mu.RLock()
+	for id, name := range b.resources {
+		if name == resource {
+			groups[id] = id
+		}
+	}
+	b.mu.RUnlock()
+	b.m.watchVFIONodes(resource, groups, devices, stop)
+}
+
+// watchVFIONodes marks a device unhealthy while the VFIO node of its IOMMU
+// group is missing, groups maps the device IDs to their IOMMU group
+func (m *Manager) watchVFIONodes(resource string, groups map[string]string, devices HealthReporter, stop <-chan struct{}) {
+	method := fmt.Sprintf("healthCheck(%s)", resource)
+	dir := m.vfioDevicePath
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("%s: Unable to create fsnotify watcher: %v", method, err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(dir); err != nil {
+		log.Printf("%s: Unable to add %s to fsnotify watcher: %v", method, dir, err)
+		return
+	}
+
+	pathDeviceMap := map[string][]string{}
+	for id, group := range groups {
+		devicePath := filepath.Join(dir, group)
+		pathDeviceMap[devicePath] = append(pathDeviceMap[devicePath], id)
+		if _, err := os.Stat(devicePath); err != nil {
+			devices.SetUnhealthy(id, healthSourceDeviceNode, fmt.Sprintf("%s is missing", devicePath))
+		}
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			for _, id := range pathDeviceMap[event.Name] {
+				// Health in this case is if the device path actually exists
+				if event.Op&fsnotify.Create != 0 {
+					devices.ClearUnhealthy(id, healthSourceDeviceNode)
+				} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					log.Printf("%s: Marking device unhealthy: %s", method, event.Name)
+					devices.SetUnhealthy(id, healthSourceDeviceNode, fmt.Sprintf("%s was removed", event.Name))
+				}
+			}
+		}
+	}
+}
+
+// ValidateAllocation checks every requested IOMMU group against the live
+// inventory and the host
+func (b *vfioBackend) ValidateAllocation(resource string, ids []string) error {
+	d := b.m.current()
+	for _, id := range ids {
+		devs := d.iommuMap[id]
+		name, known := b.resourceOf(id)
+		switch {
+		case !known || len(devs) == 0:
+			return allocationError(codes.NotFound, AllocationReasonUnknownDevice, id, "",
+				"invalid allocation request: unknown device %s", id)
+		case name != resource:
+			return allocationError(codes.NotFound, AllocationReasonOtherResource, id, devs[0].addr,
+				"invalid allocation request: device %s is not a %s/%s", id, DevicePluginNamespace, resource)
+		}
+
+		for _, dev := range devs {
+			if err := b.m.validateAllocatedFunction(id, dev); err != nil {
+				return err
+			}
+		}
+		if _, err := os.Stat(filepath.Join(b.m.vfioDevicePath, id)); err != nil {
+			return allocationError(codes.FailedPrecondition, AllocationReasonVFIONodeMissing, id, devs[0].addr,
+				"VFIO group node of device %s is missing: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// Allocate returns the functions of the IOMMU groups, and in fabric include
+// mode the NVSwitches of their partitions
+func (b *vfioBackend) Allocate(resource string, ids []string) ([]string, error) {
+	return b.m.groupCDIDevices(b.m.current(), ids), nil
+}
+
+// groupCDIDevices returns the CDI devices of the functions of the IOMMU
+// groups, and in fabric include mode of the NVSwitches of their partitions
+func (m *Manager) groupCDIDevices(d *discovery, ids []string) []string {
+	var names []string
+	for _, iommuId := range ids {
+		//Retrieve the devices associated with a Iommu group
+		for _, dev := range d.iommuMap[iommuId] {
+			names = append(names, cdiDeviceName(dev.index))
+		}
+	}
+	if m.cfg.Fabric.Mode == config.FabricModeInclude {
+		// NVLink needs every NVSwitch of the partitions in the same VM
+		for _, group := range d.partitionSwitchGroups(ids) {
+			for _, dev := range d.nvswitchMap[group] {
+				names = append(names, cdiDeviceName(dev.index))
+			}
+		}
+	}
+	return names
+}
+
+// PreferredAllocation keeps the devices in as few NVLink fabric partitions
+// as possible, see discovery.preferredAllocation
+func (b *vfioBackend) PreferredAllocation(resource string, available, mustInclude []string, size int) []string {
+	return b.m.current().preferredAllocation(available, mustInclude, size)
+}
+
+// PreStart resets every function of the allocated IOMMU groups
+func (b *vfioBackend) PreStart(resource string, ids []string) error {
+	for _, iommuId := range ids {
+		if err := b.m.resetIommuGroup(iommuId, b.m.cfg.PreStart); err != nil {
+			return fmt.Errorf("failed to reset device %s before container start: %v", iommuId, err)
+		}
+	}
+	return nil
+}
+
+// InUse reports whether the VFIO group or any function of it is opened
+func (b *vfioBackend) InUse(id string) (bool, error) {
+	return b.m.iommuGroupInUse(id)
+}
+
+// Location names the IOMMU group with the BDF of its first function
+func (b *vfioBackend) Location(id string) string {
+	return b.m.current().groupLocation(id)
+}
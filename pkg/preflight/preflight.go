@@ -0,0 +1,222 @@
+// Package preflight checks the host setup VFIO passthrough depends on: an
+// enabled IOMMU, the VFIO modules and the kernel options that weaken the
+// isolation of IOMMU groups. It only reads /proc and /sys.
+package preflight
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	// StatusWarn findings do not prevent passthrough but should be looked at
+	StatusWarn Status = "warn"
+	// StatusFail findings are fatal, no device is advertised
+	StatusFail Status = "fail"
+	// StatusSkip is reported for the checks ignored in the configuration
+	StatusSkip Status = "skip"
+)
+
+// Names of the checks, usable in the ignore list of the configuration
+const (
+	CheckIommu            = "iommu"
+	CheckVfioPci          = "vfio-pci"
+	CheckVfioIommuBackend = "vfio-iommu-backend"
+	CheckUnsafeInterrupts = "unsafe-interrupts"
+	CheckNoIommu          = "noiommu"
+	CheckAcsOverride      = "acs-override"
+)
+
+// Result is the outcome of one check
+type Result struct {
+	Name    string `json:"name" yaml:"name"`
+	Status  Status `json:"status" yaml:"status"`
+	Message string `json:"message" yaml:"message"`
+}
+
+// Report holds the results of all checks, in the order they ran
+type Report struct {
+	Results []Result `json:"results" yaml:"results"`
+}
+
+// Failed reports whether a check found a fatal problem
+func (r Report) Failed() bool {
+	for _, result := range r.Results {
+		if result.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Options locate the host files and select the checks
+type Options struct {
+	// SysfsRoot and ProcRoot are the mount points of sysfs and procfs
+	SysfsRoot string
+	ProcRoot  string
+	// Sysfs is read instead of the tree at SysfsRoot when set, with names
+	// relative to the sysfs mount point
+	Sysfs fs.FS
+	// Ignore are names of checks reported as skipped
+	Ignore []string
+}
+
+// host reads the files the checks look at
+type host struct {
+	sysfs   fs.FS
+	cmdline []string
+}
+
+// check is one preflight check
+type check struct {
+	name string
+	run  func(h host) (Status, string)
+}
+
+var checks = []check{
+	{CheckIommu, checkIommu},
+	{CheckVfioPci, checkVfioPci},
+	{CheckVfioIommuBackend, checkVfioIommuBackend},
+	{CheckUnsafeInterrupts, checkUnsafeInterrupts},
+	{CheckNoIommu, checkNoIommu},
+	{CheckAcsOverride, checkAcsOverride},
+}
+
+// Run runs every check against the host described by opts
+func Run(opts Options) Report {
+	if opts.SysfsRoot == "" {
+		opts.SysfsRoot = "/sys"
+	}
+	if opts.ProcRoot == "" {
+		opts.ProcRoot = "/proc"
+	}
+	h := host{sysfs: opts.Sysfs}
+	if h.sysfs == nil {
+		h.sysfs = os.DirFS(opts.SysfsRoot)
+	}
+	if data, err := os.ReadFile(filepath.Join(opts.ProcRoot, "cmdline")); err == nil {
+		h.cmdline = strings.Fields(string(data))
+	}
+
+	ignored := map[string]bool{}
+	for _, name := range opts.Ignore {
+		ignored[name] = true
+	}
+
+	report := Report{Results: []Result{}}
+	for _, c := range checks {
+		result := Result{Name: c.name}
+		if ignored[c.name] {
+			result.Status, result.Message = StatusSkip, "ignored in the configuration"
+		} else {
+			result.Status, result.Message = c.run(h)
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
+
+// cmdlineValue returns the value of a kernel command line parameter, the last
+// occurrence wins like in the kernel
+func (h host) cmdlineValue(name string) (string, bool) {
+	value, found := "", false
+	for _, arg := range h.cmdline {
+		key, v, _ := strings.Cut(arg, "=")
+		if key == name {
+			value, found = v, true
+		}
+	}
+	return value, found
+}
+
+// moduleLoaded reports whether a module is loaded or built in, both show up
+// below /sys/module
+func (h host) moduleLoaded(module string) bool {
+	_, err := fs.Stat(h.sysfs, path.Join("module", module))
+	return err == nil
+}
+
+// moduleParam reports whether a boolean module parameter is set
+func (h host) moduleParam(module, name string) bool {
+	data, err := fs.ReadFile(h.sysfs, path.Join("module", module, "parameters", name))
+	if err != nil {
+		return false
+	}
+	value := strings.TrimSpace(string(data))
+	return value == "Y" || value == "1"
+}
+
+// cmdlineOption reports whether a kernel command line parameter holding a
+// comma separated list, like intel_iommu=on,sm_off, contains option
+func (h host) cmdlineOption(name, option string) (string, bool) {
+	value, ok := h.cmdlineValue(name)
+	if !ok {
+		return "", false
+	}
+	for _, token := range strings.Split(value, ",") {
+		if token == option {
+			return value, true
+		}
+	}
+	return value, false
+}
+
+func checkIommu(h host) (Status, string) {
+	for _, param := range []string{"intel_iommu", "amd_iommu"} {
+		if value, off := h.cmdlineOption(param, "off"); off {
+			return StatusFail, fmt.Sprintf("IOMMU disabled on the kernel command line with %s=%s", param, value)
+		}
+	}
+	groups, err := fs.ReadDir(h.sysfs, "kernel/iommu_groups")
+	if err != nil || len(groups) == 0 {
+		return StatusFail, "no IOMMU groups, enable the IOMMU in the firmware and with intel_iommu=on or amd_iommu=on on the kernel command line"
+	}
+	return StatusPass, fmt.Sprintf("%d IOMMU groups", len(groups))
+}
+
+func checkVfioPci(h host) (Status, string) {
+	if !h.moduleLoaded("vfio_pci") {
+		return StatusFail, "vfio_pci module not loaded"
+	}
+	return StatusPass, "vfio_pci module loaded"
+}
+
+func checkVfioIommuBackend(h host) (Status, string) {
+	switch {
+	case h.moduleLoaded("vfio_iommu_type1"):
+		return StatusPass, "vfio_iommu_type1 module loaded"
+	case h.moduleLoaded("iommufd"):
+		return StatusWarn, "vfio_iommu_type1 module not loaded, relying on the iommufd VFIO compatibility"
+	default:
+		return StatusFail, "neither vfio_iommu_type1 nor iommufd loaded, VFIO containers cannot be created"
+	}
+}
+
+func checkUnsafeInterrupts(h host) (Status, string) {
+	if h.moduleParam("vfio_iommu_type1", "allow_unsafe_interrupts") {
+		return StatusWarn, "vfio_iommu_type1 allow_unsafe_interrupts is set, a device may inject interrupts into the host without interrupt remapping"
+	}
+	return StatusPass, "interrupt remapping required"
+}
+
+func checkNoIommu(h host) (Status, string) {
+	if h.moduleParam("vfio", "enable_unsafe_noiommu_mode") {
+		return StatusFail, "vfio enable_unsafe_noiommu_mode is set, devices are not isolated by an IOMMU"
+	}
+	return StatusPass, "no-IOMMU mode disabled"
+}
+
+func checkAcsOverride(h host) (Status, string) {
+	if value, ok := h.cmdlineValue("pcie_acs_override"); ok {
+		return StatusFail, fmt.Sprintf("pcie_acs_override=%s on the kernel command line, IOMMU groups do not reflect the real isolation", value)
+	}
+	return StatusPass, "no ACS override"
+}
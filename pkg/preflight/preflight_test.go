@@ -0,0 +1,167 @@
+package preflight
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// healthyHost is the sysfs of a host passing every check
+func healthyHost() fstest.MapFS {
+	return fstest.MapFS{
+		"kernel/iommu_groups/0/devices":                              &fstest.MapFile{Mode: os.ModeDir},
+		"kernel/iommu_groups/1/devices":                              &fstest.MapFile{Mode: os.ModeDir},
+		"module/vfio_pci":                                            &fstest.MapFile{Mode: os.ModeDir},
+		"module/vfio_iommu_type1/parameters/allow_unsafe_interrupts": &fstest.MapFile{Data: []byte("N\n")},
+		"module/vfio/parameters/enable_unsafe_noiommu_mode":          &fstest.MapFile{Data: []byte("N\n")},
+	}
+}
+
+// runChecks runs the checks against sysfs and a kernel command line
+func runChecks(t *testing.T, sysfs fstest.MapFS, cmdline string, ignore ...string) map[string]Result {
+	t.Helper()
+	proc := t.TempDir()
+	if err := os.WriteFile(filepath.Join(proc, "cmdline"), []byte(cmdline+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report := Run(Options{ProcRoot: proc, Sysfs: sysfs, Ignore: ignore})
+	if len(report.Results) != len(checks) {
+		t.Fatalf("expected %d results, got %+v", len(checks), report.Results)
+	}
+	results := map[string]Result{}
+	for _, result := range report.Results {
+		results[result.Name] = result
+	}
+	return results
+}
+
+func TestCmdlineValue(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		name    string
+		value   string
+		found   bool
+	}{
+		{"ro quiet intel_iommu=on", "intel_iommu", "on", true},
+		{"intel_iommu=off intel_iommu=on,sm_off", "intel_iommu", "on,sm_off", true},
+		{"amd_iommu=off", "intel_iommu", "", false},
+		{"pcie_acs_override", "pcie_acs_override", "", true},
+		{"", "intel_iommu", "", false},
+	}
+	for _, test := range tests {
+		h := host{cmdline: strings.Fields(test.cmdline)}
+		value, found := h.cmdlineValue(test.name)
+		if value != test.value || found != test.found {
+			t.Errorf("%q: %s = %q, %v, expected %q, %v", test.cmdline, test.name, value, found, test.value, test.found)
+		}
+	}
+}
+
+func TestCheckIommu(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		status  Status
+	}{
+		{"intel_iommu=on", StatusPass},
+		{"intel_iommu=on,igfx_off", StatusPass},
+		{"intel_iommu=on,sm_off", StatusPass},
+		{"amd_iommu=pgtbl_v2", StatusPass},
+		{"", StatusPass},
+		{"intel_iommu=off", StatusFail},
+		{"intel_iommu=igfx_off,off", StatusFail},
+		{"amd_iommu=off", StatusFail},
+		{"intel_iommu=off intel_iommu=on", StatusPass},
+	}
+	for _, test := range tests {
+		status, message := checkIommu(host{sysfs: healthyHost(), cmdline: strings.Fields(test.cmdline)})
+		if status != test.status {
+			t.Errorf("%q: expected %s, got %s: %s", test.cmdline, test.status, status, message)
+		}
+	}
+
+	if status, _ := checkIommu(host{sysfs: fstest.MapFS{}}); status != StatusFail {
+		t.Errorf("expected a host without IOMMU groups to fail, got %s", status)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(fstest.MapFS)
+		cmdline string
+		ignore  []string
+		check   string
+		status  Status
+	}{
+		{name: "no vfio_pci", modify: func(sysfs fstest.MapFS) { delete(sysfs, "module/vfio_pci") }, check: CheckVfioPci, status: StatusFail},
+		{name: "type1", check: CheckVfioIommuBackend, status: StatusPass},
+		{
+			name: "iommufd compatibility",
+			modify: func(sysfs fstest.MapFS) {
+				delete(sysfs, "module/vfio_iommu_type1/parameters/allow_unsafe_interrupts")
+				sysfs["module/iommufd"] = &fstest.MapFile{Mode: os.ModeDir}
+			},
+			check:  CheckVfioIommuBackend,
+			status: StatusWarn,
+		},
+		{
+			name:   "no iommu backend",
+			modify: func(sysfs fstest.MapFS) { delete(sysfs, "module/vfio_iommu_type1/parameters/allow_unsafe_interrupts") },
+			check:  CheckVfioIommuBackend,
+			status: StatusFail,
+		},
+		{
+			name: "unsafe interrupts",
+			modify: func(sysfs fstest.MapFS) {
+				sysfs["module/vfio_iommu_type1/parameters/allow_unsafe_interrupts"] = &fstest.MapFile{Data: []byte("Y\n")}
+			},
+			check:  CheckUnsafeInterrupts,
+			status: StatusWarn,
+		},
+		{name: "interrupt remapping", check: CheckUnsafeInterrupts, status: StatusPass},
+		{
+			name: "noiommu",
+			modify: func(sysfs fstest.MapFS) {
+				sysfs["module/vfio/parameters/enable_unsafe_noiommu_mode"] = &fstest.MapFile{Data: []byte("1\n")}
+			},
+			check:  CheckNoIommu,
+			status: StatusFail,
+		},
+		{name: "no noiommu", check: CheckNoIommu, status: StatusPass},
+		{name: "acs override", cmdline: "pcie_acs_override=downstream,multifunction", check: CheckAcsOverride, status: StatusFail},
+		{name: "no acs override", check: CheckAcsOverride, status: StatusPass},
+		{name: "iommu off", cmdline: "intel_iommu=off", check: CheckIommu, status: StatusFail},
+		{name: "ignored", cmdline: "intel_iommu=off", ignore: []string{CheckIommu}, check: CheckIommu, status: StatusSkip},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sysfs := healthyHost()
+			if test.modify != nil {
+				test.modify(sysfs)
+			}
+			result := runChecks(t, sysfs, test.cmdline, test.ignore...)[test.check]
+			if result.Status != test.status {
+				t.Fatalf("expected %s to report %s, got %s: %s", test.check, test.status, result.Status, result.Message)
+			}
+		})
+	}
+}
+
+func TestRunHealthyHost(t *testing.T) {
+	for name, result := range runChecks(t, healthyHost(), "intel_iommu=on iommu=pt") {
+		if result.Status != StatusPass {
+			t.Errorf("expected %s to pass, got %s: %s", name, result.Status, result.Message)
+		}
+	}
+}
+
+func TestReportFailed(t *testing.T) {
+	if (Report{Results: []Result{{Status: StatusPass}, {Status: StatusWarn}, {Status: StatusSkip}}}).Failed() {
+		t.Fatal("report without failures reported as failed")
+	}
+	if !(Report{Results: []Result{{Status: StatusPass}, {Status: StatusFail}}}).Failed() {
+		t.Fatal("report with a failure not reported as failed")
+	}
+}
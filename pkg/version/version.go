@@ -0,0 +1,5 @@
+package version
+
+// Version of the kata-xpu-device-plugin, set at build time through
+// -ldflags "-X kata-xpu-device-plugin/pkg/version.Version=<version>"
+var Version = "v1.3.1"
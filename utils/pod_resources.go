@@ -3,14 +3,15 @@ package utils
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/url"
 	"path/filepath"
+	"strings"
 	"time"
 
-	v1alpha1 "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
+	"google.golang.org/grpc"
+	klog "k8s.io/klog/v2"
+	v1 "k8s.io/kubelet/pkg/apis/podresources/v1"
 	"k8s.io/kubernetes/pkg/kubelet/apis/podresources"
-	"k8s.io/kubernetes/pkg/kubelet/util"
 )
 
 const (
@@ -21,16 +22,19 @@ const (
 const (
 	// Kubelet internal cgroup name for node allocatable cgroup.
 	defaultNodeAllocatableCgroup = "kubepods"
-	// defaultPodResourcesPath is the path to the local endpoint serving the podresources GRPC service.
-	defaultPodResourcesPath    = "/var/lib/kubelet/pod-resources"
-	defaultPodResourcesTimeout = 10 * time.Second
-	defaultPodResourcesMaxSize = 1024 * 1024 * 16 // 16 Mb
+	// DefaultPodResourcesSocket is the local endpoint serving the podresources GRPC service.
+	DefaultPodResourcesSocket         = "/var/lib/kubelet/pod-resources/kubelet.sock"
+	defaultPodResourcesConnectTimeout = 10 * time.Second
+	defaultPodResourcesRequestTimeout = 10 * time.Second
+	defaultPodResourcesMaxSize        = 1024 * 1024 * 16 // 16 Mb
 
 )
 
 // LocalEndpoint returns the full path to a unix socket at the given endpoint
 func LocalEndpoint(path, file string) (string, error) {
-	log.Printf("endpoint Path: %v, file: %v", path, file)
+	if path == "" || file == "" {
+		return "", fmt.Errorf("invalid unix socket endpoint: path %q, file %q", path, file)
+	}
 	u := url.URL{
 		Scheme: unixProtocol,
 		Path:   path,
@@ -38,24 +42,201 @@ func LocalEndpoint(path, file string) (string, error) {
 	return filepath.Join(u.String(), file+".sock"), nil
 }
 
-func GetV1alpha1PodResources(ctx context.Context) (*v1alpha1.ListPodResourcesResponse, error) {
-	endpoint, err := util.LocalEndpoint(defaultPodResourcesPath, podresources.Socket)
+// PodResourcesOptions configures the client of the kubelet pod-resources API
+type PodResourcesOptions struct {
+	// Socket is the path of the pod-resources unix socket
+	Socket string
+	// ConnectionTimeout bounds the dial of the socket
+	ConnectionTimeout time.Duration
+	// RequestTimeout bounds every single request
+	RequestTimeout time.Duration
+	// MaxMessageSize is the maximum size of a response
+	MaxMessageSize int
+}
+
+// DefaultPodResourcesOptions returns the options matching a default kubelet setup
+func DefaultPodResourcesOptions() PodResourcesOptions {
+	return PodResourcesOptions{
+		Socket:            DefaultPodResourcesSocket,
+		ConnectionTimeout: defaultPodResourcesConnectTimeout,
+		RequestTimeout:    defaultPodResourcesRequestTimeout,
+		MaxMessageSize:    defaultPodResourcesMaxSize,
+	}
+}
+
+// PodResourcesClient talks to the v1 kubelet pod-resources API
+type PodResourcesClient struct {
+	opts   PodResourcesOptions
+	client v1.PodResourcesListerClient
+	conn   *grpc.ClientConn
+}
+
+// DeviceAssignment describes the devices of one resource assigned to a container
+type DeviceAssignment struct {
+	Namespace    string
+	Pod          string
+	Container    string
+	ResourceName string
+	DeviceIDs    []string
+	// CDIDevices are the fully qualified CDI names kubelet reports for a resource claim
+	CDIDevices []string
+}
+
+// NewPodResourcesClient connects to the pod-resources API. Zero values in
+// opts are replaced by the defaults.
+func NewPodResourcesClient(opts PodResourcesOptions) (*PodResourcesClient, error) {
+	defaults := DefaultPodResourcesOptions()
+	if opts.Socket == "" {
+		opts.Socket = defaults.Socket
+	}
+	if opts.ConnectionTimeout == 0 {
+		opts.ConnectionTimeout = defaults.ConnectionTimeout
+	}
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = defaults.RequestTimeout
+	}
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = defaults.MaxMessageSize
+	}
+
+	endpoint := opts.Socket
+	if !strings.Contains(endpoint, "://") {
+		endpoint = unixProtocol + "://" + endpoint
+	}
+	client, conn, err := podresources.GetV1Client(endpoint, opts.ConnectionTimeout, opts.MaxMessageSize)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting local endpoint: %w", err)
+		return nil, fmt.Errorf("error getting grpc client: %w", err)
 	}
-	client, conn, err := podresources.GetV1alpha1Client(endpoint, defaultPodResourcesTimeout, defaultPodResourcesMaxSize)
+
+	return &PodResourcesClient{opts: opts, client: client, conn: conn}, nil
+}
+
+// Close closes the connection to kubelet
+func (c *PodResourcesClient) Close() error {
+	return c.conn.Close()
+}
+
+// List returns the resources assigned to all pods of the node
+func (c *PodResourcesClient) List(ctx context.Context) (*v1.ListPodResourcesResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.RequestTimeout)
+	defer cancel()
+
+	resp, err := c.client.List(ctx, &v1.ListPodResourcesRequest{})
 	if err != nil {
-		return nil, fmt.Errorf("Error getting grpc client: %w", err)
+		return nil, fmt.Errorf("failed to list pod resources: %w", err)
 	}
-	defer conn.Close()
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	klog.V(4).Infof("Pod resources: %d pods", len(resp.GetPodResources()))
+	return resp, nil
+}
+
+// Get returns the resources assigned to a single pod. It requires the
+// KubeletPodResourcesGet feature gate on the kubelet.
+func (c *PodResourcesClient) Get(ctx context.Context, namespace, name string) (*v1.PodResources, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.RequestTimeout)
 	defer cancel()
-	resp, err := client.List(ctx, &v1alpha1.ListPodResourcesRequest{})
+
+	resp, err := c.client.Get(ctx, &v1.GetPodResourcesRequest{PodNamespace: namespace, PodName: name})
 	if err != nil {
-		return nil, fmt.Errorf("%v.Get(_) = _, %v", client, err)
+		return nil, fmt.Errorf("failed to get resources of pod %s/%s: %w", namespace, name, err)
 	}
+	return resp.GetPodResources(), nil
+}
 
-	log.Printf("Pod Resources Response %#v", resp)
+// GetAllocatableResources returns the resources kubelet may allocate on the node
+func (c *PodResourcesClient) GetAllocatableResources(ctx context.Context) (*v1.AllocatableResourcesResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.RequestTimeout)
+	defer cancel()
 
+	resp, err := c.client.GetAllocatableResources(ctx, &v1.AllocatableResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get allocatable resources: %w", err)
+	}
 	return resp, nil
 }
+
+// AllocatedDevices returns the devices of the resources starting with
+// resourcePrefix assigned to the containers of all pods
+func (c *PodResourcesClient) AllocatedDevices(ctx context.Context, resourcePrefix string) ([]DeviceAssignment, error) {
+	resp, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	assignments := []DeviceAssignment{}
+	for _, pod := range resp.GetPodResources() {
+		assignments = append(assignments, DeviceAssignments(pod, resourcePrefix)...)
+	}
+	return assignments, nil
+}
+
+// PodDevices returns the devices of the resources starting with
+// resourcePrefix assigned to the containers of a single pod
+func (c *PodResourcesClient) PodDevices(ctx context.Context, namespace, name, resourcePrefix string) ([]DeviceAssignment, error) {
+	pod, err := c.Get(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return DeviceAssignments(pod, resourcePrefix), nil
+}
+
+// AllocatableDevices returns the device IDs kubelet may allocate for every
+// resource starting with resourcePrefix
+func (c *PodResourcesClient) AllocatableDevices(ctx context.Context, resourcePrefix string) (map[string][]string, error) {
+	resp, err := c.GetAllocatableResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string][]string)
+	for _, devs := range resp.GetDevices() {
+		if !strings.HasPrefix(devs.GetResourceName(), resourcePrefix) {
+			continue
+		}
+		devices[devs.GetResourceName()] = append(devices[devs.GetResourceName()], devs.GetDeviceIds()...)
+	}
+	return devices, nil
+}
+
+// DeviceAssignments extracts the devices of the resources starting with
+// resourcePrefix from the resources of a pod. Kubelet reports CDI device
+// names only for dynamic resource claims, those are returned with the claim
+// class as resource name and matched against the prefix by their CDI name.
+func DeviceAssignments(pod *v1.PodResources, resourcePrefix string) []DeviceAssignment {
+	assignments := []DeviceAssignment{}
+	for _, container := range pod.GetContainers() {
+		for _, devs := range container.GetDevices() {
+			if !strings.HasPrefix(devs.GetResourceName(), resourcePrefix) {
+				continue
+			}
+			assignments = append(assignments, DeviceAssignment{
+				Namespace:    pod.GetNamespace(),
+				Pod:          pod.GetName(),
+				Container:    container.GetName(),
+				ResourceName: devs.GetResourceName(),
+				DeviceIDs:    devs.GetDeviceIds(),
+			})
+		}
+
+		for _, dynamic := range container.GetDynamicResources() {
+			cdiDevices := []string{}
+			for _, claim := range dynamic.GetClaimResources() {
+				for _, cdiDevice := range claim.GetCDIDevices() {
+					if strings.HasPrefix(cdiDevice.GetName(), resourcePrefix) {
+						cdiDevices = append(cdiDevices, cdiDevice.GetName())
+					}
+				}
+			}
+			if len(cdiDevices) == 0 {
+				continue
+			}
+			assignments = append(assignments, DeviceAssignment{
+				Namespace:    pod.GetNamespace(),
+				Pod:          pod.GetName(),
+				Container:    container.GetName(),
+				ResourceName: dynamic.GetClassName(),
+				CDIDevices:   cdiDevices,
+			})
+		}
+	}
+	return assignments
+}
@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	v1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// fakeLister serves pod resources from memory
+type fakeLister struct {
+	pods        []*v1.PodResources
+	allocatable []*v1.ContainerDevices
+	err         error
+}
+
+func (f *fakeLister) List(ctx context.Context, in *v1.ListPodResourcesRequest, opts ...grpc.CallOption) (*v1.ListPodResourcesResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &v1.ListPodResourcesResponse{PodResources: f.pods}, nil
+}
+
+func (f *fakeLister) GetAllocatableResources(ctx context.Context, in *v1.AllocatableResourcesRequest, opts ...grpc.CallOption) (*v1.AllocatableResourcesResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &v1.AllocatableResourcesResponse{Devices: f.allocatable}, nil
+}
+
+func (f *fakeLister) Get(ctx context.Context, in *v1.GetPodResourcesRequest, opts ...grpc.CallOption) (*v1.GetPodResourcesResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	for _, pod := range f.pods {
+		if pod.GetNamespace() == in.GetPodNamespace() && pod.GetName() == in.GetPodName() {
+			return &v1.GetPodResourcesResponse{PodResources: pod}, nil
+		}
+	}
+	return nil, errors.New("pod not found")
+}
+
+func newFakeClient(lister *fakeLister) *PodResourcesClient {
+	return &PodResourcesClient{opts: DefaultPodResourcesOptions(), client: lister}
+}
+
+const testPrefix = "nvidia.com/GH100"
+
+func testPod() *v1.PodResources {
+	return &v1.PodResources{
+		Namespace: "default",
+		Name:      "vm",
+		Containers: []*v1.ContainerResources{
+			{
+				Name: "compute",
+				Devices: []*v1.ContainerDevices{
+					{ResourceName: "nvidia.com/GH100_H100_SXM5_80GB", DeviceIds: []string{"1", "2"}},
+					{ResourceName: "nvidia.com/gpu", DeviceIds: []string{"GPU-0"}},
+				},
+			},
+			{
+				Name: "sidecar",
+				Devices: []*v1.ContainerDevices{
+					{ResourceName: "nvidia.com/GH100_H100_SXM5_80GB", DeviceIds: []string{"3"}},
+					{ResourceName: "example.com/nic", DeviceIds: []string{"eth1"}},
+				},
+			},
+			{
+				Name: "claims",
+				DynamicResources: []*v1.DynamicResource{
+					{
+						ClassName: "vfio.kata.io",
+						ClaimName: "gpu",
+						ClaimResources: []*v1.ClaimResource{{CDIDevices: []*v1.CDIDevice{
+							{Name: "nvidia.com/GH100_H100_SXM5_80GB=4"},
+							{Name: "example.com/nic=eth2"},
+						}}},
+					},
+					{
+						ClassName:      "nic.example.com",
+						ClaimName:      "nic",
+						ClaimResources: []*v1.ClaimResource{{CDIDevices: []*v1.CDIDevice{{Name: "example.com/nic=eth3"}}}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestDeviceAssignments(t *testing.T) {
+	want := []DeviceAssignment{
+		{Namespace: "default", Pod: "vm", Container: "compute", ResourceName: "nvidia.com/GH100_H100_SXM5_80GB", DeviceIDs: []string{"1", "2"}},
+		{Namespace: "default", Pod: "vm", Container: "sidecar", ResourceName: "nvidia.com/GH100_H100_SXM5_80GB", DeviceIDs: []string{"3"}},
+		{Namespace: "default", Pod: "vm", Container: "claims", ResourceName: "vfio.kata.io", CDIDevices: []string{"nvidia.com/GH100_H100_SXM5_80GB=4"}},
+	}
+	if got := DeviceAssignments(testPod(), testPrefix); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected assignments\n got %+v\nwant %+v", got, want)
+	}
+
+	if got := DeviceAssignments(testPod(), "vendor.example/"); len(got) != 0 {
+		t.Fatalf("expected no assignments for a foreign prefix, got %+v", got)
+	}
+}
+
+func TestPodResourcesClient(t *testing.T) {
+	ctx := context.Background()
+	lister := &fakeLister{
+		pods: []*v1.PodResources{testPod(), {Namespace: "default", Name: "idle"}},
+		allocatable: []*v1.ContainerDevices{
+			{ResourceName: "nvidia.com/GH100_H100_SXM5_80GB", DeviceIds: []string{"1", "2"}},
+			{ResourceName: "nvidia.com/GH100_H100_SXM5_80GB", DeviceIds: []string{"3", "4"}},
+			{ResourceName: "nvidia.com/gpu", DeviceIds: []string{"GPU-0"}},
+		},
+	}
+	client := newFakeClient(lister)
+
+	assignments, err := client.AllocatedDevices(ctx, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assignments) != 3 {
+		t.Fatalf("expected 3 assignments, got %+v", assignments)
+	}
+
+	pod, err := client.Get(ctx, "default", "vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.GetName() != "vm" {
+		t.Fatalf("unexpected pod %q", pod.GetName())
+	}
+
+	podDevices, err := client.PodDevices(ctx, "default", "vm", testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(podDevices, assignments) {
+		t.Fatalf("unexpected pod devices %+v", podDevices)
+	}
+	if _, err := client.PodDevices(ctx, "default", "missing", testPrefix); err == nil {
+		t.Fatal("expected an error for a missing pod")
+	}
+
+	allocatable, err := client.AllocatableDevices(ctx, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"nvidia.com/GH100_H100_SXM5_80GB": {"1", "2", "3", "4"}}
+	if !reflect.DeepEqual(allocatable, want) {
+		t.Fatalf("unexpected allocatable devices %v", allocatable)
+	}
+
+	lister.err = errors.New("kubelet unavailable")
+	if _, err := client.AllocatedDevices(ctx, testPrefix); !errors.Is(err, lister.err) {
+		t.Fatalf("expected the list error, got %v", err)
+	}
+	if _, err := client.AllocatableDevices(ctx, testPrefix); !errors.Is(err, lister.err) {
+		t.Fatalf("expected the allocatable error, got %v", err)
+	}
+	if _, err := client.Get(ctx, "default", "vm"); !errors.Is(err, lister.err) {
+		t.Fatalf("expected the get error, got %v", err)
+	}
+}